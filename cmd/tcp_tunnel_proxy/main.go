@@ -3,86 +3,277 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
 	"tcp-tunnel-proxy/configs"
+	"tcp-tunnel-proxy/internal/accesslog"
 	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
 	connectionhandler "tcp-tunnel-proxy/internal/connection_handler"
 	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/ratelimit"
+	"tcp-tunnel-proxy/internal/routes"
+	"tcp-tunnel-proxy/internal/systemd"
+	"tcp-tunnel-proxy/internal/tracing"
+	"tcp-tunnel-proxy/internal/upgrade"
+	"tcp-tunnel-proxy/internal/webhook"
+	"tcp-tunnel-proxy/pkg/ech"
+	"time"
 )
 
 func main() {
-	cfg, err := configs.LoadConfigFromEnv()
+	if len(os.Args) > 1 && os.Args[1] == "ech-keygen" {
+		if err := runECHKeygen(os.Args[2:]); err != nil {
+			log.Fatalf("ech-keygen: %v", err)
+		}
+		return
+	}
+
+	loaded, err := configs.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if loaded.PrintConfig {
+		if perr := loaded.Print(os.Stdout); perr != nil {
+			log.Fatalf("print config: %v", perr)
+		}
+		if err != nil {
+			log.Fatalf("invalid configuration: %v", err)
+		}
+		return
+	}
 	if err != nil {
 		log.Fatalf("invalid configuration: %v", err)
 	}
+	cfg := loaded.Config
 	logging.Setup(cfg.LogFormat)
+	_ = logging.SetLevels(cfg.LogLevel) // validated by configs.Load
+	logOut, err := logging.OpenOutput(cfg.LogOutput, logRotation(&cfg))
+	if err != nil {
+		log.Fatalf("log output: %v", err)
+	}
+	defer logOut.Close()
+	logging.SetOutput(logOut)
 	logger := logging.New("main")
-	manager, err := cloudflaredmanager.NewNodeManager(cloudflaredmanager.Config{
-		IdleTimeout:    cfg.IdleTimeout,
-		StartupTimeout: cfg.StartupTimeout,
-		PortRangeStart: cfg.PortRangeStart,
-		PortRangeEnd:   cfg.PortRangeEnd,
-	})
+	var cloudflaredLogger *logging.Logger // nil logs cloudflared's output with the rest
+	if cfg.CloudflaredLog != "" && cfg.CloudflaredLog != cfg.LogOutput {
+		out, err := logging.OpenOutput(cfg.CloudflaredLog, logRotation(&cfg))
+		if err != nil {
+			log.Fatalf("cloudflared log output: %v", err)
+		}
+		defer out.Close()
+		cloudflaredLogger = logging.NewWithWriter("node_manager", out)
+	}
+	logSampler := logging.NewSampler(cfg.LogSampleBurst, cfg.LogSampleInterval)
+	routeTable, err := routes.New(cfg.Routes)
+	if err != nil {
+		log.Fatalf("invalid routes: %v", err)
+	}
+	var echKeys *ech.KeySet
+	if cfg.ECHKeysFile != "" {
+		echKeys, err = ech.LoadKeysFile(cfg.ECHKeysFile)
+		if err != nil {
+			log.Fatalf("invalid ECH keys: %v", err)
+		}
+		logger.Infof("ECH enabled for public names %v; publish ECHConfigList in the HTTPS record: ech=%s", echKeys.PublicNames(), echKeys.ConfigListBase64())
+	}
+	upg, err := upgrade.New()
+	if err != nil {
+		log.Fatalf("invalid upgrade handoff: %v", err)
+	}
+	notifier := systemd.NewNotifier()
+	activated, err := systemd.Sockets("proxy", "admin")
+	if err != nil {
+		logger.Errorf("socket activation: %v", err)
+	}
+	for name, f := range activated {
+		upg.Adopt(name, f)
+	}
+	var tracer *tracing.Tracer
+	if cfg.OTLPEndpoint != "" {
+		tracer, err = tracing.New(tracing.Config{
+			Endpoint:    cfg.OTLPEndpoint,
+			ServiceName: cfg.TraceServiceName,
+			SampleRatio: cfg.TraceSampleRatio,
+		})
+		if err != nil {
+			log.Fatalf("tracing: %v", err)
+		}
+		logger.Infof("Exporting traces to %s (sample ratio %g)", configs.RedactURL(cfg.OTLPEndpoint), cfg.TraceSampleRatio)
+	}
+	manager, err := newManager(&cfg, tracer, cloudflaredLogger)
 	if err != nil {
 		log.Fatalf("failed to construct node manager: %v", err)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	webhookDone, err := startWebhook(&cfg, manager)
 	if err != nil {
-		logger.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+		log.Fatalf("webhook: %v", err)
+	}
+	if cfg.WebhookURL != "" {
+		logger.Infof("Sending tunnel events to a webhook (batches of up to %d)", cfg.WebhookBatchSize)
+	}
+	if upg.Inherited() {
+		// The children in the state file belong to the previous process, which is still draining.
+		logger.Infof("Started by an upgrade; skipping orphan recovery")
+	} else if err := manager.RecoverOrphans(context.Background()); err != nil {
+		logger.Errorf("orphan recovery failed: %v", err)
+	}
+	var accessLog *accesslog.Sink
+	if cfg.AccessLog != "" {
+		accessLog, err = accesslog.Open(cfg.AccessLog, cfg.AccessLogFormat, logRotation(&cfg))
+		if err != nil {
+			logger.Errorf("failed to open access log: %v", err)
+			return
+		}
+		defer accessLog.Close()
+	}
+
+	p := newProxy(&cfg, os.Args[1:], manager, upg, notifier, connectionhandler.Options{
+		ReadHelloTimeout: cfg.ReadHelloTimeout,
+		Routes:           routeTable,
+		ECHKeys:          echKeys,
+		AccessLog:        accessLog,
+		Limiters:         ratelimit.NewRegistry(),
+		Tracer:           tracer,
+		LogSampler:       logSampler,
+	}, logger)
+	if err := p.listen(); err != nil {
+		logger.Errorf("%v", err)
+		p.shutdown("startup failed")
 		return
 	}
-	logger.Infof("Routing oracle listening on %s", cfg.ListenAddr)
+	p.start()
+	p.handleSignals()
+	p.wait()
 
-	var shutdownOnce sync.Once
-	shutdown := func(reason string) {
-		shutdownOnce.Do(func() {
-			logger.Infof("Shutting down: %s", reason)
-			cancel()
-			_ = ln.Close()
-			manager.Shutdown(context.Background())
-		})
+	// Give the last events one request timeout to go out; a batch still being retried is abandoned.
+	select {
+	case <-webhookDone:
+	case <-time.After(cfg.WebhookTimeout):
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFlush()
+	if err := tracer.Shutdown(flushCtx); err != nil {
+		logger.Errorf("tracing: %v", err)
 	}
+}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+// newManager builds the node manager that runs cloudflared for each tunnel hostname.
+func newManager(cfg *configs.Config, tracer *tracing.Tracer, outputLogger *logging.Logger) (*cloudflaredmanager.NodeManager, error) {
+	return cloudflaredmanager.NewNodeManager(cloudflaredmanager.Config{
+		IdleTimeout:    cfg.IdleTimeout,
+		StartupTimeout: cfg.StartupTimeout,
+		PortRangeStart: cfg.PortRangeStart,
+		PortRangeEnd:   cfg.PortRangeEnd,
+		PortQuarantine: cfg.PortQuarantine,
+		LoopbackCIDR:   cfg.LoopbackCIDR,
+		LoopbackPort:   cfg.LoopbackPort,
+		Restart:        restartPolicy(cfg),
+
+		LivenessInterval: cfg.LivenessInterval,
+		LivenessFailures: cfg.LivenessFailures,
+		BreakerFailures:  cfg.BreakerFailures,
+		BreakerCooldown:  cfg.BreakerCooldown,
+		MaxTunnels:       cfg.MaxTunnels,
+		MaxTunnelsWait:   cfg.MaxTunnelsWait,
+		Child: cloudflaredmanager.ChildPolicy{
+			Pdeathsig:    cfg.ChildPdeathsig,
+			Setpgid:      cfg.ChildSetpgid,
+			User:         cfg.ChildUser,
+			Group:        cfg.ChildGroup,
+			RLimitNoFile: cfg.ChildRLimitNoFile,
+			RLimitAS:     cfg.ChildRLimitAS,
+			EnvAllowlist: cfg.ChildEnvAllowlist,
+		},
+		StateFile:    cfg.StateFile,
+		Binary:       cfg.CloudflaredBin,
+		ArgsTemplate: cfg.CloudflaredArgs,
+		ExtraArgs:    cfg.CloudflaredExtraArgs,
+		Tracer:       tracer,
+		OutputLogger: outputLogger,
+	})
+}
+
+// startWebhook sends lifecycle events to WEBHOOK_URL until manager.Shutdown closes the subscription. The returned
+// channel is closed once the last batch has been flushed, or at once when no webhook is configured.
+func startWebhook(cfg *configs.Config, manager *cloudflaredmanager.NodeManager) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	if cfg.WebhookURL == "" {
+		close(done)
+		return done, nil
+	}
+	types := make([]cloudflaredmanager.EventType, 0, len(cfg.WebhookEvents))
+	for _, name := range cfg.WebhookEvents {
+		t, _ := cloudflaredmanager.ParseEventType(name) // validated by configs
+		types = append(types, t)
+	}
+	sink, err := webhook.New(webhook.Config{
+		URL:           cfg.WebhookURL,
+		Types:         types,
+		BatchSize:     cfg.WebhookBatchSize,
+		FlushInterval: cfg.WebhookFlushInterval,
+		MaxRetries:    cfg.WebhookMaxRetries,
+		Timeout:       cfg.WebhookTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	events, _ := manager.Subscribe(1024)
 	go func() {
-		<-sigCh
-		shutdown("received signal")
+		defer close(done)
+		sink.Run(context.Background(), events)
 	}()
+	return done, nil
+}
 
-	var wg sync.WaitGroup
+// runECHKeygen writes a new ECH keys file and prints the ECHConfigList to publish in DNS.
+func runECHKeygen(args []string) error {
+	fs := flag.NewFlagSet("ech-keygen", flag.ContinueOnError)
+	publicName := fs.String("public-name", "", "public (outer) SNI clients connect to, e.g. ech.example.com")
+	configID := fs.Uint("config-id", 0, "ECH config id (0-255); rotate it alongside the key")
+	out := fs.String("out", "", "path of the keys file to write (mode 0600)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *publicName == "" || *out == "" || *configID > 255 {
+		fs.Usage()
+		return errors.New("-public-name and -out are required; -config-id must be 0-255")
+	}
+	key, err := ech.GenerateKey(*publicName, uint8(*configID))
+	if err != nil {
+		return err
+	}
+	keys, err := ech.NewKeySet([]ech.Key{key})
+	if err != nil {
+		return err
+	}
+	data, err := ech.MarshalKeysFile([]ech.Key{key})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	fmt.Println(keys.ConfigListBase64())
+	return nil
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if ctx.Err() != nil {
-				break
-			}
-			if errors.Is(err, net.ErrClosed) {
-				break
-			}
-			if ne, ok := err.(net.Error); ok && ne.Timeout() {
-				logger.Errorf("accept timeout: %v", err)
-				continue
-			}
-			shutdown("listener error")
-			break
-		}
-		wg.Add(1)
-		go func(c net.Conn) {
-			defer wg.Done()
-			connectionhandler.HandleConnection(c, manager, cfg.ReadHelloTimeout, logging.New("connection"))
-		}(conn)
+func restartPolicy(cfg *configs.Config) cloudflaredmanager.RestartPolicy {
+	return cloudflaredmanager.RestartPolicy{
+		Backoff:     cfg.RestartBackoff,
+		MaxBackoff:  cfg.RestartMaxBackoff,
+		Jitter:      cfg.RestartJitter,
+		MaxRestarts: cfg.MaxRestarts,
+		Window:      cfg.RestartWindow,
 	}
+}
 
-	wg.Wait()
-	shutdown("accept loop exited")
+func logRotation(cfg *configs.Config) logging.Rotation {
+	return logging.Rotation{
+		MaxSize:    int64(cfg.LogMaxSizeMB) << 20,
+		MaxAge:     cfg.LogMaxAge,
+		MaxBackups: cfg.LogMaxBackups,
+		Compress:   cfg.LogCompress,
+	}
 }
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"tcp-tunnel-proxy/configs"
+	"tcp-tunnel-proxy/internal/admin"
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+	connectionhandler "tcp-tunnel-proxy/internal/connection_handler"
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/routes"
+	"tcp-tunnel-proxy/internal/systemd"
+	"tcp-tunnel-proxy/internal/upgrade"
+	"tcp-tunnel-proxy/pkg/ech"
+	"time"
+)
+
+// proxy is the running server: its listeners, the connections accepted on them, and the reload, upgrade and
+// shutdown paths that act on both.
+type proxy struct {
+	args     []string // command line, re-read by reloadConfig
+	logger   *logging.Logger
+	manager  *cloudflaredmanager.NodeManager
+	upg      *upgrade.Upgrader
+	notifier *systemd.Notifier
+	adminSrv *admin.Server
+
+	current  atomic.Pointer[configs.Config]            // the configuration in effect
+	connOpts atomic.Pointer[connectionhandler.Options] // read once per connection, so a reload never changes a running one
+
+	ctx    context.Context // cancelled once the proxy stops accepting
+	cancel context.CancelFunc
+
+	lnMu    sync.Mutex // guards ln and adminLn, which a reload may replace
+	ln      net.Listener
+	adminLn net.Listener
+
+	reloadMu     sync.Mutex
+	upgraded     atomic.Bool
+	stopOnce     sync.Once
+	shutdownOnce sync.Once
+
+	conns          sync.WaitGroup // connections being handled
+	acceptWG       sync.WaitGroup // running accept loops
+	activeConns    atomic.Int64
+	acceptReturned atomic.Int64 // unix nanos while an accept loop is dispatching, 0 while in Accept
+}
+
+func newProxy(cfg *configs.Config, args []string, manager *cloudflaredmanager.NodeManager, upg *upgrade.Upgrader,
+	notifier *systemd.Notifier, opts connectionhandler.Options, logger *logging.Logger) *proxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &proxy{
+		args:     args,
+		logger:   logger,
+		manager:  manager,
+		upg:      upg,
+		notifier: notifier,
+		adminSrv: admin.New(cfg.AdminAddr),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	p.current.Store(cfg)
+	p.connOpts.Store(&opts)
+	p.registerAdmin()
+	return p
+}
+
+// listen opens the proxy listener and, if configured, the admin endpoint, taking over inherited sockets.
+func (p *proxy) listen() error {
+	cfg := p.current.Load()
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	ln, err := p.upg.Listen("proxy", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.ListenAddr, err)
+	}
+	p.ln = ln
+	p.logger.Infof("Routing oracle listening on %s", ln.Addr())
+	if cfg.AdminAddr != "" {
+		adminLn, err := p.upg.Listen("admin", cfg.AdminAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start admin endpoint on %s: %w", cfg.AdminAddr, err)
+		}
+		p.adminSrv.Serve(adminLn)
+		p.adminLn = adminLn
+		p.logger.Infof("Admin endpoint listening on %s", adminLn.Addr())
+	}
+	return nil
+}
+
+// start begins accepting on the proxy listener and reports the proxy ready.
+func (p *proxy) start() {
+	p.lnMu.Lock()
+	p.acceptWG.Add(1)
+	go p.acceptLoop(p.ln)
+	p.lnMu.Unlock()
+	p.notifyReady()
+}
+
+// wait returns once the proxy has stopped accepting and the connections in flight are done: at most DRAIN_TIMEOUT
+// after handing over to an upgraded process, otherwise whenever they end.
+func (p *proxy) wait() {
+	p.acceptWG.Wait()
+	if p.upgraded.Load() {
+		if drain := p.current.Load().DrainTimeout; !waitDrained(&p.conns, drain) {
+			p.logger.Infof("Drain timeout %s elapsed; closing remaining connections", drain)
+		}
+		p.shutdown("upgraded")
+	}
+	p.conns.Wait()
+	p.shutdown("accept loop exited")
+}
+
+func (p *proxy) acceptLoop(l net.Listener) {
+	defer p.acceptWG.Done()
+	for {
+		p.acceptReturned.Store(0)
+		conn, err := l.Accept()
+		p.acceptReturned.Store(time.Now().UnixNano())
+		if err != nil {
+			if p.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				p.logger.Errorf("accept timeout: %v", err)
+				continue
+			}
+			p.shutdown("listener error")
+			return
+		}
+		p.conns.Add(1)
+		p.activeConns.Add(1)
+		go func(c net.Conn) {
+			defer p.conns.Done()
+			defer p.activeConns.Add(-1)
+			connectionhandler.HandleConnection(c, p.manager, *p.connOpts.Load(), logging.New("connection"))
+		}(conn)
+	}
+}
+
+// stopAccepting closes the listeners and leaves in-flight connections alone.
+func (p *proxy) stopAccepting() {
+	p.stopOnce.Do(func() {
+		p.lnMu.Lock()
+		p.cancel()
+		if p.ln != nil {
+			_ = p.ln.Close()
+		}
+		p.lnMu.Unlock()
+		_ = p.adminSrv.Shutdown(context.Background())
+	})
+}
+
+// shutdown stops accepting and tears down every tunnel, cutting the connections that use them.
+func (p *proxy) shutdown(reason string) {
+	p.shutdownOnce.Do(func() {
+		p.logger.Infof("Shutting down: %s", reason)
+		if !p.upgraded.Load() {
+			_ = p.notifier.Notify("STOPPING=1")
+		}
+		p.stopAccepting()
+		p.manager.Shutdown(context.Background())
+	})
+}
+
+// upgradeBinary hands the listeners to a fresh copy of the binary. Once it accepts, this process stops
+// accepting and drains; its cloudflared children are stopped after the last connection ends.
+func (p *proxy) upgradeBinary(trigger string) (int, error) {
+	p.logger.Infof("Upgrade requested via %s", trigger)
+	p.manager.SetStateFile("") // the state file belongs to the new process from now on
+	pid, err := p.upg.Upgrade(p.current.Load().UpgradeTimeout)
+	if errors.Is(err, upgrade.ErrInProgress) {
+		return 0, err
+	}
+	if err != nil {
+		p.manager.SetStateFile(p.current.Load().StateFile)
+		p.logger.Errorf("upgrade failed, continuing with the current process: %v", err)
+		return 0, err
+	}
+	p.logger.Infof("New process %d is accepting; draining connections", pid)
+	p.upgraded.Store(true)
+	// Closing the admin server waits for in-flight requests, possibly including the one that asked for this.
+	go p.stopAccepting()
+	return pid, nil
+}
+
+// reloadConfig re-reads the configuration from the same sources as at startup and applies it with reload.
+func (p *proxy) reloadConfig() error {
+	next, err := configs.Load(p.args)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return p.reload(next.Config)
+}
+
+// reload applies ncfg as a whole or not at all. Everything that can fail (routes, ECH keys, binding moved
+// listeners) happens before anything changes; settings that only take effect at startup reject the reload.
+// Running connections and tunnels are left alone.
+func (p *proxy) reload(ncfg configs.Config) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	old := p.current.Load()
+	if fixed := configs.RestartRequired(*old, ncfg); len(fixed) > 0 {
+		return fmt.Errorf("changing %s requires a restart", strings.Join(fixed, ", "))
+	}
+	routeTable, err := routes.New(ncfg.Routes)
+	if err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	var echKeys *ech.KeySet
+	if ncfg.ECHKeysFile != "" {
+		if echKeys, err = ech.LoadKeysFile(ncfg.ECHKeysFile); err != nil {
+			return fmt.Errorf("invalid ECH keys: %w", err)
+		}
+	}
+
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	if p.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	var newLn, newAdminLn net.Listener
+	if ncfg.ListenAddr != old.ListenAddr {
+		if newLn, err = net.Listen("tcp", ncfg.ListenAddr); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", ncfg.ListenAddr, err)
+		}
+	}
+	if ncfg.AdminAddr != old.AdminAddr && ncfg.AdminAddr != "" {
+		if newAdminLn, err = net.Listen("tcp", ncfg.AdminAddr); err != nil {
+			if newLn != nil {
+				newLn.Close()
+			}
+			return fmt.Errorf("failed to start admin endpoint on %s: %w", ncfg.AdminAddr, err)
+		}
+	}
+
+	// Nothing below fails.
+	changed := configs.Changed(*old, ncfg)
+	p.current.Store(&ncfg)
+	logging.Setup(ncfg.LogFormat)
+	if ncfg.LogLevel != old.LogLevel {
+		// Only a changed LOG_LEVEL replaces levels set through the admin endpoint.
+		_ = logging.SetLevels(ncfg.LogLevel)
+	}
+	opts := *p.connOpts.Load()
+	if ncfg.LogSampleBurst != old.LogSampleBurst || ncfg.LogSampleInterval != old.LogSampleInterval {
+		opts.LogSampler.Configure(ncfg.LogSampleBurst, ncfg.LogSampleInterval)
+	}
+	p.manager.Reconfigure(cloudflaredmanager.Tunables{
+		IdleTimeout:    ncfg.IdleTimeout,
+		StartupTimeout: ncfg.StartupTimeout,
+		Restart:        restartPolicy(&ncfg),
+	})
+	opts.ReadHelloTimeout = ncfg.ReadHelloTimeout
+	opts.Routes = routeTable
+	opts.ECHKeys = echKeys
+	p.connOpts.Store(&opts)
+	if newLn != nil {
+		p.upg.Register("proxy", newLn)
+		p.acceptWG.Add(1)
+		go p.acceptLoop(newLn)
+		_ = p.ln.Close()
+		p.ln = newLn
+		p.logger.Infof("Routing oracle listening on %s", newLn.Addr())
+	}
+	if ncfg.AdminAddr != old.AdminAddr {
+		if p.adminLn != nil {
+			_ = p.adminLn.Close()
+			p.adminLn = nil
+			p.upg.Forget("admin")
+		}
+		if newAdminLn != nil {
+			p.upg.Register("admin", newAdminLn)
+			p.adminSrv.Serve(newAdminLn)
+			p.adminLn = newAdminLn
+			p.logger.Infof("Admin endpoint listening on %s", newAdminLn.Addr())
+		}
+	}
+	if len(changed) == 0 {
+		changed = []string{"no changes"}
+	}
+	p.logger.Infof("Configuration reloaded (%s)", strings.Join(changed, ", "))
+	return nil
+}
+
+// handleSignals shuts down on SIGINT and SIGTERM, reloads on SIGHUP, reopens log files on SIGUSR1 and
+// upgrades on SIGUSR2, where the platform has them.
+func (p *proxy) handleSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		p.shutdown("received signal")
+	}()
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			_ = p.notifier.Notify("RELOADING=1")
+			if err := p.reloadConfig(); err != nil {
+				p.logger.Errorf("Configuration reload rejected, keeping the running configuration: %v", err)
+			}
+			_ = p.notifier.Notify("READY=1")
+		}
+	}()
+	reopenCh := make(chan os.Signal, 1)
+	logging.NotifyReopen(reopenCh)
+	go func() {
+		for range reopenCh {
+			if err := logging.ReopenFiles(); err != nil {
+				p.logger.Errorf("reopening log files: %v", err)
+				continue
+			}
+			p.logger.Infof("Reopened log files")
+		}
+	}()
+	upgradeCh := make(chan os.Signal, 1)
+	upgrade.Notify(upgradeCh)
+	go func() {
+		for range upgradeCh {
+			_, _ = p.upgradeBinary("signal")
+		}
+	}()
+}
+
+// notifyReady tells the process we were upgraded from, and systemd, that the proxy is accepting, and starts the
+// systemd heartbeat if the unit asks for one.
+func (p *proxy) notifyReady() {
+	if err := p.upg.Ready(); err != nil {
+		p.logger.Errorf("failed to notify the previous process: %v", err)
+	}
+	ready := "READY=1"
+	if p.upg.Inherited() {
+		// Take over as the unit's main process from the one we were upgraded from (needs NotifyAccess=all).
+		ready += fmt.Sprintf("\nMAINPID=%d", os.Getpid())
+	}
+	if err := p.notifier.Notify(ready); err != nil {
+		p.logger.Errorf("failed to notify systemd: %v", err)
+	}
+	if !p.notifier.Enabled() {
+		return
+	}
+	watchdog := systemd.WatchdogInterval()
+	every := watchdog
+	if every == 0 {
+		every = 10 * time.Second
+	}
+	checkAlive := func() error {
+		if t := p.acceptReturned.Load(); t != 0 && time.Since(time.Unix(0, t)) > every {
+			return fmt.Errorf("accept loop stuck for %s", time.Since(time.Unix(0, t)).Round(time.Second))
+		}
+		return p.manager.CheckResponsive(every / 2)
+	}
+	status := func() string {
+		return fmt.Sprintf("%d tunnels, %d connections", p.manager.TunnelStats().Live, p.activeConns.Load())
+	}
+	go p.notifier.Heartbeat(p.ctx, every, watchdog > 0, checkAlive, status, func(err error) {
+		p.logger.Errorf("systemd heartbeat: %v", err)
+	})
+}
+
+func (p *proxy) registerAdmin() {
+	p.adminSrv.HandleJSON("/status", func() any {
+		return map[string]any{"tunnels": p.manager.Status(), "ports": p.manager.PortStats(), "limits": p.manager.TunnelStats()}
+	})
+	p.adminSrv.Handle("/metrics", admin.Prometheus(func() []admin.Metric {
+		ps := p.manager.PortStats()
+		ts := p.manager.TunnelStats()
+		return []admin.Metric{
+			{Name: "tunnel_proxy_tunnels_live", Help: "Tunnel hostnames with a starting or ready replica.", Type: "gauge", Value: float64(ts.Live)},
+			{Name: "tunnel_proxy_tunnels_max", Help: "Configured tunnel cap (0 means unlimited).", Type: "gauge", Value: float64(ts.Max)},
+			{Name: "tunnel_proxy_tunnels_waiting", Help: "Connections queued for a tunnel slot.", Type: "gauge", Value: float64(ts.Waiting)},
+			{Name: "tunnel_proxy_tunnel_evictions_total", Help: "Idle tunnels evicted to make room under the cap.", Type: "counter", Value: float64(ts.Evictions)},
+			{Name: "tunnel_proxy_tunnel_rejections_total", Help: "Connections rejected because every tunnel was busy.", Type: "counter", Value: float64(ts.Rejected)},
+			{Name: "tunnel_proxy_ports_size", Help: "Ports in the tunnel port range.", Type: "gauge", Value: float64(ps.Size)},
+			{Name: "tunnel_proxy_ports_in_use", Help: "Ports reserved by running tunnels.", Type: "gauge", Value: float64(ps.InUse)},
+			{Name: "tunnel_proxy_ports_free", Help: "Ports available for reservation.", Type: "gauge", Value: float64(ps.Free)},
+			{Name: "tunnel_proxy_ports_quarantined", Help: "Released ports waiting out the quarantine.", Type: "gauge", Value: float64(ps.Quarantined)},
+			{Name: "tunnel_proxy_ports_utilization", Help: "Fraction of the port range in use.", Type: "gauge", Value: ps.Utilization},
+			{Name: "tunnel_proxy_port_reservations_total", Help: "Successful port reservations.", Type: "counter", Value: float64(ps.Reservations)},
+			{Name: "tunnel_proxy_port_exhausted_total", Help: "Reservations that failed because no port was free.", Type: "counter", Value: float64(ps.Exhausted)},
+			{Name: "tunnel_proxy_port_busy_skipped_total", Help: "Candidate ports skipped because another process held them.", Type: "counter", Value: float64(ps.BusySkipped)},
+			{Name: "tunnel_proxy_port_bind_conflicts_total", Help: "Ports cloudflared failed to bind.", Type: "counter", Value: float64(ps.BindConflicts)},
+		}
+	}))
+	p.adminSrv.Handle("/loglevel", admin.LogLevel())
+	p.adminSrv.Handle("/upgrade", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pid, err := p.upgradeBinary("admin endpoint")
+		if errors.Is(err, upgrade.ErrInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"pid\": %d}\n", pid)
+	}))
+}
+
+// waitDrained waits for wg, giving up after timeout (0 waits indefinitely). It reports whether wg finished.
+func waitDrained(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
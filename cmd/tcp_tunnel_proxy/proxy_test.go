@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"tcp-tunnel-proxy/configs"
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+	connectionhandler "tcp-tunnel-proxy/internal/connection_handler"
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/systemd"
+	"tcp-tunnel-proxy/internal/upgrade"
+	"testing"
+	"time"
+)
+
+func newTestProxy(t *testing.T) *proxy {
+	t.Helper()
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	t.Setenv("ADMIN_ADDR", "")
+	t.Setenv("PORT_RANGE_START", "45600")
+	t.Setenv("PORT_RANGE_END", "45700")
+	cfg, err := configs.LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	manager, err := cloudflaredmanager.NewNodeManager(cloudflaredmanager.Config{
+		IdleTimeout:    cfg.IdleTimeout,
+		StartupTimeout: cfg.StartupTimeout,
+		PortRangeStart: cfg.PortRangeStart,
+		PortRangeEnd:   cfg.PortRangeEnd,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	upg, err := upgrade.New()
+	if err != nil {
+		t.Fatalf("upgrade.New: %v", err)
+	}
+	p := newProxy(&cfg, nil, manager, upg, systemd.NewNotifier(), connectionhandler.Options{
+		ReadHelloTimeout: cfg.ReadHelloTimeout,
+		LogSampler:       logging.NewSampler(cfg.LogSampleBurst, cfg.LogSampleInterval),
+	}, logging.New("main"))
+	if err := p.listen(); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	p.start()
+	t.Cleanup(func() {
+		p.shutdown("test done")
+		p.wait()
+	})
+	return p
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestReloadMovesListenerAndSwapsRoutes(t *testing.T) {
+	p := newTestProxy(t)
+	oldAddr := p.ln.Addr().String()
+	oldOpts := p.connOpts.Load()
+
+	ncfg := *p.current.Load()
+	ncfg.ListenAddr = freeAddr(t)
+	ncfg.Routes = []configs.Route{{Match: "*.example.com"}}
+	ncfg.ReadHelloTimeout = 3 * time.Second
+	if err := p.reload(ncfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if got := p.current.Load().ListenAddr; got != ncfg.ListenAddr {
+		t.Fatalf("current ListenAddr = %q, want %q", got, ncfg.ListenAddr)
+	}
+	opts := p.connOpts.Load()
+	if opts == oldOpts || opts.ReadHelloTimeout != 3*time.Second {
+		t.Fatalf("connection options not replaced: %+v", opts)
+	}
+	if opts.Routes.Lookup("a.example.com") == nil {
+		t.Fatalf("reloaded routes do not match a.example.com")
+	}
+	if opts.LogSampler != oldOpts.LogSampler {
+		t.Fatalf("reload replaced the log sampler instead of reconfiguring it")
+	}
+	c, err := net.DialTimeout("tcp", ncfg.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial new listener: %v", err)
+	}
+	c.Close()
+	if c, err := net.DialTimeout("tcp", oldAddr, time.Second); err == nil {
+		c.Close()
+		t.Fatalf("old listener %s still accepting", oldAddr)
+	}
+}
+
+func TestReloadRejectsRestartOnlySettings(t *testing.T) {
+	p := newTestProxy(t)
+	before := p.current.Load()
+	oldOpts := p.connOpts.Load()
+
+	ncfg := *before
+	ncfg.PortRangeEnd++
+	ncfg.ReadHelloTimeout = 3 * time.Second
+	err := p.reload(ncfg)
+	if err == nil || !strings.Contains(err.Error(), "requires a restart") {
+		t.Fatalf("reload err = %v, want a restart-required error", err)
+	}
+	if p.current.Load() != before || p.connOpts.Load() != oldOpts {
+		t.Fatalf("rejected reload changed the running configuration")
+	}
+}
+
+func TestReloadAfterShutdownFails(t *testing.T) {
+	p := newTestProxy(t)
+	p.shutdown("test")
+	ncfg := *p.current.Load()
+	ncfg.ListenAddr = freeAddr(t)
+	if err := p.reload(ncfg); err == nil {
+		t.Fatalf("reload after shutdown succeeded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.acceptWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatalf("accept loop still running after shutdown")
+	}
+}
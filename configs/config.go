@@ -4,145 +4,642 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
+
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/shellwords"
 )
 
 type Config struct {
-	ListenAddr       string
-	IdleTimeout      time.Duration
-	StartupTimeout   time.Duration
-	ReadHelloTimeout time.Duration
-	PortRangeStart   int
-	PortRangeEnd     int
-	LogFormat        string // plain | json
-	RestartBackoff   time.Duration
-	MaxRestarts      int
+	ListenAddr        string
+	IdleTimeout       time.Duration
+	StartupTimeout    time.Duration
+	ReadHelloTimeout  time.Duration
+	PortRangeStart    int
+	PortRangeEnd      int
+	PortQuarantine    time.Duration // 0 disables
+	LoopbackCIDR      string        // "" keeps the 127.0.0.1 port range allocator
+	LoopbackPort      int
+	LogFormat         string // plain | json
+	LogLevel          string // global level and component=level overrides, e.g. "warn,sni=debug"
+	LogSampleBurst    int    // repeated messages per key allowed per LogSampleInterval; 0 disables sampling
+	LogSampleInterval time.Duration
+	RestartBackoff    time.Duration // delay before the first restart; doubles with each further crash
+	RestartMaxBackoff time.Duration
+	RestartJitter     float64 // fraction of each restart delay to randomize, 0-1
+	RestartWindow     time.Duration
+	MaxRestarts       int // crashes tolerated within RestartWindow
+	RoutesFile        string
+	Routes            []Route
+	ECHKeysFile       string
+	AccessLog         string // "" (disabled) | stdout | stderr | file path
+	AccessLogFormat   string // json | logfmt
+	LogOutput         string // stdout | stderr | file path
+	CloudflaredLog    string // "" follows LogOutput | stdout | stderr | file path
+
+	// Rotation of the file outputs above.
+	LogMaxSizeMB     int           // 0 disables size-based rotation
+	LogMaxAge        time.Duration // 0 disables time-based rotation
+	LogMaxBackups    int           // 0 keeps every rotated file
+	LogCompress      bool
+	LivenessInterval time.Duration
+	LivenessFailures int
+	BreakerFailures  int
+	BreakerCooldown  time.Duration
+	MaxTunnels       int           // 0 means unlimited
+	MaxTunnelsWait   time.Duration // 0 rejects immediately when every tunnel is busy
+	AdminAddr        string        // "" disables the admin HTTP endpoint
+
+	// Hardening of cloudflared child processes.
+	ChildPdeathsig    bool
+	ChildSetpgid      bool
+	ChildUser         string // "" keeps the proxy's credentials
+	ChildGroup        string // "" uses ChildUser's primary group
+	ChildRLimitNoFile uint64 // 0 keeps the inherited limit
+	ChildRLimitAS     uint64 // bytes; 0 keeps the inherited limit
+	ChildEnvAllowlist []string
+
+	StateFile string // "" disables orphan tracking across restarts
+
+	// How cloudflared is started.
+	CloudflaredBin       string
+	CloudflaredArgs      string // text/template rendering the arguments
+	CloudflaredExtraArgs []string
+
+	UpgradeTimeout time.Duration // how long a re-executed binary has to start accepting
+	DrainTimeout   time.Duration // how long the old process waits for connections after an upgrade; 0 waits for all
+
+	// Tunnel lifecycle notifications.
+	WebhookURL           string   // "" disables the webhook
+	WebhookEvents        []string // event types to send; empty sends all
+	WebhookBatchSize     int
+	WebhookFlushInterval time.Duration
+	WebhookMaxRetries    int
+	WebhookTimeout       time.Duration
+
+	// Tracing.
+	OTLPEndpoint     string  // OTLP/HTTP collector base URL; "" disables tracing
+	TraceSampleRatio float64 // fraction of connections traced, 0-1
+	TraceServiceName string
 }
 
 const (
-	defaultListenAddr       = ":19000"
-	defaultIdleTimeout      = 300 * time.Second
-	defaultStartupTimeout   = 15 * time.Second
-	defaultReadHelloTimeout = 10 * time.Second
-	defaultPortRangeStart   = 20000
-	defaultPortRangeEnd     = 20100
-	defaultLogFormat        = "plain"
-	defaultRestartBackoff   = 2 * time.Second
-	defaultMaxRestarts      = 3
+	defaultListenAddr        = ":19000"
+	defaultIdleTimeout       = 300 * time.Second
+	defaultStartupTimeout    = 15 * time.Second
+	defaultReadHelloTimeout  = 10 * time.Second
+	defaultPortRangeStart    = 20000
+	defaultPortRangeEnd      = 20100
+	defaultPortQuarantine    = 60 * time.Second
+	defaultLoopbackPort      = 20000
+	defaultLogFormat         = "plain"
+	defaultLogLevel          = "info"
+	defaultLogSampleBurst    = 5
+	defaultLogSampleInterval = time.Minute
+	defaultRestartBackoff    = 2 * time.Second
+	defaultRestartMaxBackoff = time.Minute
+	defaultRestartJitter     = 0.2
+	defaultRestartWindow     = 5 * time.Minute
+	defaultMaxRestarts       = 3
+	defaultAccessLogFormat   = "json"
+	defaultLogOutput         = "stdout"
+	defaultLogMaxSizeMB      = 100
+	defaultLogMaxBackups     = 7
+	defaultLivenessInterval  = 10 * time.Second
+	defaultLivenessFailures  = 3
+	defaultBreakerFailures   = 5
+	defaultBreakerCooldown   = 30 * time.Second
+	defaultUpgradeTimeout    = 30 * time.Second
+	defaultCloudflaredBin    = "cloudflared"
+	defaultWebhookBatchSize  = 20
+	defaultWebhookFlush      = 2 * time.Second
+	defaultWebhookRetries    = 5
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultTraceSampleRatio  = 1.0
+	defaultTraceServiceName  = "tcp-tunnel-proxy"
+	defaultCloudflaredArgs   = cloudflaredmanager.DefaultArgsTemplate
 )
 
+// defaultChildEnvAllowlist is what cloudflared needs to run, reach the network through a proxy and read its
+// own TUNNEL_* settings; everything else (credentials, tokens) stays with the proxy.
+var defaultChildEnvAllowlist = []string{
+	"PATH", "HOME", "USER", "TMPDIR", "TZ", "LANG", "LC_*",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"TUNNEL_*",
+}
+
 const (
-	envListenAddr     = "LISTEN_ADDR"
-	envIdleTimeout    = "IDLE_TIMEOUT"
-	envStartupTimeout = "STARTUP_TIMEOUT"
-	envReadHello      = "READ_HELLO_TIMEOUT"
-	envPortRangeStart = "PORT_RANGE_START"
-	envPortRangeEnd   = "PORT_RANGE_END"
-	envLogFormat      = "LOG_FORMAT"
-	envRestartBackoff = "RESTART_BACKOFF"
-	envMaxRestarts    = "MAX_RESTARTS"
+	envListenAddr        = "LISTEN_ADDR"
+	envIdleTimeout       = "IDLE_TIMEOUT"
+	envStartupTimeout    = "STARTUP_TIMEOUT"
+	envReadHello         = "READ_HELLO_TIMEOUT"
+	envPortRangeStart    = "PORT_RANGE_START"
+	envPortRangeEnd      = "PORT_RANGE_END"
+	envPortQuarantine    = "PORT_QUARANTINE"
+	envLoopbackCIDR      = "LOOPBACK_CIDR"
+	envLoopbackPort      = "LOOPBACK_PORT"
+	envLogFormat         = "LOG_FORMAT"
+	envLogLevel          = "LOG_LEVEL"
+	envLogSampleBurst    = "LOG_SAMPLE_BURST"
+	envLogSampleInterval = "LOG_SAMPLE_INTERVAL"
+	envRestartBackoff    = "RESTART_BACKOFF"
+	envRestartMaxBackoff = "RESTART_MAX_BACKOFF"
+	envRestartJitter     = "RESTART_JITTER"
+	envRestartWindow     = "RESTART_WINDOW"
+	envMaxRestarts       = "MAX_RESTARTS"
+	envRoutesFile        = "ROUTES_FILE"
+	envECHKeysFile       = "ECH_KEYS_FILE"
+	envAccessLog         = "ACCESS_LOG"
+	envAccessLogFmt      = "ACCESS_LOG_FORMAT"
+	envLogOutput         = "LOG_OUTPUT"
+	envCloudflaredLog    = "CLOUDFLARED_LOG"
+	envLogMaxSize        = "LOG_MAX_SIZE_MB"
+	envLogMaxAge         = "LOG_MAX_AGE"
+	envLogMaxBackups     = "LOG_MAX_BACKUPS"
+	envLogCompress       = "LOG_COMPRESS"
+	envLivenessEvery     = "LIVENESS_INTERVAL"
+	envLivenessFails     = "LIVENESS_FAILURES"
+	envBreakerFails      = "BREAKER_FAILURES"
+	envBreakerCool       = "BREAKER_COOLDOWN"
+	envAdminAddr         = "ADMIN_ADDR"
+	envMaxTunnels        = "MAX_TUNNELS"
+	envMaxTunnelsWait    = "MAX_TUNNELS_WAIT"
+	envChildPdeath       = "CHILD_PDEATHSIG"
+	envChildSetpgid      = "CHILD_SETPGID"
+	envChildUser         = "CHILD_USER"
+	envChildGroup        = "CHILD_GROUP"
+	envChildNoFile       = "CHILD_RLIMIT_NOFILE"
+	envChildAS           = "CHILD_RLIMIT_AS"
+	envChildEnv          = "CHILD_ENV_ALLOWLIST"
+	envStateFile         = "STATE_FILE"
+	envUpgradeTimeout    = "UPGRADE_TIMEOUT"
+	envDrainTimeout      = "DRAIN_TIMEOUT"
+	envConfigFile        = "CONFIG_FILE"
+	envCFBin             = "CLOUDFLARED_BIN"
+	envCFArgs            = "CLOUDFLARED_ARGS_TEMPLATE"
+	envCFExtraArgs       = "CLOUDFLARED_EXTRA_ARGS"
+	envWebhookURL        = "WEBHOOK_URL"
+	envWebhookEvents     = "WEBHOOK_EVENTS"
+	envWebhookBatch      = "WEBHOOK_BATCH_SIZE"
+	envWebhookFlush      = "WEBHOOK_FLUSH_INTERVAL"
+	envWebhookRetries    = "WEBHOOK_MAX_RETRIES"
+	envWebhookTimeout    = "WEBHOOK_TIMEOUT"
+	envOTLPEndpoint      = "OTLP_ENDPOINT"
+	envTraceSampleRatio  = "TRACE_SAMPLE_RATIO"
+	envTraceServiceName  = "TRACE_SERVICE_NAME"
 )
 
-// LoadConfigFromEnv returns configuration populated from environment variables, falling back to defaults.
-// It returns validation/parse errors so callers can decide how to handle them.
-func LoadConfigFromEnv() (Config, error) {
-	cfg := Config{
-		ListenAddr:       defaultListenAddr,
-		IdleTimeout:      defaultIdleTimeout,
-		StartupTimeout:   defaultStartupTimeout,
-		ReadHelloTimeout: defaultReadHelloTimeout,
-		PortRangeStart:   defaultPortRangeStart,
-		PortRangeEnd:     defaultPortRangeEnd,
-		LogFormat:        defaultLogFormat,
-		RestartBackoff:   defaultRestartBackoff,
-		MaxRestarts:      defaultMaxRestarts,
+// defaultConfig returns the configuration used when no source sets a value.
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:        defaultListenAddr,
+		IdleTimeout:       defaultIdleTimeout,
+		StartupTimeout:    defaultStartupTimeout,
+		ReadHelloTimeout:  defaultReadHelloTimeout,
+		PortRangeStart:    defaultPortRangeStart,
+		PortRangeEnd:      defaultPortRangeEnd,
+		PortQuarantine:    defaultPortQuarantine,
+		LoopbackPort:      defaultLoopbackPort,
+		LogFormat:         defaultLogFormat,
+		LogLevel:          defaultLogLevel,
+		LogSampleBurst:    defaultLogSampleBurst,
+		LogSampleInterval: defaultLogSampleInterval,
+		RestartBackoff:    defaultRestartBackoff,
+		RestartMaxBackoff: defaultRestartMaxBackoff,
+		RestartJitter:     defaultRestartJitter,
+		RestartWindow:     defaultRestartWindow,
+		MaxRestarts:       defaultMaxRestarts,
+		AccessLogFormat:   defaultAccessLogFormat,
+		LogOutput:         defaultLogOutput,
+		LogMaxSizeMB:      defaultLogMaxSizeMB,
+		LogMaxBackups:     defaultLogMaxBackups,
+		LivenessInterval:  defaultLivenessInterval,
+		LivenessFailures:  defaultLivenessFailures,
+		BreakerFailures:   defaultBreakerFailures,
+		BreakerCooldown:   defaultBreakerCooldown,
+		UpgradeTimeout:    defaultUpgradeTimeout,
+		CloudflaredBin:    defaultCloudflaredBin,
+		CloudflaredArgs:   defaultCloudflaredArgs,
+
+		WebhookBatchSize:     defaultWebhookBatchSize,
+		WebhookFlushInterval: defaultWebhookFlush,
+		WebhookMaxRetries:    defaultWebhookRetries,
+		WebhookTimeout:       defaultWebhookTimeout,
+
+		TraceSampleRatio: defaultTraceSampleRatio,
+		TraceServiceName: defaultTraceServiceName,
+
+		ChildPdeathsig:    true,
+		ChildSetpgid:      true,
+		ChildEnvAllowlist: defaultChildEnvAllowlist,
 	}
+}
 
-	var errs []error
+// setting is one configurable value. Its config file key is the lower-cased env name and its flag the same
+// with dashes, so IDLE_TIMEOUT is idle_timeout in a config file and --idle-timeout on the command line.
+type setting struct {
+	env        string
+	usage      string
+	allowEmpty bool // an empty value is meaningful rather than "unset"
+	isBool     bool // the flag may be given without a value
+	live       bool // a reload can apply a change without a restart
+	redacted   bool // the value is a URL that may carry credentials; see display
+	set        func(cfg *Config, v string) error
+	get        func(cfg *Config) string
+}
+
+func (s setting) key() string  { return strings.ToLower(s.env) }
+func (s setting) flag() string { return strings.ReplaceAll(s.key(), "_", "-") }
 
-	if v := strings.TrimSpace(os.Getenv(envListenAddr)); v != "" {
-		cfg.ListenAddr = v
+// display returns v as --print-config shows it.
+func (s setting) display(v string) string {
+	if s.redacted {
+		return RedactURL(v)
 	}
+	return v
+}
+
+var settings = []setting{
+	live(stringSetting(envListenAddr, "address the proxy listens on", func(c *Config) *string { return &c.ListenAddr })),
+	live(durationSetting(envIdleTimeout, "stop a tunnel after it has been idle this long", false, func(c *Config) *time.Duration { return &c.IdleTimeout })),
+	live(durationSetting(envStartupTimeout, "how long cloudflared has to become ready", false, func(c *Config) *time.Duration { return &c.StartupTimeout })),
+	live(durationSetting(envReadHello, "how long a client has to send its TLS ClientHello", false, func(c *Config) *time.Duration { return &c.ReadHelloTimeout })),
+	intSetting(envPortRangeStart, "first local port handed to cloudflared", 1, 0, func(c *Config) *int { return &c.PortRangeStart }),
+	intSetting(envPortRangeEnd, "last local port handed to cloudflared", 1, 0, func(c *Config) *int { return &c.PortRangeEnd }),
+	durationSetting(envPortQuarantine, "keep a released port unused this long (0 disables)", true, func(c *Config) *time.Duration { return &c.PortQuarantine }),
+	stringSetting(envLoopbackCIDR, "give each tunnel its own address in this 127.0.0.0/8 prefix", func(c *Config) *string { return &c.LoopbackCIDR }),
+	intSetting(envLoopbackPort, "port used on every loopback address (1-65534)", 1, 65534, func(c *Config) *int { return &c.LoopbackPort }),
+	live(enumSetting(envLogFormat, "log format", func(c *Config) *string { return &c.LogFormat }, "plain", "json")),
+	{
+		env:   envLogLevel,
+		live:  true,
+		usage: "log level (debug|info|warn|error), optionally followed by component=level overrides, e.g. warn,sni=debug",
+		set: func(c *Config, v string) error {
+			if err := logging.ParseLevels(v); err != nil {
+				return err
+			}
+			c.LogLevel = strings.ToLower(v)
+			return nil
+		},
+		get: func(c *Config) string { return c.LogLevel },
+	},
+	live(intSetting(envLogSampleBurst, "repeated log messages per source allowed per log_sample_interval (0 disables sampling)", 0, 0, func(c *Config) *int { return &c.LogSampleBurst })),
+	live(durationSetting(envLogSampleInterval, "window for log sampling", false, func(c *Config) *time.Duration { return &c.LogSampleInterval })),
+	live(durationSetting(envRestartBackoff, "delay before restarting a crashed cloudflared, doubled per further crash", false, func(c *Config) *time.Duration { return &c.RestartBackoff })),
+	live(durationSetting(envRestartMaxBackoff, "upper bound of the restart delay", false, func(c *Config) *time.Duration { return &c.RestartMaxBackoff })),
+	live(fractionSetting(envRestartJitter, "fraction of each restart delay to randomize", func(c *Config) *float64 { return &c.RestartJitter })),
+	live(durationSetting(envRestartWindow, "window in which crashes count towards max_restarts", false, func(c *Config) *time.Duration { return &c.RestartWindow })),
+	live(intSetting(envMaxRestarts, "crashes allowed within restart_window before a tunnel is given up", 1, 0, func(c *Config) *int { return &c.MaxRestarts })),
+	{
+		env:   envRoutesFile,
+		live:  true,
+		usage: "JSON file with per-hostname routes",
+		set: func(c *Config, v string) error {
+			routes, err := loadRoutesFile(v)
+			if err != nil {
+				return err
+			}
+			c.RoutesFile, c.Routes = v, routes
+			return nil
+		},
+		get: func(c *Config) string { return c.RoutesFile + routesDigest(c.Routes) },
+	},
+	{
+		env:   envECHKeysFile,
+		live:  true,
+		usage: "ECH key file; enables Encrypted ClientHello",
+		set: func(c *Config, v string) error {
+			if _, err := os.Stat(v); err != nil {
+				return err
+			}
+			c.ECHKeysFile = v
+			return nil
+		},
+		get: func(c *Config) string { return c.ECHKeysFile },
+	},
+	stringSetting(envAccessLog, "access log destination: stdout, stderr or a file path", func(c *Config) *string { return &c.AccessLog }),
+	enumSetting(envAccessLogFmt, "access log format", func(c *Config) *string { return &c.AccessLogFormat }, "json", "logfmt"),
+	stringSetting(envLogOutput, "log destination: stdout, stderr or a file path", func(c *Config) *string { return &c.LogOutput }),
+	stringSetting(envCloudflaredLog, "destination of cloudflared's output: stdout, stderr or a file path (default: log_output)", func(c *Config) *string { return &c.CloudflaredLog }),
+	intSetting(envLogMaxSize, "rotate log files before they grow past this many MiB (0 disables)", 0, 0, func(c *Config) *int { return &c.LogMaxSizeMB }),
+	durationSetting(envLogMaxAge, "rotate log files after writing them for this long (0 disables)", true, func(c *Config) *time.Duration { return &c.LogMaxAge }),
+	intSetting(envLogMaxBackups, "rotated log files to keep per file (0 keeps all)", 0, 0, func(c *Config) *int { return &c.LogMaxBackups }),
+	boolSetting(envLogCompress, "gzip rotated log files", func(c *Config) *bool { return &c.LogCompress }),
+	durationSetting(envLivenessEvery, "how often running tunnels are health checked", false, func(c *Config) *time.Duration { return &c.LivenessInterval }),
+	intSetting(envLivenessFails, "failed health checks before cloudflared is restarted", 1, 0, func(c *Config) *int { return &c.LivenessFailures }),
+	intSetting(envBreakerFails, "failed starts before a hostname's circuit opens", 1, 0, func(c *Config) *int { return &c.BreakerFailures }),
+	durationSetting(envBreakerCool, "how long an open circuit rejects a hostname", false, func(c *Config) *time.Duration { return &c.BreakerCooldown }),
+	live(stringSetting(envAdminAddr, "address of the admin HTTP endpoint (empty disables)", func(c *Config) *string { return &c.AdminAddr })),
+	intSetting(envMaxTunnels, "maximum concurrent tunnels (0 is unlimited)", 0, 0, func(c *Config) *int { return &c.MaxTunnels }),
+	durationSetting(envMaxTunnelsWait, "how long to wait for a tunnel slot", true, func(c *Config) *time.Duration { return &c.MaxTunnelsWait }),
+	boolSetting(envChildPdeath, "kill cloudflared when the proxy dies", func(c *Config) *bool { return &c.ChildPdeathsig }),
+	boolSetting(envChildSetpgid, "run cloudflared in its own process group", func(c *Config) *bool { return &c.ChildSetpgid }),
+	stringSetting(envChildUser, "user cloudflared runs as", func(c *Config) *string { return &c.ChildUser }),
+	stringSetting(envChildGroup, "group cloudflared runs as", func(c *Config) *string { return &c.ChildGroup }),
+	uintSetting(envChildNoFile, "RLIMIT_NOFILE for cloudflared (0 inherits)", func(c *Config) *uint64 { return &c.ChildRLimitNoFile }),
+	uintSetting(envChildAS, "RLIMIT_AS in bytes for cloudflared (0 inherits)", func(c *Config) *uint64 { return &c.ChildRLimitAS }),
+	{
+		env:        envChildEnv,
+		usage:      "comma-separated environment variables passed to cloudflared",
+		allowEmpty: true, // an empty list passes no environment at all
+		set: func(c *Config, v string) error {
+			c.ChildEnvAllowlist = []string{}
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					c.ChildEnvAllowlist = append(c.ChildEnvAllowlist, name)
+				}
+			}
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(c.ChildEnvAllowlist, ",") },
+	},
+	stringSetting(envStateFile, "file recording running cloudflared children across restarts", func(c *Config) *string { return &c.StateFile }),
+	stringSetting(envCFBin, "cloudflared executable", func(c *Config) *string { return &c.CloudflaredBin }),
+	{
+		env:   envCFArgs,
+		usage: "template for cloudflared's arguments",
+		set: func(c *Config, v string) error {
+			if _, err := template.New(envCFArgs).Parse(v); err != nil {
+				return err
+			}
+			c.CloudflaredArgs = v
+			return nil
+		},
+		get: func(c *Config) string { return c.CloudflaredArgs },
+	},
+	{
+		env:   envCFExtraArgs,
+		usage: "extra cloudflared arguments, shell-quoted (the template's {{.ExtraArgs}})",
+		set: func(c *Config, v string) error {
+			args, err := shellwords.Split(v)
+			if err != nil {
+				return err
+			}
+			c.CloudflaredExtraArgs = args
+			return nil
+		},
+		get: func(c *Config) string { return shellwords.Join(c.CloudflaredExtraArgs) },
+	},
+	live(durationSetting(envUpgradeTimeout, "how long an upgraded binary has to start accepting", false, func(c *Config) *time.Duration { return &c.UpgradeTimeout })),
+	live(durationSetting(envDrainTimeout, "how long the old process waits for connections after an upgrade (0 waits for all)", true, func(c *Config) *time.Duration { return &c.DrainTimeout })),
+	{
+		env:      envWebhookURL,
+		redacted: true,
+		usage:    "http(s) URL that tunnel lifecycle events are POSTed to (empty disables)",
+		set: func(c *Config, v string) error {
+			if err := checkHTTPURL(v); err != nil {
+				return err
+			}
+			c.WebhookURL = v
+			return nil
+		},
+		get: func(c *Config) string { return c.WebhookURL },
+	},
+	{
+		env:        envWebhookEvents,
+		usage:      "comma-separated event types sent to the webhook (empty sends all)",
+		allowEmpty: true,
+		set: func(c *Config, v string) error {
+			var types []string
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+					continue
+				}
+				if _, err := cloudflaredmanager.ParseEventType(name); err != nil {
+					return err
+				}
+				types = append(types, name)
+			}
+			c.WebhookEvents = types
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(c.WebhookEvents, ",") },
+	},
+	intSetting(envWebhookBatch, "most events per webhook request", 1, 0, func(c *Config) *int { return &c.WebhookBatchSize }),
+	durationSetting(envWebhookFlush, "how long an event waits for its webhook batch to fill", false, func(c *Config) *time.Duration { return &c.WebhookFlushInterval }),
+	intSetting(envWebhookRetries, "retries of a failed webhook request before its events are dropped", 0, 0, func(c *Config) *int { return &c.WebhookMaxRetries }),
+	durationSetting(envWebhookTimeout, "timeout of each webhook request", false, func(c *Config) *time.Duration { return &c.WebhookTimeout }),
+	{
+		env:      envOTLPEndpoint,
+		redacted: true,
+		usage:    "OTLP/HTTP collector URL traces are exported to, e.g. http://localhost:4318 (empty disables tracing)",
+		set: func(c *Config, v string) error {
+			if err := checkHTTPURL(v); err != nil {
+				return err
+			}
+			c.OTLPEndpoint = v
+			return nil
+		},
+		get: func(c *Config) string { return c.OTLPEndpoint },
+	},
+	fractionSetting(envTraceSampleRatio, "fraction of connections traced", func(c *Config) *float64 { return &c.TraceSampleRatio }),
+	stringSetting(envTraceServiceName, "service.name reported with traces", func(c *Config) *string { return &c.TraceServiceName }),
+}
 
-	if v := strings.TrimSpace(os.Getenv(envIdleTimeout)); v != "" {
-		d, err := time.ParseDuration(v)
-		if err != nil || d <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envIdleTimeout, v, err))
-		} else {
-			cfg.IdleTimeout = d
+// RedactURL returns v with its userinfo and query values replaced, for printing URLs that may carry
+// credentials. A value that does not parse as a URL is hidden entirely.
+func RedactURL(v string) string {
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{redactedValue}
 		}
+		u.RawQuery = q.Encode()
 	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
 
-	if v := strings.TrimSpace(os.Getenv(envStartupTimeout)); v != "" {
-		d, err := time.ParseDuration(v)
-		if err != nil || d <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envStartupTimeout, v, err))
-		} else {
-			cfg.StartupTimeout = d
-		}
+const redactedValue = "REDACTED"
+
+// checkHTTPURL accepts absolute http and https URLs.
+func checkHTTPURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https URL")
 	}
+	return nil
+}
 
-	if v := strings.TrimSpace(os.Getenv(envReadHello)); v != "" {
-		d, err := time.ParseDuration(v)
-		if err != nil || d <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envReadHello, v, err))
-		} else {
-			cfg.ReadHelloTimeout = d
-		}
+func live(s setting) setting {
+	s.live = true
+	return s
+}
+
+func stringSetting(env, usage string, field func(*Config) *string) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		set:   func(c *Config, v string) error { *field(c) = v; return nil },
+		get:   func(c *Config) string { return *field(c) },
 	}
+}
 
-	if v := strings.TrimSpace(os.Getenv(envPortRangeStart)); v != "" {
-		n, err := strconv.Atoi(v)
-		if err != nil || n <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envPortRangeStart, v, err))
-		} else {
-			cfg.PortRangeStart = n
-		}
+func enumSetting(env, usage string, field func(*Config) *string, values ...string) setting {
+	return setting{
+		env:   env,
+		usage: fmt.Sprintf("%s (%s)", usage, strings.Join(values, "|")),
+		set: func(c *Config, v string) error {
+			v = strings.ToLower(v)
+			for _, ok := range values {
+				if v == ok {
+					*field(c) = v
+					return nil
+				}
+			}
+			return fmt.Errorf("must be %s", strings.Join(values, "|"))
+		},
+		get: func(c *Config) string { return *field(c) },
 	}
+}
 
-	if v := strings.TrimSpace(os.Getenv(envPortRangeEnd)); v != "" {
-		n, err := strconv.Atoi(v)
-		if err != nil || n <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envPortRangeEnd, v, err))
-		} else {
-			cfg.PortRangeEnd = n
-		}
+func durationSetting(env, usage string, allowZero bool, field func(*Config) *time.Duration) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			if d < 0 || (d == 0 && !allowZero) {
+				return fmt.Errorf("must be positive")
+			}
+			*field(c) = d
+			return nil
+		},
+		get: func(c *Config) string { return field(c).String() },
 	}
+}
 
-	if v := strings.TrimSpace(os.Getenv(envLogFormat)); v != "" {
-		switch strings.ToLower(v) {
-		case "plain", "json":
-			cfg.LogFormat = v
-		default:
-			errs = append(errs, fmt.Errorf("invalid %s: %q (must be plain|json)", envLogFormat, v))
-		}
+// intSetting accepts min..max; a max of 0 means no upper bound.
+func intSetting(env, usage string, min, max int, field func(*Config) *int) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			if n < min || (max > 0 && n > max) {
+				if max > 0 {
+					return fmt.Errorf("must be %d-%d", min, max)
+				}
+				return fmt.Errorf("must be at least %d", min)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
 	}
+}
+
+// fractionSetting accepts a number from 0 to 1.
+func fractionSetting(env, usage string, field func(*Config) *float64) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return err
+			}
+			if f < 0 || f > 1 {
+				return fmt.Errorf("must be 0-1")
+			}
+			*field(c) = f
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+	}
+}
 
-	if v := strings.TrimSpace(os.Getenv(envRestartBackoff)); v != "" {
-		d, err := time.ParseDuration(v)
-		if err != nil || d <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envRestartBackoff, v, err))
-		} else {
-			cfg.RestartBackoff = d
+func uintSetting(env, usage string, field func(*Config) *uint64) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return err
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatUint(*field(c), 10) },
+	}
+}
+
+func boolSetting(env, usage string, field func(*Config) *bool) setting {
+	return setting{
+		env:    env,
+		usage:  usage,
+		isBool: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			*field(c) = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+	}
+}
+
+// Changed returns the keys of the settings whose values differ between a and b, in table order.
+func Changed(a, b Config) []string {
+	var keys []string
+	for _, s := range settings {
+		if s.get(&a) != s.get(&b) {
+			keys = append(keys, s.key())
 		}
 	}
+	return keys
+}
 
-	if v := strings.TrimSpace(os.Getenv(envMaxRestarts)); v != "" {
-		n, err := strconv.Atoi(v)
-		if err != nil || n <= 0 {
-			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", envMaxRestarts, v, err))
-		} else {
-			cfg.MaxRestarts = n
+// RestartRequired returns the changed settings that a running proxy cannot apply.
+func RestartRequired(old, next Config) []string {
+	var keys []string
+	for _, s := range settings {
+		if !s.live && s.get(&old) != s.get(&next) {
+			keys = append(keys, s.key())
 		}
 	}
+	return keys
+}
 
+// LoadConfigFromEnv returns configuration populated from environment variables, falling back to defaults.
+// It returns validation/parse errors so callers can decide how to handle them.
+func LoadConfigFromEnv() (Config, error) {
+	cfg := defaultConfig()
+	errs := envLayer().apply(&cfg, nil)
 	if err := validateConfig(&cfg); err != nil {
 		errs = append(errs, err)
 	}
-
 	return cfg, errors.Join(errs...)
 }
 
@@ -174,17 +671,138 @@ func validateConfig(cfg *Config) error {
 		cfg.PortRangeStart = defaultPortRangeStart
 		cfg.PortRangeEnd = defaultPortRangeEnd
 	}
+	if cfg.PortQuarantine < 0 {
+		errs = append(errs, fmt.Errorf("port quarantine must not be negative, got %s", cfg.PortQuarantine))
+		cfg.PortQuarantine = defaultPortQuarantine
+	}
+	if cfg.LoopbackCIDR != "" {
+		prefix, err := netip.ParsePrefix(cfg.LoopbackCIDR)
+		if err != nil || !prefix.Addr().Is4() || !prefix.Addr().IsLoopback() || prefix.Bits() < 8 {
+			errs = append(errs, fmt.Errorf("loopback CIDR must be an IPv4 prefix within 127.0.0.0/8, got %q", cfg.LoopbackCIDR))
+			cfg.LoopbackCIDR = ""
+		}
+	}
+	if cfg.LoopbackPort <= 0 || cfg.LoopbackPort >= 65535 {
+		errs = append(errs, fmt.Errorf("loopback port must be 1-65534, got %d", cfg.LoopbackPort))
+		cfg.LoopbackPort = defaultLoopbackPort
+	}
 	if cfg.LogFormat == "" {
 		cfg.LogFormat = defaultLogFormat
 	}
+	if err := logging.ParseLevels(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log level: %w", err))
+		cfg.LogLevel = defaultLogLevel
+	}
+	if cfg.LogSampleBurst < 0 {
+		errs = append(errs, fmt.Errorf("log sample burst must not be negative, got %d", cfg.LogSampleBurst))
+		cfg.LogSampleBurst = defaultLogSampleBurst
+	}
+	if cfg.LogSampleInterval <= 0 {
+		errs = append(errs, fmt.Errorf("log sample interval must be positive, got %s", cfg.LogSampleInterval))
+		cfg.LogSampleInterval = defaultLogSampleInterval
+	}
 	if cfg.RestartBackoff <= 0 {
 		errs = append(errs, fmt.Errorf("restart backoff must be positive, got %s", cfg.RestartBackoff))
 		cfg.RestartBackoff = defaultRestartBackoff
 	}
+	if cfg.RestartMaxBackoff < cfg.RestartBackoff {
+		errs = append(errs, fmt.Errorf("restart max backoff %s must not be below restart backoff %s", cfg.RestartMaxBackoff, cfg.RestartBackoff))
+		cfg.RestartMaxBackoff = max(defaultRestartMaxBackoff, cfg.RestartBackoff)
+	}
+	if cfg.RestartJitter < 0 || cfg.RestartJitter > 1 {
+		errs = append(errs, fmt.Errorf("restart jitter must be 0-1, got %g", cfg.RestartJitter))
+		cfg.RestartJitter = defaultRestartJitter
+	}
+	if cfg.RestartWindow <= 0 {
+		errs = append(errs, fmt.Errorf("restart window must be positive, got %s", cfg.RestartWindow))
+		cfg.RestartWindow = defaultRestartWindow
+	}
 	if cfg.MaxRestarts <= 0 {
 		errs = append(errs, fmt.Errorf("max restarts must be positive, got %d", cfg.MaxRestarts))
 		cfg.MaxRestarts = defaultMaxRestarts
 	}
+	if cfg.LivenessInterval <= 0 {
+		errs = append(errs, fmt.Errorf("liveness interval must be positive, got %s", cfg.LivenessInterval))
+		cfg.LivenessInterval = defaultLivenessInterval
+	}
+	if cfg.LivenessFailures <= 0 {
+		errs = append(errs, fmt.Errorf("liveness failures must be positive, got %d", cfg.LivenessFailures))
+		cfg.LivenessFailures = defaultLivenessFailures
+	}
+	if cfg.BreakerFailures <= 0 {
+		errs = append(errs, fmt.Errorf("breaker failures must be positive, got %d", cfg.BreakerFailures))
+		cfg.BreakerFailures = defaultBreakerFailures
+	}
+	if cfg.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("breaker cooldown must be positive, got %s", cfg.BreakerCooldown))
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	if cfg.MaxTunnels < 0 {
+		errs = append(errs, fmt.Errorf("max tunnels must not be negative, got %d", cfg.MaxTunnels))
+		cfg.MaxTunnels = 0
+	}
+	if cfg.MaxTunnelsWait < 0 {
+		errs = append(errs, fmt.Errorf("max tunnels wait must not be negative, got %s", cfg.MaxTunnelsWait))
+		cfg.MaxTunnelsWait = 0
+	}
+	if cfg.UpgradeTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("upgrade timeout must be positive, got %s", cfg.UpgradeTimeout))
+		cfg.UpgradeTimeout = defaultUpgradeTimeout
+	}
+	if cfg.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("drain timeout must not be negative, got %s", cfg.DrainTimeout))
+		cfg.DrainTimeout = 0
+	}
+	if cfg.ChildGroup != "" && cfg.ChildUser == "" {
+		errs = append(errs, fmt.Errorf("child group %q requires a child user", cfg.ChildGroup))
+		cfg.ChildGroup = ""
+	}
+	if cfg.AdminAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.AdminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin address %q: %w", cfg.AdminAddr, err))
+			cfg.AdminAddr = ""
+		}
+	}
+	if cfg.AccessLogFormat == "" {
+		cfg.AccessLogFormat = defaultAccessLogFormat
+	}
+	if cfg.LogOutput == "" {
+		cfg.LogOutput = defaultLogOutput
+	}
+	// Two writers rotating the same file would rename it from under each other.
+	files := map[string]string{}
+	for _, out := range []struct{ env, dest string }{{envLogOutput, cfg.LogOutput}, {envAccessLog, cfg.AccessLog}, {envCloudflaredLog, cfg.CloudflaredLog}} {
+		if out.dest == "" || out.dest == "stdout" || out.dest == "stderr" {
+			continue
+		}
+		path := filepath.Clean(out.dest)
+		if other, ok := files[path]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s both write to %s; use separate files", other, out.env, out.dest))
+			if out.env == envAccessLog {
+				cfg.AccessLog = ""
+			} else {
+				cfg.CloudflaredLog = ""
+			}
+			continue
+		}
+		files[path] = out.env
+	}
+	if cfg.LogMaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("log max size must not be negative, got %d", cfg.LogMaxSizeMB))
+		cfg.LogMaxSizeMB = defaultLogMaxSizeMB
+	}
+	if cfg.LogMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("log max age must not be negative, got %s", cfg.LogMaxAge))
+		cfg.LogMaxAge = 0
+	}
+	if cfg.LogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("log max backups must not be negative, got %d", cfg.LogMaxBackups))
+		cfg.LogMaxBackups = defaultLogMaxBackups
+	}
+	if err := validateRoutes(cfg.Routes); err != nil {
+		errs = append(errs, err)
+		cfg.Routes = nil
+	}
 
 	return errors.Join(errs...)
 }
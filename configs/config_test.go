@@ -2,6 +2,8 @@ package configs
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,6 +33,9 @@ func TestLoadConfigDefaults(t *testing.T) {
 	if cfg.LogFormat != defaultLogFormat {
 		t.Fatalf("LogFormat: got %q, want %q", cfg.LogFormat, defaultLogFormat)
 	}
+	if !cfg.ChildPdeathsig || !cfg.ChildSetpgid || len(cfg.ChildEnvAllowlist) == 0 {
+		t.Fatalf("child hardening should be on by default, got %+v", cfg)
+	}
 }
 
 func TestLoadConfigOverrides(t *testing.T) {
@@ -42,8 +47,48 @@ func TestLoadConfigOverrides(t *testing.T) {
 	t.Setenv(envPortRangeStart, "25000")
 	t.Setenv(envPortRangeEnd, "25010")
 	t.Setenv(envLogFormat, "json")
+	t.Setenv(envLogLevel, "WARN,sni=debug")
+	t.Setenv(envLogSampleBurst, "0")
+	t.Setenv(envLogSampleInterval, "30s")
+	t.Setenv(envLogOutput, "/var/log/tunnel-proxy/proxy.log")
+	t.Setenv(envCloudflaredLog, "stderr")
+	t.Setenv(envLogMaxSize, "0")
+	t.Setenv(envLogMaxAge, "24h")
+	t.Setenv(envLogMaxBackups, "30")
+	t.Setenv(envLogCompress, "true")
 	t.Setenv(envRestartBackoff, "1s")
 	t.Setenv(envMaxRestarts, "5")
+	t.Setenv(envRestartMaxBackoff, "30s")
+	t.Setenv(envRestartJitter, "0.5")
+	t.Setenv(envRestartWindow, "10m")
+	t.Setenv(envWebhookURL, "https://alerts.example.com/hook")
+	t.Setenv(envWebhookEvents, "failed, Restarting")
+	t.Setenv(envWebhookRetries, "0")
+	t.Setenv(envOTLPEndpoint, "http://127.0.0.1:4318")
+	t.Setenv(envTraceSampleRatio, "0.25")
+	t.Setenv(envAccessLog, "stderr")
+	t.Setenv(envAccessLogFmt, "logfmt")
+	t.Setenv(envBreakerFails, "2")
+	t.Setenv(envPortQuarantine, "0")
+	t.Setenv(envMaxTunnels, "50")
+	t.Setenv(envMaxTunnelsWait, "2s")
+	t.Setenv(envLoopbackCIDR, "127.64.0.0/16")
+	t.Setenv(envLoopbackPort, "5432")
+	t.Setenv(envBreakerCool, "1m")
+	t.Setenv(envAdminAddr, "127.0.0.1:19001")
+	t.Setenv(envChildPdeath, "false")
+	t.Setenv(envChildSetpgid, "0")
+	t.Setenv(envChildUser, "nobody")
+	t.Setenv(envChildGroup, "nogroup")
+	t.Setenv(envChildNoFile, "4096")
+	t.Setenv(envChildAS, "2147483648")
+	t.Setenv(envChildEnv, "PATH, TUNNEL_*")
+	t.Setenv(envStateFile, "/var/lib/tcp-tunnel-proxy/state.json")
+	t.Setenv(envUpgradeTimeout, "10s")
+	t.Setenv(envDrainTimeout, "15m")
+	t.Setenv(envCFBin, "/usr/local/bin/cloudflared")
+	t.Setenv(envCFArgs, "access tcp --hostname {{.Hostname}} --url {{.Listen}}")
+	t.Setenv(envCFExtraArgs, `--loglevel debug --header "X-A: b"`)
 
 	cfg, err := LoadConfigFromEnv()
 	if err != nil {
@@ -68,12 +113,69 @@ func TestLoadConfigOverrides(t *testing.T) {
 	if cfg.LogFormat != "json" {
 		t.Fatalf("LogFormat override failed, got %q", cfg.LogFormat)
 	}
+	if cfg.LogOutput != "/var/log/tunnel-proxy/proxy.log" || cfg.CloudflaredLog != "stderr" {
+		t.Fatalf("log output override failed, got %q/%q", cfg.LogOutput, cfg.CloudflaredLog)
+	}
+	if cfg.LogMaxSizeMB != 0 || cfg.LogMaxAge != 24*time.Hour || cfg.LogMaxBackups != 30 || !cfg.LogCompress {
+		t.Fatalf("log rotation override failed, got %d/%v/%d/%v", cfg.LogMaxSizeMB, cfg.LogMaxAge, cfg.LogMaxBackups, cfg.LogCompress)
+	}
+	if cfg.LogLevel != "warn,sni=debug" || cfg.LogSampleBurst != 0 || cfg.LogSampleInterval != 30*time.Second {
+		t.Fatalf("log level/sampling override failed, got %q/%d/%v", cfg.LogLevel, cfg.LogSampleBurst, cfg.LogSampleInterval)
+	}
 	if cfg.RestartBackoff != time.Second {
 		t.Fatalf("RestartBackoff override failed, got %v", cfg.RestartBackoff)
 	}
 	if cfg.MaxRestarts != 5 {
 		t.Fatalf("MaxRestarts override failed, got %d", cfg.MaxRestarts)
 	}
+	if cfg.RestartMaxBackoff != 30*time.Second || cfg.RestartJitter != 0.5 || cfg.RestartWindow != 10*time.Minute {
+		t.Fatalf("Restart policy override failed, got %v/%g/%v", cfg.RestartMaxBackoff, cfg.RestartJitter, cfg.RestartWindow)
+	}
+	if cfg.WebhookURL != "https://alerts.example.com/hook" || strings.Join(cfg.WebhookEvents, ",") != "failed,restarting" || cfg.WebhookMaxRetries != 0 {
+		t.Fatalf("Webhook override failed, got %q %q %d", cfg.WebhookURL, cfg.WebhookEvents, cfg.WebhookMaxRetries)
+	}
+	if cfg.OTLPEndpoint != "http://127.0.0.1:4318" || cfg.TraceSampleRatio != 0.25 || cfg.TraceServiceName != defaultTraceServiceName {
+		t.Fatalf("Tracing override failed, got %q %g %q", cfg.OTLPEndpoint, cfg.TraceSampleRatio, cfg.TraceServiceName)
+	}
+	if cfg.AccessLog != "stderr" || cfg.AccessLogFormat != "logfmt" {
+		t.Fatalf("AccessLog override failed, got %q/%q", cfg.AccessLog, cfg.AccessLogFormat)
+	}
+	if cfg.BreakerFailures != 2 || cfg.BreakerCooldown != time.Minute {
+		t.Fatalf("Breaker override failed, got %d/%v", cfg.BreakerFailures, cfg.BreakerCooldown)
+	}
+	if cfg.MaxTunnels != 50 || cfg.MaxTunnelsWait != 2*time.Second {
+		t.Fatalf("MaxTunnels override failed, got %d/%v", cfg.MaxTunnels, cfg.MaxTunnelsWait)
+	}
+	if cfg.PortQuarantine != 0 {
+		t.Fatalf("PortQuarantine override to 0 failed, got %v", cfg.PortQuarantine)
+	}
+	if cfg.LoopbackCIDR != "127.64.0.0/16" || cfg.LoopbackPort != 5432 {
+		t.Fatalf("Loopback override failed, got %q/%d", cfg.LoopbackCIDR, cfg.LoopbackPort)
+	}
+	if cfg.AdminAddr != "127.0.0.1:19001" {
+		t.Fatalf("AdminAddr override failed, got %q", cfg.AdminAddr)
+	}
+	if cfg.ChildPdeathsig || cfg.ChildSetpgid || cfg.ChildUser != "nobody" || cfg.ChildGroup != "nogroup" {
+		t.Fatalf("Child process override failed, got %v/%v/%q/%q", cfg.ChildPdeathsig, cfg.ChildSetpgid, cfg.ChildUser, cfg.ChildGroup)
+	}
+	if cfg.ChildRLimitNoFile != 4096 || cfg.ChildRLimitAS != 2147483648 {
+		t.Fatalf("Child rlimit override failed, got %d/%d", cfg.ChildRLimitNoFile, cfg.ChildRLimitAS)
+	}
+	if strings.Join(cfg.ChildEnvAllowlist, ",") != "PATH,TUNNEL_*" {
+		t.Fatalf("Child env allowlist override failed, got %q", cfg.ChildEnvAllowlist)
+	}
+	if cfg.StateFile != "/var/lib/tcp-tunnel-proxy/state.json" {
+		t.Fatalf("StateFile override failed, got %q", cfg.StateFile)
+	}
+	if cfg.UpgradeTimeout != 10*time.Second || cfg.DrainTimeout != 15*time.Minute {
+		t.Fatalf("Upgrade override failed, got %v/%v", cfg.UpgradeTimeout, cfg.DrainTimeout)
+	}
+	if cfg.CloudflaredBin != "/usr/local/bin/cloudflared" || !strings.HasPrefix(cfg.CloudflaredArgs, "access tcp") {
+		t.Fatalf("cloudflared command override failed, got %q %q", cfg.CloudflaredBin, cfg.CloudflaredArgs)
+	}
+	if strings.Join(cfg.CloudflaredExtraArgs, "|") != "--loglevel|debug|--header|X-A: b" {
+		t.Fatalf("cloudflared extra args override failed, got %q", cfg.CloudflaredExtraArgs)
+	}
 }
 
 func TestLoadConfigInvalidValues(t *testing.T) {
@@ -83,9 +185,28 @@ func TestLoadConfigInvalidValues(t *testing.T) {
 	t.Setenv(envPortRangeStart, "30000")
 	t.Setenv(envPortRangeEnd, "20000") // end < start triggers validation error/reset
 	t.Setenv(envLogFormat, "xml")
+	t.Setenv(envLogLevel, "info,sni=loud")
+	t.Setenv(envLogSampleBurst, "-1")
+	t.Setenv(envLogMaxBackups, "-1")
+	t.Setenv(envLogMaxAge, "-1h")
 	t.Setenv(envListenAddr, "badaddr")
 	t.Setenv(envRestartBackoff, "-1s")
 	t.Setenv(envMaxRestarts, "0")
+	t.Setenv(envRestartJitter, "1.5")
+	t.Setenv(envRestartWindow, "0s")
+	t.Setenv(envWebhookURL, "alerts.example.com/hook")
+	t.Setenv(envWebhookEvents, "failed,exploded")
+	t.Setenv(envOTLPEndpoint, "127.0.0.1:4318")
+	t.Setenv(envTraceSampleRatio, "2")
+	t.Setenv(envBreakerFails, "-1")
+	t.Setenv(envLoopbackCIDR, "10.0.0.0/8")
+	t.Setenv(envChildPdeath, "sometimes")
+	t.Setenv(envChildNoFile, "-1")
+	t.Setenv(envChildGroup, "nogroup")
+	t.Setenv(envUpgradeTimeout, "0s")
+	t.Setenv(envDrainTimeout, "-1m")
+	t.Setenv(envCFArgs, "{{.Hostname")
+	t.Setenv(envCFExtraArgs, `--header "unterminated`)
 
 	cfg, err := LoadConfigFromEnv()
 	if err == nil {
@@ -104,6 +225,12 @@ func TestLoadConfigInvalidValues(t *testing.T) {
 	if cfg.LogFormat != defaultLogFormat {
 		t.Fatalf("LogFormat should remain default on invalid, got %q", cfg.LogFormat)
 	}
+	if cfg.LogMaxBackups != defaultLogMaxBackups || cfg.LogMaxAge != 0 {
+		t.Fatalf("log rotation should remain default on invalid, got %d/%v", cfg.LogMaxBackups, cfg.LogMaxAge)
+	}
+	if cfg.LogLevel != defaultLogLevel || cfg.LogSampleBurst != defaultLogSampleBurst {
+		t.Fatalf("log level/sampling should remain default on invalid, got %q/%d", cfg.LogLevel, cfg.LogSampleBurst)
+	}
 	if cfg.ListenAddr != defaultListenAddr {
 		t.Fatalf("ListenAddr should reset to default on invalid, got %q", cfg.ListenAddr)
 	}
@@ -113,6 +240,33 @@ func TestLoadConfigInvalidValues(t *testing.T) {
 	if cfg.MaxRestarts != defaultMaxRestarts {
 		t.Fatalf("MaxRestarts should reset to default on invalid, got %d", cfg.MaxRestarts)
 	}
+	if cfg.RestartJitter != defaultRestartJitter || cfg.RestartWindow != defaultRestartWindow {
+		t.Fatalf("Restart policy should stay default on invalid, got %g/%v", cfg.RestartJitter, cfg.RestartWindow)
+	}
+	if cfg.WebhookURL != "" || cfg.WebhookEvents != nil {
+		t.Fatalf("Webhook should stay disabled on invalid, got %q %q", cfg.WebhookURL, cfg.WebhookEvents)
+	}
+	if cfg.OTLPEndpoint != "" || cfg.TraceSampleRatio != defaultTraceSampleRatio {
+		t.Fatalf("Tracing should stay at defaults on invalid, got %q %g", cfg.OTLPEndpoint, cfg.TraceSampleRatio)
+	}
+	if cfg.BreakerFailures != defaultBreakerFailures {
+		t.Fatalf("BreakerFailures should stay default on invalid, got %d", cfg.BreakerFailures)
+	}
+	if cfg.LoopbackCIDR != "" {
+		t.Fatalf("non-loopback CIDR should be rejected, got %q", cfg.LoopbackCIDR)
+	}
+	if !cfg.ChildPdeathsig || cfg.ChildRLimitNoFile != 0 {
+		t.Fatalf("child settings should stay default on invalid, got %v/%d", cfg.ChildPdeathsig, cfg.ChildRLimitNoFile)
+	}
+	if cfg.ChildGroup != "" {
+		t.Fatalf("child group without a user should be rejected, got %q", cfg.ChildGroup)
+	}
+	if cfg.UpgradeTimeout != defaultUpgradeTimeout || cfg.DrainTimeout != 0 {
+		t.Fatalf("upgrade settings should stay default on invalid, got %v/%v", cfg.UpgradeTimeout, cfg.DrainTimeout)
+	}
+	if cfg.CloudflaredArgs != defaultCloudflaredArgs || cfg.CloudflaredExtraArgs != nil {
+		t.Fatalf("cloudflared command should stay default on invalid, got %q %q", cfg.CloudflaredArgs, cfg.CloudflaredExtraArgs)
+	}
 }
 
 func unsetAllEnv(t *testing.T) {
@@ -123,7 +277,190 @@ func unsetAllEnv(t *testing.T) {
 	os.Unsetenv(envReadHello)
 	os.Unsetenv(envPortRangeStart)
 	os.Unsetenv(envPortRangeEnd)
+	os.Unsetenv(envPortQuarantine)
+	os.Unsetenv(envLoopbackCIDR)
+	os.Unsetenv(envLoopbackPort)
 	os.Unsetenv(envLogFormat)
+	os.Unsetenv(envLogLevel)
+	os.Unsetenv(envLogSampleBurst)
+	os.Unsetenv(envLogSampleInterval)
+	os.Unsetenv(envLogOutput)
+	os.Unsetenv(envCloudflaredLog)
+	os.Unsetenv(envLogMaxSize)
+	os.Unsetenv(envLogMaxAge)
+	os.Unsetenv(envLogMaxBackups)
+	os.Unsetenv(envLogCompress)
 	os.Unsetenv(envRestartBackoff)
 	os.Unsetenv(envMaxRestarts)
+	os.Unsetenv(envRestartMaxBackoff)
+	os.Unsetenv(envRestartJitter)
+	os.Unsetenv(envRestartWindow)
+	os.Unsetenv(envWebhookURL)
+	os.Unsetenv(envWebhookEvents)
+	os.Unsetenv(envWebhookBatch)
+	os.Unsetenv(envWebhookFlush)
+	os.Unsetenv(envWebhookRetries)
+	os.Unsetenv(envWebhookTimeout)
+	os.Unsetenv(envOTLPEndpoint)
+	os.Unsetenv(envTraceSampleRatio)
+	os.Unsetenv(envTraceServiceName)
+	os.Unsetenv(envRoutesFile)
+	os.Unsetenv(envECHKeysFile)
+	os.Unsetenv(envAccessLog)
+	os.Unsetenv(envAccessLogFmt)
+	os.Unsetenv(envLivenessEvery)
+	os.Unsetenv(envLivenessFails)
+	os.Unsetenv(envBreakerFails)
+	os.Unsetenv(envBreakerCool)
+	os.Unsetenv(envAdminAddr)
+	os.Unsetenv(envMaxTunnels)
+	os.Unsetenv(envMaxTunnelsWait)
+	os.Unsetenv(envChildPdeath)
+	os.Unsetenv(envChildSetpgid)
+	os.Unsetenv(envChildUser)
+	os.Unsetenv(envChildGroup)
+	os.Unsetenv(envChildNoFile)
+	os.Unsetenv(envChildAS)
+	os.Unsetenv(envChildEnv)
+	os.Unsetenv(envStateFile)
+	os.Unsetenv(envUpgradeTimeout)
+	os.Unsetenv(envDrainTimeout)
+	os.Unsetenv(envConfigFile)
+	os.Unsetenv(envCFBin)
+	os.Unsetenv(envCFArgs)
+	os.Unsetenv(envCFExtraArgs)
+}
+
+func TestLoadConfigRoutesFile(t *testing.T) {
+	unsetAllEnv(t)
+	path := filepath.Join(t.TempDir(), "routes.json")
+	data := `{"routes":[{"match":"*.example.com","min_tls_version":"1.2","cipher_suites":["TLS_AES_128_GCM_SHA256"],"replicas":3}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+	t.Setenv(envRoutesFile, path)
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected valid routes file, got %v", err)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].MinTLSVersion != "1.2" || cfg.Routes[0].Replicas != 3 {
+		t.Fatalf("unexpected routes: %+v", cfg.Routes)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"routes":[{"match":"x.com","min_tls_version":"1.9"}]}`), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+	t.Setenv(envRoutesFile, bad)
+	if cfg, err := LoadConfigFromEnv(); err == nil || len(cfg.Routes) != 0 {
+		t.Fatalf("expected invalid TLS version to be rejected, got routes=%+v err=%v", cfg.Routes, err)
+	}
+
+	insecure := filepath.Join(t.TempDir(), "insecure.json")
+	data = `{"routes":[{"match":"x.com","secure_ciphers_only":true,"cipher_suites":["TLS_AES_128_GCM_SHA256","TLS_RSA_WITH_RC4_128_SHA"]}]}`
+	if err := os.WriteFile(insecure, []byte(data), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+	t.Setenv(envRoutesFile, insecure)
+	if _, err := LoadConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "TLS_RSA_WITH_RC4_128_SHA") {
+		t.Fatalf("expected an insecure suite with secure_ciphers_only to be rejected, got %v", err)
+	}
+}
+
+func TestChangedDetectsEditedRoutesFile(t *testing.T) {
+	unsetAllEnv(t)
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(`{"routes":[{"match":"*.example.com","replicas":1}]}`), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+	t.Setenv(envRoutesFile, path)
+	old, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(`{"routes":[{"match":"*.example.com","replicas":2}]}`), 0o600); err != nil {
+		t.Fatalf("rewrite routes file: %v", err)
+	}
+	next, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if got := strings.Join(Changed(old, next), ","); got != "routes_file" {
+		t.Fatalf("an edited routes file at the same path should count as changed, got %q", got)
+	}
+	if got := Changed(next, next); len(got) != 0 {
+		t.Fatalf("unchanged routes reported as changed: %v", got)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := defaultConfig()
+	next := old
+	next.IdleTimeout = time.Minute
+	next.ListenAddr = "127.0.0.1:29000"
+	next.RoutesFile = "/etc/routes.json"
+	if got := RestartRequired(old, next); len(got) != 0 {
+		t.Fatalf("live settings should not require a restart, got %v", got)
+	}
+	next.PortRangeEnd = 30000
+	next.ChildEnvAllowlist = []string{"PATH"}
+	if got := strings.Join(RestartRequired(old, next), ","); got != "port_range_end,child_env_allowlist" {
+		t.Fatalf("unexpected restart-only changes %q", got)
+	}
+	if got := strings.Join(Changed(old, next), ","); got != "listen_addr,idle_timeout,port_range_end,routes_file,child_env_allowlist" {
+		t.Fatalf("unexpected changes %q", got)
+	}
+}
+
+func TestLoadConfigRoutesServiceToken(t *testing.T) {
+	unsetAllEnv(t)
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	t.Setenv("DB_TOKEN_ID", "id.access")
+	path := filepath.Join(dir, "routes.json")
+	data := `{"routes":[{"match":"db.example.com","service_token":{"id":"env:DB_TOKEN_ID","secret":"file:` + secretFile + `"}}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+	t.Setenv(envRoutesFile, path)
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected valid service token references, got %v", err)
+	}
+	id, secret, err := cfg.Routes[0].ServiceToken.Resolve()
+	if err != nil || id != "id.access" || secret != "s3cr3t" {
+		t.Fatalf("Resolve: %q %q %v", id, secret, err)
+	}
+
+	for _, ref := range []ServiceTokenRef{
+		{ID: "id.access", Secret: "env:DB_TOKEN_ID"},                       // literal values are not accepted
+		{ID: "env:DB_TOKEN_MISSING", Secret: "env:DB_TOKEN_ID"},            // unset variable
+		{ID: "env:DB_TOKEN_ID", Secret: "file:" + filepath.Join(dir, "x")}, // missing file
+	} {
+		if _, _, err := ref.Resolve(); err == nil {
+			t.Fatalf("expected error for %+v", ref)
+		} else if strings.Contains(err.Error(), "s3cr3t") || strings.Contains(err.Error(), "id.access") {
+			t.Fatalf("error leaked a credential: %v", err)
+		}
+	}
+}
+
+func TestLoadConfigRejectsSharedLogFiles(t *testing.T) {
+	unsetAllEnv(t)
+	t.Setenv(envLogOutput, "/var/log/proxy.log")
+	t.Setenv(envAccessLog, "/var/log/../log/proxy.log")
+	t.Setenv(envCloudflaredLog, "stdout")
+
+	cfg, err := LoadConfigFromEnv()
+	if err == nil || !strings.Contains(err.Error(), envAccessLog) {
+		t.Fatalf("expected an error naming %s, got %v", envAccessLog, err)
+	}
+	if cfg.AccessLog != "" || cfg.LogOutput != "/var/log/proxy.log" || cfg.CloudflaredLog != "stdout" {
+		t.Fatalf("only the conflicting output should be reset, got %q/%q/%q", cfg.LogOutput, cfg.AccessLog, cfg.CloudflaredLog)
+	}
 }
@@ -0,0 +1,356 @@
+package configs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultEnvFile is loaded when present and --env-file is not given.
+const defaultEnvFile = ".env"
+
+// Loaded is the merged configuration together with where each setting came from.
+type Loaded struct {
+	Config      Config
+	Sources     map[string]string // setting key -> source; settings left at their default are absent
+	PrintConfig bool              // --print-config was given
+}
+
+// Load merges, from lowest to highest precedence: defaults, the YAML config file (--config or CONFIG_FILE),
+// the dotenv file (--env-file, else ./.env if present), environment variables and command-line flags.
+// The result is checked by validateConfig. The returned Loaded is usable for --print-config even when an
+// error is returned, except for flag parse errors (including flag.ErrHelp).
+func Load(args []string) (Loaded, error) {
+	fs := flag.NewFlagSet("tcp-tunnel-proxy", flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML config file (default $"+envConfigFile+")")
+	envFile := fs.String("env-file", "", "dotenv file (default "+defaultEnvFile+" if it exists)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and the source of each value, then exit")
+	flags := layer{origin: func(s setting) string { return "flag --" + s.flag() }, values: map[string]string{}}
+	for _, s := range settings {
+		record := func(v string) error {
+			flags.values[s.key()] = v
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag(), s.usage, record)
+		} else {
+			fs.Func(s.flag(), s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Loaded{}, err
+	}
+	if fs.NArg() > 0 {
+		return Loaded{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	loaded := Loaded{Config: defaultConfig(), Sources: map[string]string{}, PrintConfig: *printConfig}
+	var errs []error
+
+	// The dotenv file is read first so it can export CONFIG_FILE, but it still ranks above the config file.
+	dotenv, err := dotenvLayer(*envFile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if *configFile == "" {
+		*configFile = strings.TrimSpace(os.Getenv(envConfigFile))
+	}
+	if *configFile != "" {
+		file, err := fileLayer(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, file.apply(&loaded.Config, loaded.Sources)...)
+	}
+	errs = append(errs, dotenv.apply(&loaded.Config, loaded.Sources)...)
+	errs = append(errs, envLayer().apply(&loaded.Config, loaded.Sources)...)
+	errs = append(errs, flags.apply(&loaded.Config, loaded.Sources)...)
+
+	before := make(map[string]string, len(settings))
+	for _, s := range settings {
+		before[s.key()] = s.get(&loaded.Config)
+	}
+	if err := validateConfig(&loaded.Config); err != nil {
+		errs = append(errs, err)
+	}
+	for _, s := range settings {
+		if v := before[s.key()]; v != s.get(&loaded.Config) {
+			loaded.Sources[s.key()] = fmt.Sprintf("default (rejected %q from %s)", s.display(v), loaded.source(s))
+		}
+	}
+	return loaded, errors.Join(errs...)
+}
+
+func (l Loaded) source(s setting) string {
+	if src, ok := l.Sources[s.key()]; ok {
+		return src
+	}
+	return "default"
+}
+
+// Print writes every setting with the source it came from and its effective value. Credentials in URL settings
+// are redacted.
+func (l Loaded) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tSOURCE\tVALUE")
+	for _, s := range settings {
+		v := s.display(s.get(&l.Config))
+		if v == "" {
+			v = `""`
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.key(), l.source(s), v)
+	}
+	return tw.Flush()
+}
+
+// layer is one configuration source: raw values keyed by setting key.
+type layer struct {
+	origin func(s setting) string // names the setting in errors and --print-config
+	values map[string]string
+}
+
+// apply parses the layer's values into cfg in place. A value that fails to parse is reported and leaves the
+// lower-precedence value alone, as does an empty value unless the setting gives emptiness a meaning.
+func (l layer) apply(cfg *Config, sources map[string]string) []error {
+	var errs []error
+	for _, s := range settings {
+		v, ok := l.values[s.key()]
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "" && !s.allowEmpty {
+			continue
+		}
+		if err := s.set(cfg, v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %q (%v)", l.origin(s), v, err))
+			continue
+		}
+		if sources != nil {
+			sources[s.key()] = l.origin(s)
+		}
+	}
+	return errs
+}
+
+func envLayer() layer {
+	l := layer{origin: func(s setting) string { return s.env }, values: map[string]string{}}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			l.values[s.key()] = v
+		}
+	}
+	return l
+}
+
+// fileLayer reads a YAML config file of top-level "setting: value" pairs. Keys are the lower-cased env
+// names (dashes are accepted for underscores); lists are joined with commas. Unknown keys are errors so
+// typos do not go unnoticed.
+func fileLayer(path string) (layer, error) {
+	l := layer{origin: func(s setting) string { return s.key() + " in " + path }, values: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return l, fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return l, fmt.Errorf("config file %s: %w", path, err)
+	}
+	known := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		known[s.key()] = true
+	}
+	var errs []error
+	for k, v := range raw {
+		key := strings.ReplaceAll(strings.ToLower(k), "-", "_")
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %q", path, k))
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		s, err := yamlScalar(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, k, err))
+			continue
+		}
+		l.values[key] = s
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return l, errors.Join(errs...)
+}
+
+func yamlScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := yamlScalar(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("must be a scalar or a list, got %T", v)
+}
+
+// dotenvLayer loads path, or ./.env when path is empty and that file exists. Settings become a layer; any
+// other variables (TUNNEL_* for cloudflared, CONFIG_FILE) are exported to the environment unless already set.
+func dotenvLayer(path string) (layer, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultEnvFile
+	}
+	l := layer{origin: func(s setting) string { return s.env + " in " + path }, values: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return l, nil
+		}
+		return l, fmt.Errorf("env file: %w", err)
+	}
+	vars, err := parseDotenv(data)
+	if err != nil {
+		return l, fmt.Errorf("env file %s: %w", path, err)
+	}
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.env] = s
+	}
+	exportedMu.Lock()
+	defer exportedMu.Unlock()
+	for name, v := range vars {
+		if s, ok := known[name]; ok {
+			l.values[s.key()] = v
+			continue
+		}
+		cur, set := os.LookupEnv(name)
+		if prev, ours := exported[name]; set && (!ours || cur != prev) {
+			// Set by the environment (or changed since we exported it): that wins.
+			delete(exported, name)
+			continue
+		}
+		os.Setenv(name, v)
+		exported[name] = v
+	}
+	for name, prev := range exported {
+		if _, ok := vars[name]; !ok {
+			if cur, set := os.LookupEnv(name); set && cur == prev {
+				os.Unsetenv(name)
+			}
+			delete(exported, name)
+		}
+	}
+	return l, nil
+}
+
+// exported remembers the variables dotenvLayer put into the environment and their values, so a reload can
+// update or remove them after the file changes without overriding anything the real environment set.
+var (
+	exportedMu sync.Mutex
+	exported   = map[string]string{}
+)
+
+// parseDotenv reads NAME=value lines. Blank lines and # comments are skipped, an "export " prefix is allowed,
+// values may be single-quoted (literal) or double-quoted (with \n, \t, \" and \\ escapes), and an unquoted
+// value ends at " #".
+func parseDotenv(data []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, v, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validEnvName(name) {
+			return nil, fmt.Errorf("line %d: expected NAME=value", lineNo)
+		}
+		v, err := dotenvValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNo, name, err)
+		}
+		vars[name] = v
+	}
+	return vars, sc.Err()
+}
+
+func dotenvValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	var val, rest string
+	switch v[0] {
+	case '\'':
+		end := strings.IndexByte(v[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated quote")
+		}
+		val, rest = v[1:1+end], v[2+end:]
+	case '"':
+		var b strings.Builder
+		i := 1
+		for ; i < len(v) && v[i] != '"'; i++ {
+			if v[i] == '\\' && i+1 < len(v) {
+				i++
+				switch v[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(v[i])
+				}
+				continue
+			}
+			b.WriteByte(v[i])
+		}
+		if i >= len(v) {
+			return "", errors.New("unterminated quote")
+		}
+		val, rest = b.String(), v[i+1:]
+	default:
+		if strings.HasPrefix(v, "#") {
+			return "", nil
+		}
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = v[:i]
+		}
+		return strings.TrimSpace(v), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+	return val, nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package configs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+)
+
+// Route describes per-SNI policy. Match is an exact hostname, a "*.suffix" wildcard, or "*" for every SNI.
+// Routes are evaluated in file order and the first match wins.
+type Route struct {
+	Match             string   `json:"match"`
+	MinTLSVersion     string   `json:"min_tls_version,omitempty"`     // "1.0" | "1.1" | "1.2" | "1.3"
+	CipherSuites      []string `json:"cipher_suites,omitempty"`       // crypto/tls names; client must offer at least one
+	SecureCiphersOnly bool     `json:"secure_ciphers_only,omitempty"` // client must offer a suite from tls.CipherSuites(); CipherSuites may only list those
+	Throttle          Throttle `json:"throttle"`
+	Replicas          int      `json:"replicas,omitempty"` // cloudflared processes for the tunnel; 0 means 1
+	// ServiceToken authenticates the route's cloudflared to Cloudflare Access; nil uses cloudflared's own login.
+	ServiceToken *ServiceTokenRef `json:"service_token,omitempty"`
+}
+
+// ServiceTokenRef points at an Access service token without holding it. ID and Secret are references of the
+// form "env:NAME" or "file:PATH", so the routes file itself never contains credentials.
+type ServiceTokenRef struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// Resolve reads the referenced token. Files are read on every call so a reload picks up rotated credentials.
+func (r ServiceTokenRef) Resolve() (id, secret string, err error) {
+	if id, err = resolveSecretRef(r.ID); err != nil {
+		return "", "", fmt.Errorf("service token id: %w", err)
+	}
+	if secret, err = resolveSecretRef(r.Secret); err != nil {
+		return "", "", fmt.Errorf("service token secret: %w", err)
+	}
+	return id, secret, nil
+}
+
+func resolveSecretRef(ref string) (string, error) {
+	kind, target, _ := strings.Cut(ref, ":")
+	var v string
+	switch kind {
+	case "env":
+		var ok bool
+		if v, ok = os.LookupEnv(target); !ok {
+			return "", fmt.Errorf("environment variable %s is not set", target)
+		}
+	case "file":
+		data, err := os.ReadFile(target)
+		if err != nil {
+			return "", err
+		}
+		v = string(data)
+	default:
+		return "", errors.New(`must be "env:NAME" or "file:PATH"`)
+	}
+	if v = strings.TrimSpace(v); v == "" {
+		return "", fmt.Errorf("%s is empty", ref)
+	}
+	return v, nil
+}
+
+// Throttle holds bandwidth limits for a route. Connection limits apply to each connection, ClientIP limits are
+// shared by all connections from one client IP on the route, and Tunnel limits are shared by every connection to
+// the route's tunnel hostname, whichever route it matched (at the lowest rate those routes set). A nil scope or a
+// zero rate means unlimited.
+type Throttle struct {
+	Connection *Bandwidth `json:"connection,omitempty"`
+	ClientIP   *Bandwidth `json:"client_ip,omitempty"`
+	Tunnel     *Bandwidth `json:"tunnel,omitempty"`
+}
+
+// Bandwidth is a pair of rates in bytes per second. Upload is client -> backend, Download is backend -> client.
+type Bandwidth struct {
+	UploadBytesPerSec   int64 `json:"upload_bytes_per_sec,omitempty"`
+	DownloadBytesPerSec int64 `json:"download_bytes_per_sec,omitempty"`
+}
+
+type routesFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// loadRoutesFile reads a JSON document of the form {"routes": [...]}.
+func loadRoutesFile(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes file: %w", err)
+	}
+	var rf routesFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rf); err != nil {
+		return nil, fmt.Errorf("parse routes file %s: %w", path, err)
+	}
+	return rf.Routes, nil
+}
+
+// routesDigest identifies the parsed routes, so a routes file edited in place counts as a changed setting.
+func routesDigest(routes []Route) string {
+	if len(routes) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(routes)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf(" (sha256:%x)", sum[:6])
+}
+
+func validateRoutes(routes []Route) error {
+	var errs []error
+	for i, r := range routes {
+		match := strings.TrimSpace(r.Match)
+		if match == "" {
+			errs = append(errs, fmt.Errorf("route %d: match is empty", i))
+		} else if strings.Contains(match[1:], "*") || (strings.HasPrefix(match, "*") && match != "*" && !strings.HasPrefix(match, "*.")) {
+			errs = append(errs, fmt.Errorf("route %d: invalid match %q (use exact host, *.suffix or *)", i, r.Match))
+		}
+		if r.MinTLSVersion != "" {
+			if _, err := ParseTLSVersion(r.MinTLSVersion); err != nil {
+				errs = append(errs, fmt.Errorf("route %d: %w", i, err))
+			}
+		}
+		for scope, bw := range map[string]*Bandwidth{"connection": r.Throttle.Connection, "client_ip": r.Throttle.ClientIP, "tunnel": r.Throttle.Tunnel} {
+			if bw != nil && (bw.UploadBytesPerSec < 0 || bw.DownloadBytesPerSec < 0) {
+				errs = append(errs, fmt.Errorf("route %d: throttle %s rates must not be negative", i, scope))
+			}
+		}
+		for _, name := range r.CipherSuites {
+			id, err := ParseCipherSuite(name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("route %d: %w", i, err))
+			} else if r.SecureCiphersOnly && !SecureCipherSuite(id) {
+				errs = append(errs, fmt.Errorf("route %d: cipher suite %q is insecure but secure_ciphers_only is set", i, name))
+			}
+		}
+		if r.Replicas < 0 || r.Replicas > cloudflaredmanager.MaxReplicas {
+			errs = append(errs, fmt.Errorf("route %d: replicas must be 0-%d, got %d", i, cloudflaredmanager.MaxReplicas, r.Replicas))
+		}
+		if r.ServiceToken != nil {
+			if _, _, err := r.ServiceToken.Resolve(); err != nil {
+				errs = append(errs, fmt.Errorf("route %d: %w", i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseTLSVersion maps "1.0".."1.3" (optionally prefixed with "TLS") to the crypto/tls version constant.
+func ParseTLSVersion(v string) (uint16, error) {
+	s := strings.TrimSpace(strings.ToLower(v))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "tls"), "v")
+	switch s {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", v)
+}
+
+// ParseCipherSuite resolves a crypto/tls cipher suite name (secure or insecure) to its ID.
+func ParseCipherSuite(name string) (uint16, error) {
+	name = strings.TrimSpace(name)
+	for _, cs := range tls.CipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, nil
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// SecureCipherSuite reports whether id is in Go's secure set (tls.CipherSuites()).
+func SecureCipherSuite(id uint16) bool {
+	for _, cs := range tls.CipherSuites() {
+		if cs.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -1,3 +1,5 @@
 module tcp-tunnel-proxy
 
 go 1.24.9
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,159 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+// Record is the single access-log entry written when a client connection ends.
+type Record struct {
+	Start          time.Time
+	ClientAddr     string
+	SNI            string
+	TunnelHostname string
+	LocalAddr      string // loopback address of the tunnel listener
+	LocalPort      int
+	BytesIn        int64 // client -> backend, including replayed prelude/ClientHello bytes
+	BytesOut       int64 // backend -> client
+	TimeToSNI      time.Duration
+	TimeToTunnel   time.Duration // from accept until the tunnel reported ready
+	Duration       time.Duration
+	ClosedBy       string // client | backend | proxy
+	CloseReason    string
+}
+
+// Sink serializes records to a dedicated writer.
+type Sink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+	format string // json | logfmt
+}
+
+// Open returns a sink writing to dest ("stdout", "stderr" or a file path opened for append and rotated according
+// to rot).
+func Open(dest, format string, rot logging.Rotation) (*Sink, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "logfmt" {
+		return nil, fmt.Errorf("unknown access log format %q (must be json|logfmt)", format)
+	}
+	out, err := logging.OpenOutput(dest, rot)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return &Sink{format: format, out: out, closer: out}, nil
+}
+
+// New returns a sink writing to w; useful for tests and custom destinations.
+func New(w io.Writer, format string) *Sink {
+	if format != "logfmt" {
+		format = "json"
+	}
+	return &Sink{out: w, format: format}
+}
+
+// Log writes one record. Errors are dropped: access logging must never affect proxying.
+func (s *Sink) Log(r Record) {
+	if s == nil {
+		return
+	}
+	var line []byte
+	if s.format == "logfmt" {
+		line = r.appendLogfmt(nil)
+	} else {
+		line = r.appendJSON()
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	_, _ = s.out.Write(line)
+	s.mu.Unlock()
+}
+
+// Close releases the underlying file, if any.
+func (s *Sink) Close() error {
+	if s == nil || s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+type jsonRecord struct {
+	TS             string  `json:"ts"`
+	ClientAddr     string  `json:"client_addr"`
+	SNI            string  `json:"sni"`
+	TunnelHostname string  `json:"tunnel_hostname"`
+	LocalAddr      string  `json:"local_addr"`
+	LocalPort      int     `json:"local_port"`
+	BytesIn        int64   `json:"bytes_in"`
+	BytesOut       int64   `json:"bytes_out"`
+	TimeToSNIMs    float64 `json:"time_to_sni_ms"`
+	TimeToTunnelMs float64 `json:"time_to_tunnel_ms"`
+	DurationMs     float64 `json:"duration_ms"`
+	ClosedBy       string  `json:"closed_by"`
+	CloseReason    string  `json:"close_reason"`
+}
+
+func (r Record) appendJSON() []byte {
+	data, err := json.Marshal(jsonRecord{
+		TS:             r.Start.UTC().Format(time.RFC3339Nano),
+		ClientAddr:     r.ClientAddr,
+		SNI:            r.SNI,
+		TunnelHostname: r.TunnelHostname,
+		LocalAddr:      r.LocalAddr,
+		LocalPort:      r.LocalPort,
+		BytesIn:        r.BytesIn,
+		BytesOut:       r.BytesOut,
+		TimeToSNIMs:    millis(r.TimeToSNI),
+		TimeToTunnelMs: millis(r.TimeToTunnel),
+		DurationMs:     millis(r.Duration),
+		ClosedBy:       r.ClosedBy,
+		CloseReason:    r.CloseReason,
+	})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (r Record) appendLogfmt(b []byte) []byte {
+	b = appendPair(b, "ts", r.Start.UTC().Format(time.RFC3339Nano))
+	b = appendPair(b, "client_addr", r.ClientAddr)
+	b = appendPair(b, "sni", r.SNI)
+	b = appendPair(b, "tunnel_hostname", r.TunnelHostname)
+	b = appendPair(b, "local_addr", r.LocalAddr)
+	b = appendPair(b, "local_port", strconv.Itoa(r.LocalPort))
+	b = appendPair(b, "bytes_in", strconv.FormatInt(r.BytesIn, 10))
+	b = appendPair(b, "bytes_out", strconv.FormatInt(r.BytesOut, 10))
+	b = appendPair(b, "time_to_sni_ms", strconv.FormatFloat(millis(r.TimeToSNI), 'f', -1, 64))
+	b = appendPair(b, "time_to_tunnel_ms", strconv.FormatFloat(millis(r.TimeToTunnel), 'f', -1, 64))
+	b = appendPair(b, "duration_ms", strconv.FormatFloat(millis(r.Duration), 'f', -1, 64))
+	b = appendPair(b, "closed_by", r.ClosedBy)
+	b = appendPair(b, "close_reason", r.CloseReason)
+	return b
+}
+
+func appendPair(b []byte, key, value string) []byte {
+	if len(b) > 0 {
+		b = append(b, ' ')
+	}
+	b = append(b, key...)
+	b = append(b, '=')
+	if value == "" || strings.ContainsAny(value, " =\"\t\n\\") {
+		return strconv.AppendQuote(b, value)
+	}
+	return append(b, value...)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
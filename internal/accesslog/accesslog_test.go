@@ -0,0 +1,103 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+func sampleRecord() Record {
+	return Record{
+		Start:          time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		ClientAddr:     "203.0.113.7:51234",
+		SNI:            "db.ratio1.link",
+		TunnelHostname: "cft-db.ratio1.link",
+		LocalAddr:      "127.0.0.1:20001",
+		LocalPort:      20001,
+		BytesIn:        512,
+		BytesOut:       2048,
+		TimeToSNI:      1500 * time.Microsecond,
+		TimeToTunnel:   2 * time.Second,
+		Duration:       3 * time.Second,
+		ClosedBy:       "client",
+		CloseReason:    "eof",
+	}
+}
+
+func TestSinkJSON(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, "json").Log(sampleRecord())
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if got["sni"] != "db.ratio1.link" || got["bytes_out"] != float64(2048) || got["time_to_sni_ms"] != 1.5 {
+		t.Fatalf("unexpected JSON record: %v", got)
+	}
+	if got["closed_by"] != "client" || got["local_port"] != float64(20001) || got["local_addr"] != "127.0.0.1:20001" {
+		t.Fatalf("unexpected JSON record: %v", got)
+	}
+}
+
+func TestSinkLogfmtQuotesValues(t *testing.T) {
+	var buf bytes.Buffer
+	rec := sampleRecord()
+	rec.CloseReason = `read tcp: connection reset by "peer"`
+	rec.TunnelHostname = ""
+	New(&buf, "logfmt").Log(rec)
+
+	line := strings.TrimSpace(buf.String())
+	for _, want := range []string{
+		"client_addr=203.0.113.7:51234",
+		"bytes_in=512",
+		"duration_ms=3000",
+		`tunnel_hostname=""`,
+		`close_reason="read tcp: connection reset by \"peer\""`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("logfmt line %q missing %q", line, want)
+		}
+	}
+}
+
+func TestOpenRejectsUnknownFormat(t *testing.T) {
+	if _, err := Open("stdout", "xml", logging.Rotation{}); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
+
+func TestNilSinkIsNoop(t *testing.T) {
+	var s *Sink
+	s.Log(sampleRecord())
+	if err := s.Close(); err != nil {
+		t.Fatalf("nil Close returned %v", err)
+	}
+}
+
+func TestOpenFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	s, err := Open(path, "logfmt", logging.Rotation{MaxSize: 64})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.Log(sampleRecord())
+	s.Log(sampleRecord())
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 1 {
+		t.Fatalf("expected one rotated file, got %v", matches)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("current file should hold the second record, got %q (err=%v)", data, err)
+	}
+}
@@ -0,0 +1,82 @@
+// Package admin serves operator endpoints (status and runtime controls) on a listener separate from the proxy.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+// Server is a small HTTP server for admin endpoints. Register handlers before calling Start.
+type Server struct {
+	addr   string
+	mux    *http.ServeMux
+	srv    *http.Server
+	logger *logging.Logger
+}
+
+// New returns an admin server that will listen on addr.
+func New(addr string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		addr:   addr,
+		mux:    mux,
+		srv:    &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+		logger: logging.New("admin"),
+	}
+}
+
+// Handle registers h for pattern.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// HandleJSON registers a read-only endpoint that renders the value returned by fn as JSON.
+func (s *Server) HandleJSON(pattern string, fn func() any) {
+	s.mux.Handle(pattern, JSON(fn))
+}
+
+// JSON returns a handler answering GET/HEAD requests with fn's value encoded as indented JSON.
+func JSON(fn func() any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(fn())
+	})
+}
+
+// Start binds the listener and serves in the background, returning the bound address.
+func (s *Server) Start() (net.Addr, error) {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	s.Serve(ln)
+	return ln.Addr(), nil
+}
+
+// Serve serves on an existing listener in the background, e.g. one inherited across an upgrade. It may be
+// called again with another listener; closing one of them stops serving on it alone.
+func (s *Server) Serve(ln net.Listener) {
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			s.logger.Errorf("admin server error: %v", err)
+		}
+	}()
+}
+
+// Shutdown stops the server, waiting for in-flight requests until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
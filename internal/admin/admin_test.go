@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestServerJSONEndpoint(t *testing.T) {
+	s := New("127.0.0.1:0")
+	s.HandleJSON("/status", func() any { return map[string]int{"tunnels": 2} })
+	addr, err := s.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr.String() + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var body map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body["tunnels"] != 2 {
+		t.Fatalf("unexpected body %v (err=%v)", body, err)
+	}
+
+	post, err := http.Post("http://"+addr.String()+"/status", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST /status: %v", err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for POST, got %d", post.StatusCode)
+	}
+}
@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+// LogLevel returns a handler for the process log levels. GET answers with the spec in effect, e.g.
+// "info,sni=debug"; PUT or POST replaces it with the spec in the level query parameter or the request body.
+// A change lasts until the next one, including across configuration reloads that leave LOG_LEVEL alone.
+func LogLevel() http.Handler {
+	logger := logging.New("admin")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut, http.MethodPost:
+			spec := r.URL.Query().Get("level")
+			if spec == "" {
+				body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				spec = strings.TrimSpace(string(body))
+			}
+			if spec == "" {
+				http.Error(w, "missing level", http.StatusBadRequest)
+				return
+			}
+			if err := logging.ParseLevels(spec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Logged before the change so that raising the level does not hide it.
+			logger.Infof("Changing log levels from %s to %s via admin endpoint", logging.Levels(), spec)
+			_ = logging.SetLevels(spec)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, logging.Levels())
+	})
+}
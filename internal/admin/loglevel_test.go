@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+func TestLogLevelEndpoint(t *testing.T) {
+	t.Cleanup(func() { _ = logging.SetLevels("info") })
+	srv := httptest.NewServer(LogLevel())
+	defer srv.Close()
+
+	do := func(method, url, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	if code, body := do(http.MethodGet, srv.URL, ""); code != http.StatusOK || body != "info" {
+		t.Fatalf("GET: got %d %q", code, body)
+	}
+	if code, body := do(http.MethodPut, srv.URL, "warn, sni=DEBUG"); code != http.StatusOK || body != "warn,sni=debug" {
+		t.Fatalf("PUT body: got %d %q", code, body)
+	}
+	if code, body := do(http.MethodPost, srv.URL+"?level=error,connection=info", ""); code != http.StatusOK || body != "error,connection=info" {
+		t.Fatalf("POST query: got %d %q", code, body)
+	}
+	if code, _ := do(http.MethodPut, srv.URL, "verbose"); code != http.StatusBadRequest {
+		t.Fatalf("invalid level: got %d, want 400", code)
+	}
+	if got := logging.Levels(); got != "error,connection=info" {
+		t.Fatalf("invalid level changed the spec to %q", got)
+	}
+	if code, _ := do(http.MethodDelete, srv.URL, ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE: got %d, want 405", code)
+	}
+}
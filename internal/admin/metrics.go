@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+)
+
+// Metric is a single unlabeled sample rendered in the Prometheus text exposition format.
+type Metric struct {
+	Name  string
+	Help  string
+	Type  string // gauge | counter
+	Value float64
+}
+
+// Prometheus returns a handler that renders the metrics returned by fn for scraping.
+func Prometheus(fn func() []Metric) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range fn() {
+			if m.Help != "" {
+				bw.WriteString("# HELP " + m.Name + " " + m.Help + "\n")
+			}
+			if m.Type != "" {
+				bw.WriteString("# TYPE " + m.Name + " " + m.Type + "\n")
+			}
+			bw.WriteString(m.Name + " " + strconv.FormatFloat(m.Value, 'g', -1, 64) + "\n")
+		}
+		_ = bw.Flush()
+	})
+}
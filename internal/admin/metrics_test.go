@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	h := Prometheus(func() []Metric {
+		return []Metric{
+			{Name: "ports_in_use", Help: "Ports in use.", Type: "gauge", Value: 3},
+			{Name: "ports_utilization", Type: "gauge", Value: 0.25},
+		}
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := "# HELP ports_in_use Ports in use.\n# TYPE ports_in_use gauge\nports_in_use 3\n" +
+		"# TYPE ports_utilization gauge\nports_utilization 0.25\n"
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s", got)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+}
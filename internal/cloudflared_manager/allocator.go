@@ -0,0 +1,204 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// tunnelAddrs are the loopback endpoints of one cloudflared child: the TCP listener clients are proxied to and
+// the --metrics listener used for readiness and liveness.
+type tunnelAddrs struct {
+	listen  netip.AddrPort
+	metrics netip.AddrPort
+}
+
+func (a tunnelAddrs) valid() bool { return a.listen.IsValid() }
+
+// addrAllocator hands out tunnelAddrs. Implementations are safe for concurrent use.
+type addrAllocator interface {
+	reserve() (tunnelAddrs, error)
+	release(tunnelAddrs)
+	// releaseConflicted releases addresses cloudflared failed to bind, so they are counted and quarantined.
+	releaseConflicted(tunnelAddrs)
+	// claim reserves specific addresses, as used by a cloudflared adopted from a previous run. It reports false
+	// if they do not belong to this allocator or are already handed out.
+	claim(tunnelAddrs) bool
+	stats() PortStats
+}
+
+var loopbackV4 = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+
+// portAllocator gives each tunnel two ports on 127.0.0.1 from a port range.
+type portAllocator struct {
+	pool *portPool
+}
+
+func newPortAllocator(start, end int) *portAllocator {
+	return &portAllocator{pool: newPortPool(start, end)}
+}
+
+func (a *portAllocator) reserve() (tunnelAddrs, error) {
+	listen, err := a.pool.reserve()
+	if err != nil {
+		return tunnelAddrs{}, err
+	}
+	metrics, err := a.pool.reserve()
+	if err != nil {
+		a.pool.release(listen)
+		return tunnelAddrs{}, err
+	}
+	return tunnelAddrs{
+		listen:  netip.AddrPortFrom(loopbackV4, uint16(listen)),
+		metrics: netip.AddrPortFrom(loopbackV4, uint16(metrics)),
+	}, nil
+}
+
+func (a *portAllocator) release(t tunnelAddrs) {
+	if !t.valid() {
+		return
+	}
+	a.pool.release(int(t.listen.Port()))
+	a.pool.release(int(t.metrics.Port()))
+}
+
+func (a *portAllocator) releaseConflicted(t tunnelAddrs) {
+	if !t.valid() {
+		return
+	}
+	a.pool.releaseConflicted(int(t.listen.Port()))
+	a.pool.releaseConflicted(int(t.metrics.Port()))
+}
+
+func (a *portAllocator) claim(t tunnelAddrs) bool {
+	if t.listen.Addr() != loopbackV4 || t.metrics.Addr() != loopbackV4 || t.listen.Port() == t.metrics.Port() {
+		return false
+	}
+	if !a.pool.claim(int(t.listen.Port())) {
+		return false
+	}
+	if !a.pool.claim(int(t.metrics.Port())) {
+		a.pool.release(int(t.listen.Port()))
+		return false
+	}
+	return true
+}
+
+func (a *portAllocator) stats() PortStats {
+	s := a.pool.stats()
+	s.Mode = "ports"
+	s.Range = fmt.Sprintf("%d-%d", a.pool.start, a.pool.end)
+	return s
+}
+
+// loopbackAllocator gives each tunnel its own address from a loopback CIDR, with fixed listener and metrics
+// ports. Linux routes all of 127.0.0.0/8 to lo, so no interface configuration is needed there.
+type loopbackAllocator struct {
+	prefix      netip.Prefix
+	base        uint32
+	port        uint16
+	metricsPort uint16
+	pool        *portPool // slots are host offsets within prefix
+}
+
+func newLoopbackAllocator(cidr string, port int) (*loopbackAllocator, error) {
+	prefix, err := parseLoopbackCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if port <= 0 || port >= 65535 {
+		return nil, fmt.Errorf("loopback port must be 1-65534, got %d", port)
+	}
+	b := prefix.Addr().As4()
+	a := &loopbackAllocator{
+		prefix:      prefix,
+		base:        uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]),
+		port:        uint16(port),
+		metricsPort: uint16(port + 1),
+	}
+	// Skip the network and broadcast addresses unless the prefix is too small to have them.
+	first, last := 0, 1<<(32-prefix.Bits())-1
+	if prefix.Bits() <= 30 {
+		first, last = first+1, last-1
+	}
+	a.pool = newPortPool(first, last)
+	a.pool.probe = func(slot int) bool {
+		addr := a.addr(slot)
+		return isAddrAvailable(netip.AddrPortFrom(addr, a.port)) && isAddrAvailable(netip.AddrPortFrom(addr, a.metricsPort))
+	}
+	return a, nil
+}
+
+// parseLoopbackCIDR accepts IPv4 prefixes inside 127.0.0.0/8.
+func parseLoopbackCIDR(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid loopback CIDR %q: %w", cidr, err)
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || !prefix.Addr().IsLoopback() || prefix.Bits() < 8 {
+		return netip.Prefix{}, fmt.Errorf("loopback CIDR %q must be an IPv4 prefix within 127.0.0.0/8", cidr)
+	}
+	return prefix, nil
+}
+
+func (a *loopbackAllocator) addr(slot int) netip.Addr {
+	v := a.base + uint32(slot)
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (a *loopbackAllocator) slot(addr netip.Addr) (int, bool) {
+	if !a.prefix.Contains(addr) {
+		return 0, false
+	}
+	b := addr.As4()
+	return int(uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]) - a.base), true
+}
+
+func (a *loopbackAllocator) reserve() (tunnelAddrs, error) {
+	slot, err := a.pool.reserve()
+	if err != nil {
+		return tunnelAddrs{}, fmt.Errorf("no free loopback addresses in %s", a.prefix)
+	}
+	addr := a.addr(slot)
+	return tunnelAddrs{
+		listen:  netip.AddrPortFrom(addr, a.port),
+		metrics: netip.AddrPortFrom(addr, a.metricsPort),
+	}, nil
+}
+
+func (a *loopbackAllocator) release(t tunnelAddrs) {
+	if slot, ok := a.slot(t.listen.Addr()); ok {
+		a.pool.release(slot)
+	}
+}
+
+func (a *loopbackAllocator) releaseConflicted(t tunnelAddrs) {
+	if slot, ok := a.slot(t.listen.Addr()); ok {
+		a.pool.releaseConflicted(slot)
+	}
+}
+
+func (a *loopbackAllocator) claim(t tunnelAddrs) bool {
+	if t.listen.Port() != a.port || t.metrics != netip.AddrPortFrom(t.listen.Addr(), a.metricsPort) {
+		return false
+	}
+	slot, ok := a.slot(t.listen.Addr())
+	return ok && a.pool.claim(slot)
+}
+
+func (a *loopbackAllocator) stats() PortStats {
+	s := a.pool.stats()
+	s.Mode = "loopback"
+	s.Range = fmt.Sprintf("%s:%d", a.prefix, a.port)
+	return s
+}
+
+func isAddrAvailable(ap netip.AddrPort) bool {
+	ln, err := net.Listen("tcp", ap.String())
+	if err != nil {
+		return false
+	}
+	_ = ln.Close()
+	return true
+}
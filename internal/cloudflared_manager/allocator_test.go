@@ -0,0 +1,116 @@
+package cloudflaredmanager
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLoopbackAllocator(t *testing.T) {
+	a, err := newLoopbackAllocator("127.64.0.0/30", 5432)
+	if err != nil {
+		t.Fatalf("newLoopbackAllocator: %v", err)
+	}
+	a.pool.probe = func(int) bool { return true }
+
+	first, err := a.reserve()
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if first.listen != netip.MustParseAddrPort("127.64.0.1:5432") || first.metrics != netip.MustParseAddrPort("127.64.0.1:5433") {
+		t.Fatalf("unexpected first allocation %+v", first)
+	}
+	second, _ := a.reserve()
+	if second.listen.Addr() != netip.MustParseAddr("127.64.0.2") {
+		t.Fatalf("unexpected second allocation %+v", second)
+	}
+	// Network and broadcast addresses of a /30 are never handed out.
+	if _, err := a.reserve(); err == nil {
+		t.Fatalf("expected exhaustion of 127.64.0.0/30 after two hosts")
+	}
+
+	a.release(first)
+	again, err := a.reserve()
+	if err != nil || again != first {
+		t.Fatalf("expected to reuse %v, got %v (%v)", first.listen, again.listen, err)
+	}
+
+	st := a.stats()
+	if st.Mode != "loopback" || st.Range != "127.64.0.0/30:5432" || st.Size != 2 || st.InUse != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestLoopbackAllocatorLargePrefixIsLazy(t *testing.T) {
+	a, err := newLoopbackAllocator("127.0.0.0/8", 20000)
+	if err != nil {
+		t.Fatalf("newLoopbackAllocator: %v", err)
+	}
+	a.pool.probe = func(int) bool { return true }
+	got, err := a.reserve()
+	if err != nil || got.listen.Addr() != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("unexpected allocation %v (%v)", got.listen, err)
+	}
+	if st := a.stats(); st.Size != 1<<24-2 || st.Free != 1<<24-3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestLoopbackAllocatorRejectsInvalidCIDR(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/8", "::1/128", "127.0.0.0/7", "nope"} {
+		if _, err := newLoopbackAllocator(cidr, 20000); err == nil {
+			t.Fatalf("expected %q to be rejected", cidr)
+		}
+	}
+	if _, err := newLoopbackAllocator("127.1.0.0/16", 65535); err == nil {
+		t.Fatalf("expected port 65535 to be rejected (metrics needs port+1)")
+	}
+}
+
+func TestPortAllocatorUsesLoopbackPairs(t *testing.T) {
+	a := newPortAllocator(100, 103)
+	a.pool.probe = func(int) bool { return true }
+	got, err := a.reserve()
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if got.listen != netip.MustParseAddrPort("127.0.0.1:100") || got.metrics != netip.MustParseAddrPort("127.0.0.1:101") {
+		t.Fatalf("unexpected allocation %+v", got)
+	}
+	a.releaseConflicted(got)
+	if st := a.stats(); st.Mode != "ports" || st.InUse != 0 || st.BindConflicts != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestAllocatorsClaimAdoptedAddresses(t *testing.T) {
+	lb, err := newLoopbackAllocator("127.64.0.0/29", 5432)
+	if err != nil {
+		t.Fatalf("newLoopbackAllocator: %v", err)
+	}
+	lb.pool.probe = func(int) bool { return true }
+	adopted := tunnelAddrs{listen: netip.MustParseAddrPort("127.64.0.3:5432"), metrics: netip.MustParseAddrPort("127.64.0.3:5433")}
+	if !lb.claim(adopted) || lb.claim(adopted) {
+		t.Fatalf("expected exactly one successful claim of %v", adopted.listen)
+	}
+	for _, bad := range []tunnelAddrs{
+		{listen: netip.MustParseAddrPort("127.65.0.3:5432"), metrics: netip.MustParseAddrPort("127.65.0.3:5433")},
+		{listen: netip.MustParseAddrPort("127.64.0.4:6000"), metrics: netip.MustParseAddrPort("127.64.0.4:6001")},
+	} {
+		if lb.claim(bad) {
+			t.Fatalf("claim of foreign addresses %v should fail", bad.listen)
+		}
+	}
+
+	pa := newPortAllocator(46000, 46010)
+	pa.pool.probe = func(int) bool { return true }
+	if !pa.claim(tunnelAddrs{listen: netip.MustParseAddrPort("127.0.0.1:46004"), metrics: netip.MustParseAddrPort("127.0.0.1:46005")}) {
+		t.Fatalf("expected claim within the port range to succeed")
+	}
+	// A half-fitting pair must not leave the listener port claimed.
+	if pa.claim(tunnelAddrs{listen: netip.MustParseAddrPort("127.0.0.1:46006"), metrics: netip.MustParseAddrPort("127.0.0.1:47000")}) {
+		t.Fatalf("claim with metrics port outside the range should fail")
+	}
+	if st := pa.stats(); st.InUse != 2 {
+		t.Fatalf("expected two claimed ports, got %+v", st)
+	}
+}
@@ -0,0 +1,82 @@
+package cloudflaredmanager
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen is returned by GetOrStart while a hostname's circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+)
+
+// circuitBreaker tracks consecutive tunnel start failures for one hostname. It is guarded by NodeManager.mu.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a new start attempt may be launched. It is only consulted when no launch is in flight,
+// so after the cooldown an open breaker moves to half-open and admits one probe; callers arriving while the probe
+// runs wait on it rather than launching their own.
+func (b *circuitBreaker) allow(now time.Time, cooldown time.Duration) (ok bool, retryIn time.Duration) {
+	if b.state != breakerOpen {
+		return true, 0
+	}
+	if wait := b.openedAt.Add(cooldown).Sub(now); wait > 0 {
+		return false, wait
+	}
+	b.state = breakerHalfOpen
+	return true, 0
+}
+
+// onSuccess closes the breaker and reports whether it was previously tripped.
+func (b *circuitBreaker) onSuccess() bool {
+	tripped := b.current() != breakerClosed
+	b.state = breakerClosed
+	b.failures = 0
+	return tripped
+}
+
+// onFailure records a failed start and reports whether the breaker (re)opened.
+func (b *circuitBreaker) onFailure(now time.Time, threshold int) bool {
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state != breakerOpen && b.failures >= threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+		return true
+	}
+	return false
+}
+
+// trip opens the breaker regardless of the failure count and reports whether it was closed or half-open before.
+func (b *circuitBreaker) trip(now time.Time) bool {
+	if b.state == breakerOpen {
+		return false
+	}
+	b.state = breakerOpen
+	b.openedAt = now
+	return true
+}
+
+func (b *circuitBreaker) current() breakerState {
+	if b.state == "" {
+		return breakerClosed
+	}
+	return b.state
+}
+
+// recordStartFailure feeds a failed launch into the hostname's breaker. Callers hold m.mu.
+func (m *NodeManager) recordStartFailure(st *nodeState) {
+	if st.breaker.onFailure(m.now(), m.breakerFailures) {
+		m.logger.Errorf("Circuit breaker for %s opened after %d consecutive start failures; failing fast for %s",
+			st.hostname, st.breaker.failures, m.breakerCooldown)
+	}
+}
@@ -0,0 +1,88 @@
+package cloudflaredmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var b circuitBreaker
+	now := time.Unix(1000, 0)
+	cooldown := 30 * time.Second
+
+	if b.onFailure(now, 3) || b.onFailure(now, 3) {
+		t.Fatalf("breaker opened before threshold")
+	}
+	if ok, _ := b.allow(now, cooldown); !ok {
+		t.Fatalf("closed breaker should allow starts")
+	}
+	if !b.onFailure(now, 3) || b.current() != breakerOpen {
+		t.Fatalf("breaker should open at threshold, state=%s", b.current())
+	}
+	if ok, retryIn := b.allow(now.Add(10*time.Second), cooldown); ok || retryIn != 20*time.Second {
+		t.Fatalf("open breaker should fail fast, ok=%v retryIn=%s", ok, retryIn)
+	}
+	if ok, _ := b.allow(now.Add(cooldown), cooldown); !ok || b.current() != breakerHalfOpen {
+		t.Fatalf("breaker should admit a probe after cooldown, ok=%v state=%s", ok, b.current())
+	}
+
+	// A failed probe re-opens immediately, regardless of the threshold.
+	later := now.Add(time.Minute)
+	if !b.onFailure(later, 100) || b.current() != breakerOpen {
+		t.Fatalf("failed probe should re-open the breaker, state=%s", b.current())
+	}
+	if ok, _ := b.allow(later.Add(cooldown-time.Second), cooldown); ok {
+		t.Fatalf("cooldown should restart after a failed probe")
+	}
+
+	b.allow(later.Add(cooldown), cooldown)
+	if !b.onSuccess() || b.current() != breakerClosed || b.failures != 0 {
+		t.Fatalf("successful probe should close and reset, state=%s failures=%d", b.current(), b.failures)
+	}
+	if b.onSuccess() {
+		t.Fatalf("onSuccess on a closed breaker should not report recovery")
+	}
+}
+
+func TestGetOrStartFailsFastWhenBreakerOpen(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // cloudflared cannot be found, so every start fails
+	m, err := NewNodeManager(Config{
+		IdleTimeout:     time.Minute,
+		StartupTimeout:  time.Second,
+		PortRangeStart:  42000,
+		PortRangeEnd:    42100,
+		BreakerFailures: 2,
+		BreakerCooldown: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("attempt %d: expected start failure, got %v", i, err)
+		}
+	}
+	if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	status := m.Status()
+	if len(status) != 1 || status[0].Breaker != "open" || status[0].ConsecutiveFailures != 2 || status[0].BreakerRetryAt == nil {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if status[0].ActiveConnections != 0 {
+		t.Fatalf("rejected callers must not hold a reference, got %d", status[0].ActiveConnections)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected half-open probe to attempt a start, got %v", err)
+	}
+	if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected breaker to re-open after failed probe, got %v", err)
+	}
+}
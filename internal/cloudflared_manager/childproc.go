@@ -0,0 +1,120 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ChildPolicy controls how cloudflared children are executed. The zero value runs them like any other
+// subprocess: same credentials, limits and full environment.
+type ChildPolicy struct {
+	// Pdeathsig kills a child when the proxy dies, even by SIGKILL (Linux only).
+	Pdeathsig bool
+	// Setpgid runs each child in its own process group; stopping a tunnel then kills the whole group.
+	Setpgid bool
+	// User and Group, when set, are the (name or numeric) credentials children run as. Group defaults to the
+	// user's primary group. Changing credentials requires the proxy to run as root or with CAP_SETUID/CAP_SETGID.
+	User  string
+	Group string
+	// RLimitNoFile and RLimitAS cap open file descriptors and address space (bytes); 0 keeps the inherited limit.
+	RLimitNoFile uint64
+	RLimitAS     uint64
+	// EnvAllowlist names the environment variables children inherit; a trailing "*" matches a prefix. nil, or
+	// an entry of "*", inherits the whole environment.
+	EnvAllowlist []string
+}
+
+// childSpec is a ChildPolicy with credentials resolved.
+type childSpec struct {
+	policy   ChildPolicy
+	setCreds bool
+	uid      uint32
+	gid      uint32
+}
+
+func newChildSpec(p ChildPolicy) (*childSpec, error) {
+	c := &childSpec{policy: p}
+	if p.User == "" && p.Group != "" {
+		return nil, fmt.Errorf("child group %q requires a child user", p.Group)
+	}
+	if p.User != "" {
+		u, err := lookupUser(p.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("child user %q: non-numeric uid %q", p.User, u.Uid)
+		}
+		gidStr := u.Gid
+		if p.Group != "" {
+			g, err := lookupGroup(p.Group)
+			if err != nil {
+				return nil, err
+			}
+			gidStr = g.Gid
+		}
+		gid, err := strconv.ParseUint(gidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("child group for %q: non-numeric gid %q", p.User, gidStr)
+		}
+		c.setCreds, c.uid, c.gid = true, uint32(uid), uint32(gid)
+	}
+	if err := c.checkPlatform(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// Numeric ids need not exist in the user database.
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("child user: %w", err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("child group: %w", err)
+	}
+	return g, nil
+}
+
+// prepare applies the environment and process attributes to cmd before it is started.
+func (c *childSpec) prepare(cmd *exec.Cmd) {
+	if c.policy.EnvAllowlist != nil {
+		cmd.Env = filterEnv(os.Environ(), c.policy.EnvAllowlist)
+	}
+	c.setSysProcAttr(cmd)
+}
+
+// filterEnv keeps the KEY=value entries of env whose key is allowed.
+func filterEnv(env, allow []string) []string {
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		for _, a := range allow {
+			if a == "*" || a == key || (strings.HasSuffix(a, "*") && strings.HasPrefix(key, strings.TrimSuffix(a, "*"))) {
+				out = append(out, kv)
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+func (c *childSpec) checkPlatform() error { return nil }
+
+// ownGroup reports whether children are started in a process group of their own, whose ID is their PID.
+func (c *childSpec) ownGroup() bool { return c.policy.Setpgid }
+
+func (c *childSpec) setSysProcAttr(cmd *exec.Cmd) {
+	attr := &syscall.SysProcAttr{Setpgid: c.policy.Setpgid}
+	if c.policy.Pdeathsig {
+		attr.Pdeathsig = syscall.SIGKILL
+	}
+	if c.setCreds {
+		attr.Credential = &syscall.Credential{Uid: c.uid, Gid: c.gid, Groups: []uint32{}}
+	}
+	cmd.SysProcAttr = attr
+	if c.policy.Setpgid && cmd.Cancel != nil {
+		// Take cloudflared's own children (if any) down with it when the command's context is cancelled.
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// afterStart applies resource limits to the started child. Linux has no pre-exec hook for rlimits in
+// SysProcAttr, so they are set with prlimit(2) right after fork; descriptors and memory are only checked on
+// allocation, so the short window is harmless.
+func (c *childSpec) afterStart(pid int) error {
+	if c.policy.RLimitNoFile > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, c.policy.RLimitNoFile); err != nil {
+			return fmt.Errorf("set RLIMIT_NOFILE: %w", err)
+		}
+	}
+	if c.policy.RLimitAS > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, c.policy.RLimitAS); err != nil {
+			return fmt.Errorf("set RLIMIT_AS: %w", err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, limit uint64) error {
+	rl := syscall.Rlimit{Cur: limit, Max: limit}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rl)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
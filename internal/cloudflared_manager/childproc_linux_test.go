@@ -0,0 +1,194 @@
+//go:build linux
+
+package cloudflaredmanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startHardened runs `sleep 60` under policy and returns it; the process is killed when the test ends.
+func startHardened(t *testing.T, policy ChildPolicy) *exec.Cmd {
+	t.Helper()
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	c, err := newChildSpec(policy)
+	if err != nil {
+		t.Fatalf("newChildSpec: %v", err)
+	}
+	cmd := exec.Command("sleep", "60")
+	c.prepare(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	if err := c.afterStart(cmd.Process.Pid); err != nil {
+		t.Fatalf("afterStart: %v", err)
+	}
+	return cmd
+}
+
+func procFile(t *testing.T, pid int, name string) string {
+	t.Helper()
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/" + name)
+	if err != nil {
+		t.Fatalf("read /proc/%d/%s: %v", pid, name, err)
+	}
+	return string(b)
+}
+
+// procLimit returns the soft limit column of the named /proc/PID/limits row.
+func procLimit(t *testing.T, pid int, row string) string {
+	t.Helper()
+	for _, line := range strings.Split(procFile(t, pid, "limits"), "\n") {
+		if strings.HasPrefix(line, row) {
+			return strings.Fields(strings.TrimPrefix(line, row))[0]
+		}
+	}
+	t.Fatalf("no %q row in /proc/%d/limits", row, pid)
+	return ""
+}
+
+func TestChildPolicyRlimitsAndProcessGroup(t *testing.T) {
+	cmd := startHardened(t, ChildPolicy{Setpgid: true, RLimitNoFile: 123, RLimitAS: 8 << 30})
+	pid := cmd.Process.Pid
+
+	if got := procLimit(t, pid, "Max open files"); got != "123" {
+		t.Fatalf("Max open files = %s, want 123", got)
+	}
+	if got := procLimit(t, pid, "Max address space"); got != strconv.FormatUint(8<<30, 10) {
+		t.Fatalf("Max address space = %s", got)
+	}
+	if pgid, err := syscall.Getpgid(pid); err != nil || pgid != pid {
+		t.Fatalf("child should lead its own process group, pgid=%d err=%v", pgid, err)
+	}
+}
+
+func TestChildPolicyEnvAllowlist(t *testing.T) {
+	t.Setenv("TUNNEL_PROXY_TEST_SECRET", "hunter2")
+	t.Setenv("TUNNEL_LOGLEVEL", "debug")
+	cmd := startHardened(t, ChildPolicy{EnvAllowlist: []string{"PATH", "TUNNEL_LOG*"}})
+
+	var keys []string
+	for _, kv := range bytes.Split([]byte(procFile(t, cmd.Process.Pid, "environ")), []byte{0}) {
+		if len(kv) > 0 {
+			keys = append(keys, strings.SplitN(string(kv), "=", 2)[0])
+		}
+	}
+	if strings.Join(keys, ",") != "PATH,TUNNEL_LOGLEVEL" {
+		t.Fatalf("child environment keys = %v", keys)
+	}
+}
+
+func TestChildPolicyDropsCredentials(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing credentials requires root")
+	}
+	cmd := startHardened(t, ChildPolicy{User: "65534", Group: "65534"})
+
+	var uid, gid, groups string
+	sc := bufio.NewScanner(strings.NewReader(procFile(t, cmd.Process.Pid, "status")))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "Uid:"):
+			uid = strings.Join(strings.Fields(line)[1:], " ")
+		case strings.HasPrefix(line, "Gid:"):
+			gid = strings.Join(strings.Fields(line)[1:], " ")
+		case strings.HasPrefix(line, "Groups:"):
+			groups = strings.TrimSpace(strings.TrimPrefix(line, "Groups:"))
+		}
+	}
+	if uid != "65534 65534 65534 65534" || gid != "65534 65534 65534 65534" || groups != "" {
+		t.Fatalf("child credentials uid=%q gid=%q groups=%q", uid, gid, groups)
+	}
+}
+
+func TestChildPolicyPdeathsigKillsOrphans(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	parent := exec.Command(exe)
+	parent.Env = append(os.Environ(), "CHILDPROC_PARENT=1")
+	out, err := parent.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := parent.Start(); err != nil {
+		t.Fatalf("start parent: %v", err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		_ = parent.Process.Kill()
+		t.Fatalf("read child pid: %v", err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("bad child pid %q", line)
+	}
+	t.Cleanup(func() { _ = syscall.Kill(child, syscall.SIGKILL) })
+
+	_ = parent.Process.Signal(syscall.SIGKILL)
+	_ = parent.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if !processAlive(child) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("child %d outlived its parent", child)
+}
+
+func TestLaunchAppliesChildPolicy(t *testing.T) {
+	fakeReadyCloudflared(t)
+	t.Setenv("TUNNEL_PROXY_TEST_SECRET", "hunter2")
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45000,
+		PortRangeEnd:   45100,
+		Child:          ChildPolicy{Pdeathsig: true, Setpgid: true, RLimitNoFile: 256, EnvAllowlist: []string{"PATH"}},
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	lease, err := m.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	pid := m.Status()[0].Replicas[0].PID
+
+	if env := procFile(t, pid, "environ"); strings.Contains(env, "TUNNEL_PROXY_TEST_SECRET") {
+		t.Fatalf("secret leaked into the cloudflared environment")
+	}
+	if got := procLimit(t, pid, "Max open files"); got != "256" {
+		t.Fatalf("Max open files = %s, want 256", got)
+	}
+	if pgid, err := syscall.Getpgid(pid); err != nil || pgid != pid {
+		t.Fatalf("cloudflared should lead its own process group, pgid=%d err=%v", pgid, err)
+	}
+
+	lease.Release()
+	m.Shutdown(context.Background())
+	if processAlive(pid) {
+		t.Fatalf("cloudflared %d still running after shutdown", pid)
+	}
+}
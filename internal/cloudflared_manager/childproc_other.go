@@ -0,0 +1,24 @@
+//go:build !linux
+
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// checkPlatform rejects options that cannot be honoured here; Pdeathsig and Setpgid are best-effort and
+// silently ignored.
+func (c *childSpec) checkPlatform() error {
+	if c.setCreds || c.policy.RLimitNoFile > 0 || c.policy.RLimitAS > 0 {
+		return fmt.Errorf("child credentials and rlimits are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+func (c *childSpec) ownGroup() bool { return false }
+
+func (c *childSpec) setSysProcAttr(cmd *exec.Cmd) {}
+
+func (c *childSpec) afterStart(pid int) error { return nil }
@@ -0,0 +1,60 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "HOME=/root", "TUNNEL_LOGLEVEL=debug", "TUNNEL=x", "AWS_SECRET_ACCESS_KEY=s", "EMPTY="}
+	got := filterEnv(env, []string{"PATH", "TUNNEL_*", "EMPTY"})
+	want := []string{"PATH=/bin", "TUNNEL_LOGLEVEL=debug", "EMPTY="}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("filterEnv = %q, want %q", got, want)
+	}
+	if got := filterEnv(env, []string{"*"}); !reflect.DeepEqual(got, env) {
+		t.Fatalf("wildcard should keep everything, got %q", got)
+	}
+	if got := filterEnv(env, []string{}); len(got) != 0 {
+		t.Fatalf("empty allowlist should drop everything, got %q", got)
+	}
+}
+
+func TestNewChildSpecValidation(t *testing.T) {
+	if _, err := newChildSpec(ChildPolicy{Group: "nogroup"}); err == nil {
+		t.Fatalf("expected error for group without user")
+	}
+	if _, err := newChildSpec(ChildPolicy{User: "no-such-user-tcp-tunnel-proxy"}); err == nil {
+		t.Fatalf("expected error for unknown user")
+	}
+	c, err := newChildSpec(ChildPolicy{})
+	if err != nil {
+		t.Fatalf("zero policy: %v", err)
+	}
+	cmd := exec.Command("true")
+	c.prepare(cmd)
+	if cmd.Env != nil {
+		t.Fatalf("zero policy should inherit the environment, got %q", cmd.Env)
+	}
+}
+
+// runChildprocParent stands in for the proxy in the Pdeathsig test: it starts a hardened sleep, prints its pid
+// and blocks until killed.
+func runChildprocParent() {
+	c, err := newChildSpec(ChildPolicy{Pdeathsig: true, Setpgid: true})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cmd := exec.Command("sleep", "60")
+	c.prepare(cmd)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(cmd.Process.Pid)
+	select {}
+}
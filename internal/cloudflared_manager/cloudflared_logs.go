@@ -0,0 +1,137 @@
+package cloudflaredmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+// failureCause classifies well-known cloudflared failure messages.
+type failureCause string
+
+const (
+	causeNone            failureCause = ""
+	causeAuthDenied      failureCause = "auth_denied"
+	causeUnknownHost     failureCause = "unknown_host"
+	causeAddressInUse    failureCause = "address_in_use"
+	causeEdgeUnreachable failureCause = "edge_unreachable"
+)
+
+// failureSignatures maps lower-cased message fragments to causes; the first match wins.
+var failureSignatures = []struct {
+	fragment string
+	cause    failureCause
+}{
+	{"address already in use", causeAddressInUse},
+	{"failed to fetch access token", causeAuthDenied},
+	{"access denied", causeAuthDenied},
+	{"unauthorized", causeAuthDenied},
+	{"forbidden", causeAuthDenied},
+	{"status code 403", causeAuthDenied},
+	{"websocket: bad handshake", causeAuthDenied},
+	{"no such host", causeUnknownHost},
+	{"server misbehaving", causeUnknownHost},
+	{"failed to dial to edge", causeEdgeUnreachable},
+	{"network is unreachable", causeEdgeUnreachable},
+	{"no route to host", causeEdgeUnreachable},
+	{"connection refused", causeEdgeUnreachable},
+	{"i/o timeout", causeEdgeUnreachable},
+}
+
+// cloudflaredLine is one decoded line of cloudflared --output json (zerolog) output.
+type cloudflaredLine struct {
+	level  string
+	msg    string
+	fields []logging.Field
+}
+
+// parseCloudflaredLine decodes a zerolog JSON line. Lines that are not JSON (e.g. panics, or builds without
+// --output json) are passed through as the message with level "info".
+func parseCloudflaredLine(line string) cloudflaredLine {
+	var raw map[string]any
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") || json.Unmarshal([]byte(line), &raw) != nil {
+		return cloudflaredLine{level: "info", msg: line}
+	}
+	out := cloudflaredLine{level: "info"}
+	if v, ok := raw["level"].(string); ok && v != "" {
+		out.level = strings.ToLower(v)
+	}
+	for _, key := range []string{"message", "msg"} {
+		if v, ok := raw[key].(string); ok {
+			out.msg = v
+			break
+		}
+	}
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		switch k {
+		case "level", "message", "msg", "time":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.fields = append(out.fields, logging.Field{Key: k, Value: raw[k]})
+	}
+	return out
+}
+
+// classifyFailure returns the failure cause for a message and its fields (cloudflared puts the underlying
+// error in an "error" field).
+func classifyFailure(l cloudflaredLine) failureCause {
+	text := strings.ToLower(l.msg)
+	for _, f := range l.fields {
+		if f.Key == "error" || f.Key == "err" {
+			if s, ok := f.Value.(string); ok {
+				text += " " + strings.ToLower(s)
+			}
+		}
+	}
+	for _, sig := range failureSignatures {
+		if strings.Contains(text, sig.fragment) {
+			return sig.cause
+		}
+	}
+	return causeNone
+}
+
+// streamPipe re-emits cloudflared output through the output logger at the matching level, tagged with the
+// tunnel hostname and replica, and records recognized failures on the replica.
+func (m *NodeManager) streamPipe(rep *replica, r io.ReadCloser, stream string) {
+	defer r.Close()
+	base := []logging.Field{{Key: "tunnel", Value: rep.node.hostname}, {Key: "replica", Value: rep.index}, {Key: "stream", Value: stream}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := parseCloudflaredLine(scanner.Text())
+		fields := append(append([]logging.Field{}, base...), line.fields...)
+		msg := "[cloudflared] " + line.msg
+
+		switch line.level {
+		case "debug", "trace":
+			m.outputLogger.Debug(msg, fields...)
+		case "warn", "warning":
+			m.outputLogger.Warn(msg, fields...)
+		case "error", "fatal", "panic":
+			m.outputLogger.Error(msg, append(fields, logging.Field{Key: "cloudflared_level", Value: line.level})...)
+		default:
+			m.outputLogger.Info(msg, fields...)
+		}
+
+		if cause := classifyFailure(line); cause != causeNone {
+			m.mu.Lock()
+			rep.lastErrCause = cause
+			rep.lastErrMsg = line.msg
+			rep.lastErrAt = time.Now()
+			m.mu.Unlock()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		m.outputLogger.Error("cloudflared output stream error", append(base, logging.Field{Key: "error", Value: err.Error()})...)
+	}
+}
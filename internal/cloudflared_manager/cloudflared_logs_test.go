@@ -0,0 +1,80 @@
+package cloudflaredmanager
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+func TestParseCloudflaredLineJSON(t *testing.T) {
+	line := parseCloudflaredLine(`{"level":"error","time":"2026-01-01T00:00:00Z","error":"dial tcp: lookup cft-x.ratio1.link: no such host","message":"failed to connect to origin"}`)
+	if line.level != "error" || line.msg != "failed to connect to origin" {
+		t.Fatalf("unexpected parse: %+v", line)
+	}
+	if len(line.fields) != 1 || line.fields[0].Key != "error" {
+		t.Fatalf("expected only the error field to be kept, got %+v", line.fields)
+	}
+	if got := classifyFailure(line); got != causeUnknownHost {
+		t.Fatalf("classifyFailure = %q, want %q", got, causeUnknownHost)
+	}
+}
+
+func TestParseCloudflaredLinePlainText(t *testing.T) {
+	line := parseCloudflaredLine("2026-01-01T00:00:00Z ERR listen tcp 127.0.0.1:20000: bind: address already in use")
+	if line.level != "info" || !strings.Contains(line.msg, "address already in use") {
+		t.Fatalf("unexpected parse: %+v", line)
+	}
+	if got := classifyFailure(line); got != causeAddressInUse {
+		t.Fatalf("classifyFailure = %q, want %q", got, causeAddressInUse)
+	}
+}
+
+func TestClassifyFailureSignatures(t *testing.T) {
+	cases := map[string]failureCause{
+		`{"level":"error","message":"failed to fetch access token"}`:                         causeAuthDenied,
+		`{"level":"error","message":"failed to connect","error":"websocket: bad handshake"}`: causeAuthDenied,
+		`{"level":"error","message":"failed to dial to edge with quic"}`:                     causeEdgeUnreachable,
+		`{"level":"info","message":"Start Websocket listener"}`:                              causeNone,
+	}
+	for in, want := range cases {
+		if got := classifyFailure(parseCloudflaredLine(in)); got != want {
+			t.Fatalf("classifyFailure(%s) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStreamPipeRecordsLastFailure(t *testing.T) {
+	m, err := NewNodeManager(Config{IdleTimeout: time.Minute, StartupTimeout: time.Second, PortRangeStart: 1, PortRangeEnd: 1})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	rep := &replica{node: &nodeState{hostname: "cft-db.ratio1.link"}}
+	out := `{"level":"info","message":"Start Websocket listener","host":"127.0.0.1:20000"}
+{"level":"error","message":"listen failed","error":"bind: address already in use"}
+`
+	m.streamPipe(rep, io.NopCloser(strings.NewReader(out)), "stderr")
+
+	if rep.lastErrCause != causeAddressInUse || rep.lastErrMsg != "listen failed" || rep.lastErrAt.IsZero() {
+		t.Fatalf("failure not recorded: cause=%q msg=%q", rep.lastErrCause, rep.lastErrMsg)
+	}
+}
+
+func TestStreamPipeWritesToOutputLogger(t *testing.T) {
+	var out bytes.Buffer
+	m, err := NewNodeManager(Config{IdleTimeout: time.Minute, StartupTimeout: time.Second, PortRangeStart: 1, PortRangeEnd: 1,
+		OutputLogger: logging.NewWithWriter("node_manager", &out)})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	rep := &replica{node: &nodeState{hostname: "cft-db.ratio1.link"}}
+	m.streamPipe(rep, io.NopCloser(strings.NewReader(`{"level":"warn","message":"retrying connection"}`+"\n")), "stderr")
+
+	if got := out.String(); !strings.Contains(got, "[WARN][node_manager]") || !strings.Contains(got, "tunnel=cft-db.ratio1.link") ||
+		!strings.HasSuffix(got, "[cloudflared] retrying connection\n") {
+		t.Fatalf("cloudflared output not re-logged to the output logger: %q", got)
+	}
+}
@@ -1,82 +1,140 @@
 package cloudflaredmanager
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net"
+	"math/rand/v2"
+	"net/netip"
+	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/tracing"
 )
 
-type portPool struct {
-	mu    sync.Mutex
-	start int
-	end   int
-	used  map[int]bool
-}
-
-func newPortPool(start, end int) *portPool {
-	return &portPool{
-		start: start,
-		end:   end,
-		used:  make(map[int]bool),
-	}
-}
-
-func (p *portPool) reserve() (int, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	for port := p.start; port <= p.end; port++ {
-		if p.used[port] {
-			continue
-		}
-		if !isPortAvailable(port) {
-			continue
-		}
-		p.used[port] = true
-		return port, nil
-	}
-	return 0, fmt.Errorf("no free ports in range %d-%d", p.start, p.end)
-}
-
-func (p *portPool) release(port int) {
-	if port == 0 {
-		return
-	}
-	p.mu.Lock()
-	delete(p.used, port)
-	p.mu.Unlock()
-}
-
 // NodeManager tracks cloudflared tunnels per backend hostname and manages lifecycles.
 type NodeManager struct {
 	mu             sync.Mutex
 	nodes          map[string]*nodeState // keyed by backend hostname
 	idleTimeout    time.Duration
 	startupTimeout time.Duration
-	ports          *portPool
+	addrs          addrAllocator
 	closed         bool
-	restartBackoff time.Duration
-	maxRestarts    int
+	restart        RestartPolicy
+	rand           func() float64 // jitter source, uniform in [0, 1)
 	logger         *logging.Logger
+	outputLogger   *logging.Logger // re-logs cloudflared's stdout and stderr
+
+	livenessInterval time.Duration
+	livenessFailures int
+
+	breakerFailures int
+	breakerCooldown time.Duration
+	now             func() time.Time
+
+	child   *childSpec
+	command *commandSpec
+
+	probing atomic.Bool // a CheckResponsive probe is waiting for mu
+
+	tracer *tracing.Tracer // nil disables tracing
+
+	events eventBus
+
+	stateMu   sync.Mutex // guards stateFile and serializes writes
+	stateFile string
+
+	maxTunnels     int
+	maxTunnelsWait time.Duration
+	capacity       chan struct{} // closed and replaced when a tunnel slot may have freed up
+	waiting        int
+	evictions      uint64
+	rejected       uint64
 }
 
+// nodeState is one backend hostname and the cloudflared replicas serving it.
 type nodeState struct {
 	hostname  string
-	cmd       *exec.Cmd
-	cancel    context.CancelFunc
-	refCount  int
+	replicas  []*replica
+	refCount  int // active leases across all replicas
 	idleTimer *time.Timer
-	ready     chan struct{}
-	startErr  error
-	port      int
-	restarts  int
+	breaker   circuitBreaker
+	changed   chan struct{} // closed and replaced whenever a replica changes state
+	lastUsed  time.Time     // last lease or release, for LRU eviction
+	token     ServiceToken  // from the latest GetOrStart; used by the next launch
+}
+
+type replicaState string
+
+const (
+	replicaStopped  replicaState = "stopped"
+	replicaStarting replicaState = "starting"
+	replicaReady    replicaState = "ready"
+)
+
+// replica is one supervised cloudflared process for a hostname, listening on its own address.
+type replica struct {
+	node     *nodeState
+	index    int
+	state    replicaState
+	gen      int // bumped on every launch and stop so stale launches and exit handlers can tell they lost
+	cmd      *exec.Cmd
+	cancel   context.CancelFunc
+	exited   chan struct{}
+	addrs    tunnelAddrs
+	active   int
+	restarts int           // consecutive restarts since the replica was last ready
+	crashes  crashLog      // recent crashes, for crash-loop detection
+	failed   chan struct{} // closed when the replica is given up; handed to its leases
+	startErr error
+	retryAt  time.Time // earliest relaunch of a failed replica while the hostname is otherwise in use
+
+	// Last recognized failure reported in cloudflared's own log output.
+	lastErrCause failureCause
+	lastErrMsg   string
+	lastErrAt    time.Time
+
+	adopted   bool      // taken over from a previous run rather than launched by us
+	startedAt time.Time // when the running process was started
+	procStart uint64    // kernel start time of the running process, for the state file
+	pgid      int       // process group created for the running process, 0 if it shares ours
+}
+
+// MaxReplicas bounds TunnelOptions.Replicas; larger values are clamped to it.
+const MaxReplicas = 16
+
+// TunnelOptions are per-route settings applied when a hostname's tunnel is started.
+type TunnelOptions struct {
+	// Replicas is the number of cloudflared processes run for the hostname; values below 1 mean 1.
+	Replicas int
+	// ServiceToken authenticates cloudflared to Cloudflare Access; the zero value uses cloudflared's own login.
+	ServiceToken ServiceToken
+}
+
+// Lease is a connection's claim on one tunnel replica. Release must be called when the connection ends.
+type Lease struct {
+	Addr    netip.AddrPort
+	Replica int
+
+	m      *NodeManager
+	r      *replica
+	failed <-chan struct{}
+	once   sync.Once
+}
+
+// Failed is closed when the replica behind the lease crashed and will not be restarted (ErrRestartsExhausted).
+// The tunnel port is dead by then, so connections using the lease should be closed.
+func (l *Lease) Failed() <-chan struct{} {
+	return l.failed
+}
+
+// Release returns the lease; calls after the first are no-ops.
+func (l *Lease) Release() {
+	l.once.Do(func() { l.m.release(l.r) })
 }
 
 // Config holds tunable settings for the node manager.
@@ -85,240 +143,611 @@ type Config struct {
 	StartupTimeout time.Duration
 	PortRangeStart int
 	PortRangeEnd   int
-	RestartBackoff time.Duration
-	MaxRestarts    int
+	// PortQuarantine keeps released ports (or loopback addresses) out of circulation for this long; zero disables
+	// the quarantine.
+	PortQuarantine time.Duration
+	// LoopbackCIDR, when set, switches allocation to one address per tunnel from this prefix inside 127.0.0.0/8,
+	// listening on LoopbackPort (metrics on LoopbackPort+1). The port range is then unused.
+	LoopbackCIDR string
+	LoopbackPort int
+	// Restart controls how crashed tunnels are relaunched; zero fields take DefaultRestartPolicy's values.
+	Restart RestartPolicy
+	// LivenessInterval is how often running tunnels are re-checked via the metrics endpoint.
+	LivenessInterval time.Duration
+	// LivenessFailures is the number of consecutive failed checks before a busy tunnel is restarted.
+	LivenessFailures int
+	// BreakerFailures is the number of consecutive start failures that opens a hostname's circuit breaker.
+	BreakerFailures int
+	// BreakerCooldown is how long an open breaker fails fast before allowing a single probe start.
+	BreakerCooldown time.Duration
+	// MaxTunnels caps concurrently running tunnel hostnames (replicas of one hostname count once); 0 means
+	// unlimited. At the cap the least-recently-used idle tunnel is evicted to make room.
+	MaxTunnels int
+	// MaxTunnelsWait is how long a new hostname waits for a slot when every tunnel is busy; 0 rejects at once.
+	MaxTunnelsWait time.Duration
+	// Child controls the credentials, limits and environment cloudflared children run with.
+	Child ChildPolicy
+	// StateFile, when set, records running children so RecoverOrphans can adopt or kill them after a crash.
+	StateFile string
+	// Binary is the cloudflared executable, looked up in PATH unless it contains a slash; "" means cloudflared.
+	Binary string
+	// ArgsTemplate renders cloudflared's arguments (see commandData for the fields); "" means DefaultArgsTemplate.
+	ArgsTemplate string
+	// ExtraArgs are available to the template as {{.ExtraArgs}}, e.g. --loglevel debug.
+	ExtraArgs []string
+	// Tracer records spans for tunnel starts; nil disables tracing.
+	Tracer *tracing.Tracer
+	// OutputLogger re-logs cloudflared's output, e.g. to a file of its own; nil uses the manager's logger.
+	OutputLogger *logging.Logger
 }
 
 // NewNodeManager constructs a manager using the provided configuration, then applies overrides.
 func NewNodeManager(cfg Config) (*NodeManager, error) {
-	if cfg.PortRangeStart <= 0 || cfg.PortRangeEnd < cfg.PortRangeStart {
-		return nil, fmt.Errorf("invalid port pool range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+	var addrs addrAllocator
+	if cfg.LoopbackCIDR != "" {
+		la, err := newLoopbackAllocator(cfg.LoopbackCIDR, cfg.LoopbackPort)
+		if err != nil {
+			return nil, err
+		}
+		la.pool.quarantineFor = cfg.PortQuarantine
+		addrs = la
+	} else {
+		if cfg.PortRangeStart <= 0 || cfg.PortRangeEnd < cfg.PortRangeStart {
+			return nil, fmt.Errorf("invalid port pool range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+		}
+		pa := newPortAllocator(cfg.PortRangeStart, cfg.PortRangeEnd)
+		pa.pool.quarantineFor = cfg.PortQuarantine
+		addrs = pa
 	}
 	if cfg.IdleTimeout <= 0 || cfg.StartupTimeout <= 0 {
 		return nil, fmt.Errorf("timeouts must be positive")
 	}
-	if cfg.RestartBackoff <= 0 {
-		cfg.RestartBackoff = 2 * time.Second
+	if cfg.LivenessInterval <= 0 {
+		cfg.LivenessInterval = 10 * time.Second
 	}
-	if cfg.MaxRestarts <= 0 {
-		cfg.MaxRestarts = 3
+	if cfg.LivenessFailures <= 0 {
+		cfg.LivenessFailures = 3
+	}
+	if cfg.BreakerFailures <= 0 {
+		cfg.BreakerFailures = 5
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = 30 * time.Second
+	}
+	child, err := newChildSpec(cfg.Child)
+	if err != nil {
+		return nil, err
+	}
+	command, err := newCommandSpec(cfg.Binary, cfg.ArgsTemplate, cfg.ExtraArgs)
+	if err != nil {
+		return nil, err
+	}
+	logger := logging.New("node_manager")
+	outputLogger := cfg.OutputLogger
+	if outputLogger == nil {
+		outputLogger = logger
 	}
-
 	return &NodeManager{
 		nodes:          make(map[string]*nodeState),
 		idleTimeout:    cfg.IdleTimeout,
 		startupTimeout: cfg.StartupTimeout,
-		ports:          newPortPool(cfg.PortRangeStart, cfg.PortRangeEnd),
-		restartBackoff: cfg.RestartBackoff,
-		maxRestarts:    cfg.MaxRestarts,
-		logger:         logging.New("node_manager"),
+		addrs:          addrs,
+		restart:        cfg.Restart.withDefaults(),
+		rand:           rand.Float64,
+		logger:         logger,
+		outputLogger:   outputLogger,
+
+		livenessInterval: cfg.LivenessInterval,
+		livenessFailures: cfg.LivenessFailures,
+
+		breakerFailures: cfg.BreakerFailures,
+		breakerCooldown: cfg.BreakerCooldown,
+		now:             time.Now,
+
+		maxTunnels:     max(cfg.MaxTunnels, 0),
+		maxTunnelsWait: cfg.MaxTunnelsWait,
+		capacity:       make(chan struct{}),
+
+		child:     child,
+		command:   command,
+		stateFile: cfg.StateFile,
+		tracer:    cfg.Tracer,
 	}, nil
 }
 
-// GetOrStart ensures a tunnel for the given SNI is running and returns its local port.
-func (m *NodeManager) GetOrStart(sni string) (int, error) {
+// GetOrStart ensures a tunnel for the given SNI is running and leases its least-loaded ready replica.
+func (m *NodeManager) GetOrStart(sni string, opts TunnelOptions) (*Lease, error) {
+	return m.GetOrStartContext(context.Background(), sni, opts)
+}
+
+// GetOrStartContext is GetOrStart with a context: it stops waiting for a starting tunnel when ctx is done (the
+// launch itself carries on for other callers), and traces the call and any launch it triggers under ctx's span.
+func (m *NodeManager) GetOrStartContext(ctx context.Context, sni string, opts TunnelOptions) (*Lease, error) {
+	ctx, span := m.tracer.Start(ctx, "GetOrStart", tracing.String("sni", sni))
+	defer span.End()
+	lease, err := m.getOrStart(ctx, sni, opts)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(tracing.Int("tunnel.replica", lease.Replica), tracing.Int("tunnel.port", int(lease.Addr.Port())))
+	return lease, nil
+}
+
+func (m *NodeManager) getOrStart(ctx context.Context, sni string, opts TunnelOptions) (*Lease, error) {
 	hostname, err := deriveValidatedTunnelHostname(sni)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	tracing.SpanFromContext(ctx).SetAttributes(tracing.String("tunnel.hostname", hostname))
+	want := min(max(opts.Replicas, 1), MaxReplicas)
 
 	m.mu.Lock()
-	if m.closed {
-		m.mu.Unlock()
-		return 0, fmt.Errorf("node manager shutting down")
+	var st *nodeState
+	for {
+		if m.closed {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("node manager shutting down")
+		}
+		var ok bool
+		st, ok = m.nodes[hostname]
+		if !ok {
+			st = &nodeState{hostname: hostname, changed: make(chan struct{})}
+			m.nodes[hostname] = st
+		}
+		st.token = opts.ServiceToken
+		for len(st.replicas) < want {
+			st.replicas = append(st.replicas, &replica{node: st, index: len(st.replicas), state: replicaStopped})
+		}
+		if st.liveLocked() {
+			break
+		}
+		// Nothing is serving or on its way: this is a fresh start, gated by the breaker. The breaker goes first so
+		// that a hostname failing fast never evicts another tunnel to make room.
+		ok, retryIn := st.breaker.allow(m.now(), m.breakerCooldown)
+		if !ok {
+			m.forgetLocked(st)
+			m.mu.Unlock()
+			return nil, fmt.Errorf("%w for %s (retry in %s)", ErrCircuitOpen, hostname, retryIn.Round(time.Second))
+		}
+		if m.maxTunnels == 0 {
+			break
+		}
+		if err := m.admitLocked(ctx, st); err != nil {
+			m.forgetLocked(st)
+			m.mu.Unlock()
+			return nil, err
+		}
+		if m.nodes[hostname] == st {
+			break
+		}
+		// st was forgotten while we waited for a slot; start over with whatever node the hostname has now.
 	}
-	st, ok := m.nodes[hostname]
-	if !ok {
-		st = &nodeState{hostname: hostname}
-		m.nodes[hostname] = st
+
+	if !st.liveLocked() {
+		if st.breaker.current() == breakerHalfOpen {
+			m.logger.Infof("Circuit breaker for %s half-open; probing with a single start", hostname)
+			m.launchLocked(ctx, st.replicas[0])
+		} else {
+			for _, r := range st.replicas {
+				m.launchLocked(ctx, r)
+			}
+		}
+	} else if st.breaker.current() == breakerClosed {
+		// Top up replicas that crashed or never came up, once their retry delay has passed.
+		now := m.now()
+		for _, r := range st.replicas {
+			if r.state == replicaStopped && !now.Before(r.retryAt) {
+				m.launchLocked(ctx, r)
+			}
+		}
 	}
-	st.refCount++
 
+	st.refCount++
+	st.lastUsed = m.now()
 	if st.idleTimer != nil {
 		st.idleTimer.Stop()
 		st.idleTimer = nil
 	}
 
-	ready := st.ready
-	if st.cmd == nil || st.cmd.Process == nil || st.cmd.ProcessState != nil {
-		if ready == nil {
-			ready = make(chan struct{})
-			st.ready = ready
-			go m.launchTunnel(st, ready)
+	for {
+		if r := st.pickLocked(); r != nil {
+			r.active++
+			if r.failed == nil {
+				r.failed = make(chan struct{})
+			}
+			lease := &Lease{Addr: r.addrs.listen, Replica: r.index, m: m, r: r, failed: r.failed}
+			m.mu.Unlock()
+			return lease, nil
+		}
+		if st.countLocked(replicaStarting) == 0 {
+			err := st.startErrLocked()
+			m.releaseNodeLocked(st)
+			m.mu.Unlock()
+			return nil, err
+		}
+		changed := st.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+			m.mu.Lock()
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.releaseNodeLocked(st)
+			m.mu.Unlock()
+			return nil, ctx.Err()
 		}
 	}
-	m.mu.Unlock()
-
-	if ready != nil {
-		<-ready
-	}
+}
 
+// release ends a lease and schedules tunnel teardown once the hostname is idle.
+func (m *NodeManager) release(r *replica) {
 	m.mu.Lock()
-	err = st.startErr
-	port := st.port
-	m.mu.Unlock()
+	defer m.mu.Unlock()
+	if r.active > 0 {
+		r.active--
+	}
+	m.releaseNodeLocked(r.node)
+}
 
-	if err != nil {
-		m.Release(sni)
-		return 0, err
+func (m *NodeManager) releaseNodeLocked(st *nodeState) {
+	if st.refCount > 0 {
+		st.refCount--
 	}
-	if port == 0 {
-		m.Release(sni)
-		return 0, fmt.Errorf("no port assigned for %s", hostname)
+	st.lastUsed = m.now()
+	if st.refCount == 0 {
+		m.capacityChangedLocked()
+	}
+	if st.refCount == 0 && st.idleTimer == nil {
+		hostname := st.hostname
+		st.idleTimer = time.AfterFunc(m.idleTimeout, func() {
+			m.stopNode(hostname, false)
+		})
 	}
-	return port, nil
 }
 
-// Release decrements the refcount for a node and schedules tunnel teardown if idle.
-func (m *NodeManager) Release(sni string) {
-	hostname, err := deriveValidatedTunnelHostname(sni)
-	if err != nil {
-		return
+// pickLocked returns the ready replica with the fewest active connections.
+func (st *nodeState) pickLocked() *replica {
+	var best *replica
+	for _, r := range st.replicas {
+		if r.state == replicaReady && (best == nil || r.active < best.active) {
+			best = r
+		}
 	}
+	return best
+}
 
-	m.mu.Lock()
-	st, ok := m.nodes[hostname]
-	if !ok {
-		m.mu.Unlock()
-		return
+func (st *nodeState) countLocked(state replicaState) int {
+	n := 0
+	for _, r := range st.replicas {
+		if r.state == state {
+			n++
+		}
 	}
+	return n
+}
 
-	if st.refCount > 0 {
-		st.refCount--
+func (st *nodeState) startErrLocked() error {
+	for _, r := range st.replicas {
+		if r.startErr != nil {
+			return r.startErr
+		}
 	}
+	return fmt.Errorf("no ready replica for %s", st.hostname)
+}
 
-	if st.refCount == 0 && st.idleTimer == nil {
-		st.idleTimer = time.AfterFunc(m.idleTimeout, func() {
-			m.stopNode(hostname, false)
-		})
+// notifyLocked wakes callers waiting for a replica of st to change state.
+func (st *nodeState) notifyLocked() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+// launchLocked marks r as starting and launches it in the background. The launch is traced under ctx's span but
+// is not cancelled with ctx, since other callers may be waiting for it.
+func (m *NodeManager) launchLocked(ctx context.Context, r *replica) {
+	if r.state != replicaStopped {
+		return
 	}
-	m.mu.Unlock()
+	r.state = replicaStarting
+	r.startErr = nil
+	r.gen++
+	go m.launchTunnel(context.WithoutCancel(ctx), r, r.gen)
 }
 
-func (m *NodeManager) launchTunnel(st *nodeState, ready chan struct{}) {
-	hostname := st.hostname
+// maxBindAttempts bounds how often a start is retried on fresh addresses after cloudflared reports a bind conflict.
+const maxBindAttempts = 3
+
+// launchTunnel starts cloudflared for r and waits for it to become ready. A restart passes a context without a
+// span, so it is traced as a trace of its own.
+func (m *NodeManager) launchTunnel(ctx context.Context, r *replica, gen int) {
+	hostname := r.node.hostname
 	m.mu.Lock()
-	port := st.port
+	if r.gen != gen {
+		m.mu.Unlock()
+		return
+	}
+	addrs := r.addrs
+	startupTimeout := m.startupTimeout
+	token := r.node.token
+	restarts := r.restarts
 	m.mu.Unlock()
 
-	if port == 0 {
-		var err error
-		port, err = m.ports.reserve()
-		if err != nil {
-			m.logger.Errorf("port reservation failed for %s: %v", hostname, err)
-			m.mu.Lock()
-			st.startErr = err
-			if st.ready == ready {
-				close(ready)
-				st.ready = nil
-			}
+	traceCtx, span := m.tracer.Start(ctx, "launchTunnel", tracing.String("tunnel.hostname", hostname),
+		tracing.Int("tunnel.replica", r.index), tracing.Int("tunnel.restarts", restarts))
+	defer span.End()
+
+	// fail records a failed launch unless the replica was stopped (and possibly relaunched) meanwhile.
+	fail := func(err error, countFailure bool) {
+		span.RecordError(err)
+		m.mu.Lock()
+		if r.gen != gen {
 			m.mu.Unlock()
 			return
 		}
-		m.mu.Lock()
-		st.port = port
+		st := r.node
+		m.publish(r.eventLocked(EventFailed, err))
+		r.state = replicaStopped
+		r.startErr = err
+		r.cmd = nil
+		r.cancel = nil
+		r.exited = nil
+		r.addrs = tunnelAddrs{}
+		r.retryAt = m.now().Add(m.restart.Backoff)
+		if !st.liveLocked() {
+			if countFailure {
+				m.recordStartFailure(st)
+			}
+			m.capacityChangedLocked()
+		}
+		st.notifyLocked()
 		m.mu.Unlock()
+		m.addrs.release(addrs)
 	}
 
-	m.logger.Infof("Starting cloudflared for %s on %d", hostname, port)
+	for attempt := 1; ; attempt++ {
+		if !addrs.valid() {
+			var err error
+			if addrs, err = m.addrs.reserve(); err != nil {
+				m.logger.Errorf("address reservation failed for %s: %v", hostname, err)
+				fail(err, false)
+				return
+			}
+			m.mu.Lock()
+			if r.gen != gen {
+				m.mu.Unlock()
+				m.addrs.release(addrs)
+				return
+			}
+			r.addrs = addrs
+			m.mu.Unlock()
+		}
+
+		m.logger.Infof("Starting cloudflared for %s replica %d on %s (metrics %s)", hostname, r.index, addrs.listen, addrs.metrics)
+		span.SetAttributes(tracing.Int("tunnel.port", int(addrs.listen.Port())), tracing.Int("tunnel.bind_attempts", attempt))
+
+		args, err := m.command.args(commandData{Hostname: hostname, Listen: addrs.listen.String(), Metrics: addrs.metrics.String(), Replica: r.index})
+		if err != nil {
+			m.logger.Errorf("cloudflared command for %s: %v", hostname, err)
+			fail(err, true)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(ctx, m.command.binary, args...)
+
+		m.child.prepare(cmd)
+		if env := token.env(); env != nil {
+			if cmd.Env == nil {
+				cmd.Env = os.Environ()
+			}
+			cmd.Env = append(cmd.Env, env...)
+		}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, "cloudflared", "access", "tcp", "--hostname", hostname, "--url", fmt.Sprintf("localhost:%d", port))
+		stdout, _ := cmd.StdoutPipe()
+		stderr, _ := cmd.StderrPipe()
 
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
+		if err := cmd.Start(); err != nil {
+			m.logger.Errorf("cloudflared start failed for %s: %v", hostname, err)
+			cancel()
+			fail(err, true)
+			return
+		}
+		if err := m.child.afterStart(cmd.Process.Pid); err != nil {
+			m.logger.Errorf("cloudflared hardening failed for %s: %v", hostname, err)
+			cancel()
+			_ = cmd.Wait()
+			fail(err, true)
+			return
+		}
 
-	if err := cmd.Start(); err != nil {
-		m.logger.Errorf("cloudflared start failed for %s: %v", hostname, err)
+		exited := make(chan struct{})
 		m.mu.Lock()
-		st.startErr = err
-		st.cmd = nil
-		st.cancel = nil
-		st.port = 0
-		if st.ready == ready {
-			close(ready)
-			st.ready = nil
+		if r.gen != gen {
+			m.mu.Unlock()
+			cancel()
+			_ = cmd.Wait()
+			return
 		}
+		r.lastErrCause = causeNone
+		r.lastErrMsg = ""
+		r.adopted = false
+		r.startedAt = m.now()
+		r.procStart, _ = procStartTime(cmd.Process.Pid)
+		r.pgid = 0
+		if m.child.ownGroup() {
+			r.pgid = cmd.Process.Pid
+		}
+		r.cmd = cmd
+		r.cancel = cancel
+		r.exited = exited
+		m.publish(r.eventLocked(EventStarting, nil))
 		m.mu.Unlock()
-		m.ports.release(port)
-		cancel()
-		return
-	}
+		span.SetAttributes(tracing.Int("tunnel.pid", cmd.Process.Pid))
+
+		// Drain both pipes before Wait so every failure line is classified by the time the exit is observed.
+		var pipes sync.WaitGroup
+		pipes.Add(2)
+		go func() { defer pipes.Done(); m.streamPipe(r, stdout, "stdout") }()
+		go func() { defer pipes.Done(); m.streamPipe(r, stderr, "stderr") }()
+		var exitErr error
+		go func() {
+			pipes.Wait()
+			exitErr = cmd.Wait()
+			close(exited)
+		}()
+
+		readyCtx, readyCancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-exited:
+			case <-readyCtx.Done():
+			}
+			readyCancel()
+		}()
+		probe := newMetricsProbe(addrs.metrics.String(), addrs.listen.String())
+		_, waitSpan := m.tracer.Start(traceCtx, "waitForPort", tracing.Int("tunnel.port", int(addrs.listen.Port())),
+			tracing.Int("tunnel.pid", cmd.Process.Pid))
+		err = waitForReady(readyCtx, probe, startupTimeout)
+		waitSpan.RecordError(err)
+		waitSpan.End()
+		readyCancel()
+		if err == nil {
+			m.mu.Lock()
+			if r.gen != gen {
+				m.mu.Unlock()
+				cancel()
+				return
+			}
+			r.state = replicaReady
+			r.startErr = nil
+			m.publish(r.eventLocked(EventReady, nil))
+			r.restarts = 0
+			if r.node.breaker.onSuccess() {
+				m.logger.Infof("Circuit breaker for %s closed after successful start", hostname)
+			}
+			r.node.notifyLocked()
+			m.mu.Unlock()
+			m.persistState()
 
-	go streamPipe(m.logger, stdout, fmt.Sprintf("[%s][cloudflared][stdout]", hostname))
-	go streamPipe(m.logger, stderr, fmt.Sprintf("[%s][cloudflared][stderr]", hostname))
+			go m.monitorLiveness(ctx, r, probe, cmd.Process)
 
-	m.mu.Lock()
-	st.cmd = cmd
-	st.cancel = cancel
-	st.startErr = nil
-	m.mu.Unlock()
+			go func() {
+				<-exited
+				cancel()
+				m.logger.Errorf("cloudflared exited for %s replica %d: %v", hostname, r.index, exitErr)
+				m.handleProcessExit(r, cmd, exitErr)
+			}()
+			return
+		}
 
-	err := waitForPort(ctx, "127.0.0.1", port, m.startupTimeout)
-	if err != nil {
-		m.logger.Errorf("cloudflared not ready for %s: %v", hostname, err)
 		cancel()
 		_ = cmd.Process.Kill()
-		_, _ = cmd.Process.Wait()
+		<-exited
+		if errors.Is(err, context.Canceled) {
+			err = fmt.Errorf("cloudflared exited before becoming ready: %v", exitErr)
+		}
+
 		m.mu.Lock()
-		st.cmd = nil
-		st.cancel = nil
-		st.startErr = err
-		st.port = 0
-		if st.ready == ready {
-			close(ready)
-			st.ready = nil
+		cause, causeMsg := r.lastErrCause, r.lastErrMsg
+		retry := cause == causeAddressInUse && attempt < maxBindAttempts && r.gen == gen
+		if retry {
+			r.addrs = tunnelAddrs{}
+			r.cmd = nil
+			r.cancel = nil
+			r.exited = nil
 		}
 		m.mu.Unlock()
-		m.ports.release(port)
+		if retry {
+			m.logger.Errorf("cloudflared for %s hit a bind conflict on %s/%s; retrying on fresh addresses (attempt %d/%d)",
+				hostname, addrs.listen, addrs.metrics, attempt+1, maxBindAttempts)
+			m.addrs.releaseConflicted(addrs)
+			addrs = tunnelAddrs{}
+			continue
+		}
+		if cause != causeNone {
+			err = fmt.Errorf("%w (cloudflared reported %s: %s)", err, cause, causeMsg)
+		}
+		m.logger.Errorf("cloudflared not ready for %s: %v", hostname, err)
+		fail(err, true)
 		return
 	}
-
-	m.mu.Lock()
-	st.startErr = nil
-	st.restarts = 0
-	m.mu.Unlock()
-	close(ready)
-
-	go func() {
-		err := cmd.Wait()
-		cancel()
-		m.logger.Errorf("cloudflared exited for %s: %v", hostname, err)
-		m.handleProcessExit(st, err)
-	}()
 }
 
-func (m *NodeManager) handleProcessExit(st *nodeState, err error) {
-	hostname := st.hostname
+// handleProcessExit marks a replica down after its process exits and restarts it while the hostname is in use.
+// Other replicas keep serving in the meantime.
+func (m *NodeManager) handleProcessExit(r *replica, cmd *exec.Cmd, err error) {
+	hostname := r.node.hostname
 	m.mu.Lock()
+	if r.cmd != cmd {
+		// Stopped deliberately, or already superseded by a newer launch.
+		m.mu.Unlock()
+		return
+	}
+	st := r.node
 	active := st.refCount
-	st.cmd = nil
-	st.cancel = nil
-	st.ready = nil
-	st.startErr = fmt.Errorf("tunnel exited: %v", err)
-	st.restarts++
-	restarts := st.restarts
+	ev := r.eventLocked(EventFailed, nil)
+	r.cmd = nil
+	r.cancel = nil
+	r.exited = nil
+	r.state = replicaStopped
+	r.startErr = fmt.Errorf("tunnel exited: %v", err)
+	if r.lastErrCause != causeNone {
+		r.startErr = fmt.Errorf("tunnel exited: %v (cloudflared reported %s: %s)", err, r.lastErrCause, r.lastErrMsg)
+	}
+	r.restarts++
+	restarts := r.restarts
+	now := m.now()
+	crashes := r.crashes.record(now, m.restart.Window)
+	window := m.restart.Window
+	crashLoop := crashes > m.restart.MaxRestarts
+	backoff := m.restart.delay(crashes, m.rand())
+	restart := active > 0 && !crashLoop && !m.closed
+	ev.Attempt = restarts
+	if restart {
+		ev.Type = EventRestarting
+		r.state = replicaStarting
+		r.gen++
+		gen := r.gen
+		time.AfterFunc(backoff, func() {
+			m.launchTunnel(context.Background(), r, gen)
+		})
+	} else {
+		r.retryAt = now.Add(backoff)
+		if crashLoop {
+			r.retryAt = r.crashes.clearsAt(m.restart.Window)
+			r.startErr = fmt.Errorf("%w: %d crashes within %s: %v", ErrRestartsExhausted, crashes, m.restart.Window, r.startErr)
+			r.failLeasesLocked()
+			if !st.liveLocked() && st.breaker.trip(now) {
+				m.logger.Errorf("Circuit breaker for %s opened after replica %d crash-looped; failing fast for %s",
+					hostname, r.index, m.breakerCooldown)
+			}
+		}
+		if !st.liveLocked() {
+			m.capacityChangedLocked()
+		}
+	}
+	ev.Err = r.startErr
+	m.publish(ev)
+	retryAt, failing := r.retryAt, r.active
+	st.notifyLocked()
 	m.mu.Unlock()
+	m.persistState()
 
-	if active > 0 && restarts <= m.maxRestarts {
-		backoff := time.Duration(restarts) * m.restartBackoff
-		m.logger.Infof("Restarting cloudflared for %s (active=%d, attempt=%d, backoff=%s)", hostname, active, restarts, backoff)
-		m.mu.Lock()
-		if st.ready == nil && st.cmd == nil {
-			st.ready = make(chan struct{})
-			ready := st.ready
-			m.mu.Unlock()
-			time.AfterFunc(backoff, func() {
-				m.launchTunnel(st, ready)
-			})
-		} else {
-			m.mu.Unlock()
-		}
-	} else if active > 0 {
-		m.logger.Errorf("Max restart attempts reached for %s; not restarting", hostname)
+	if restart {
+		m.logger.Infof("Restarting cloudflared for %s replica %d (active=%d, attempt=%d, backoff=%s)", hostname, r.index, active, restarts, backoff)
+	} else if crashLoop {
+		m.logger.Errorf("cloudflared for %s replica %d crashed %d times within %s; not restarting before %s, failing %d connection(s)",
+			hostname, r.index, crashes, window, retryAt.Format(time.RFC3339), failing)
 	}
 }
 
+// stoppedReplica is what is left to clean up of a replica detached from its node.
+type stoppedReplica struct {
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	exited chan struct{}
+	addrs  tunnelAddrs
+}
+
 func (m *NodeManager) stopNode(hostname string, force bool) {
 	m.mu.Lock()
 	st, ok := m.nodes[hostname]
@@ -330,36 +759,95 @@ func (m *NodeManager) stopNode(hostname string, force bool) {
 		m.mu.Unlock()
 		return
 	}
-	cmd := st.cmd
-	cancel := st.cancel
-	port := st.port
-	st.cmd = nil
-	st.cancel = nil
-	st.ready = nil
-	st.startErr = fmt.Errorf("tunnel stopped")
-	st.idleTimer = nil
-	st.port = 0
+	reason := EventIdleStopped
+	if force {
+		reason = EventForceStopped
+	}
+	victims := m.detachLocked(st, reason)
 	m.mu.Unlock()
 
-	m.logger.Infof("Stopping cloudflared for %s (idle=%v)", hostname, force)
-	if cancel != nil {
-		cancel()
+	m.logger.Infof("Stopping cloudflared for %s (idle=%v)", hostname, !force)
+	m.reap(victims)
+	m.forget(st)
+	m.persistState()
+}
+
+// forget removes st from m.nodes if nothing needs it any more; see forgetLocked.
+func (m *NodeManager) forget(st *nodeState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forgetLocked(st)
+}
+
+// forgetLocked removes st from m.nodes once nothing needs it: no leases and no replica starting or running.
+// An open circuit breaker is remembered until its cooldown ends, so a failing hostname cannot reset it by going
+// idle; after that the hostname starts over with a closed breaker. Callers hold m.mu.
+func (m *NodeManager) forgetLocked(st *nodeState) {
+	if st.refCount > 0 || st.liveLocked() || m.nodes[st.hostname] != st {
+		return
 	}
-	if cmd != nil && cmd.Process != nil {
-		done := make(chan struct{})
-		go func() {
-			_, _ = cmd.Process.Wait()
-			close(done)
-		}()
-		select {
-		case <-done:
-		case <-time.After(2 * time.Second):
-			_ = cmd.Process.Kill()
-			<-done
+	if st.breaker.current() != breakerClosed {
+		if wait := st.breaker.openedAt.Add(m.breakerCooldown).Sub(m.now()); wait > 0 {
+			if st.idleTimer == nil {
+				var t *time.Timer
+				t = time.AfterFunc(wait, func() {
+					m.mu.Lock()
+					defer m.mu.Unlock()
+					if st.idleTimer == t {
+						st.idleTimer = nil
+						m.forgetLocked(st)
+					}
+				})
+				st.idleTimer = t
+			}
+			return
 		}
 	}
-	if port != 0 {
-		m.ports.release(port)
+	delete(m.nodes, st.hostname)
+}
+
+// detachLocked marks every replica of st stopped, publishing reason for those that were running, and hands back
+// what reap must clean up.
+func (m *NodeManager) detachLocked(st *nodeState, reason EventType) []stoppedReplica {
+	var victims []stoppedReplica
+	for _, r := range st.replicas {
+		if r.state != replicaStopped {
+			m.publish(r.eventLocked(reason, nil))
+		}
+		victims = append(victims, stoppedReplica{cmd: r.cmd, cancel: r.cancel, exited: r.exited, addrs: r.addrs})
+		r.gen++
+		r.state = replicaStopped
+		r.cmd = nil
+		r.cancel = nil
+		r.exited = nil
+		r.addrs = tunnelAddrs{}
+		r.startErr = fmt.Errorf("tunnel stopped")
+		r.retryAt = time.Time{}
+	}
+	if st.idleTimer != nil {
+		st.idleTimer.Stop()
+		st.idleTimer = nil
+	}
+	st.notifyLocked()
+	m.capacityChangedLocked()
+	return victims
+}
+
+// reap terminates detached processes and releases their addresses.
+func (m *NodeManager) reap(victims []stoppedReplica) {
+	for _, v := range victims {
+		if v.cancel != nil {
+			v.cancel()
+		}
+		if v.cmd != nil && v.cmd.Process != nil && v.exited != nil {
+			select {
+			case <-v.exited:
+			case <-time.After(2 * time.Second):
+				_ = v.cmd.Process.Kill()
+				<-v.exited
+			}
+		}
+		m.addrs.release(v.addrs)
 	}
 }
 
@@ -376,6 +864,7 @@ func (m *NodeManager) Shutdown(ctx context.Context) {
 		hostnames = append(hostnames, h)
 	}
 	m.mu.Unlock()
+	defer m.closeEvents()
 
 	var wg sync.WaitGroup
 	for _, h := range hostnames {
@@ -397,47 +886,3 @@ func (m *NodeManager) Shutdown(ctx context.Context) {
 	case <-ctx.Done():
 	}
 }
-
-func waitForPort(ctx context.Context, host string, port int, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	target := fmt.Sprintf("%s:%d", host, port)
-	for {
-		dialer := net.Dialer{Timeout: 500 * time.Millisecond}
-		conn, err := dialer.DialContext(ctx, "tcp", target)
-		if err == nil {
-			conn.Close()
-			return nil
-		}
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for %s: %w", target, err)
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(300 * time.Millisecond):
-		}
-	}
-}
-
-func streamPipe(logger *logging.Logger, r io.ReadCloser, prefix string) {
-	defer r.Close()
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		logger.Infof("%s %s", prefix, scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		logger.Errorf("%s stream error: %v", prefix, err)
-	}
-}
-
-func isPortAvailable(port int) bool {
-	if port <= 0 {
-		return false
-	}
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		return false
-	}
-	_ = ln.Close()
-	return true
-}
@@ -0,0 +1,270 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/tracing"
+	"tcp-tunnel-proxy/internal/tracing/tracingtest"
+)
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("FAKE_CLOUDFLARED") {
+	case "1":
+		runFakeCloudflared(os.Args[1:])
+		return
+	case "hang":
+		// A cloudflared that never becomes ready.
+		time.Sleep(time.Hour)
+		return
+	}
+	if os.Getenv("CHILDPROC_PARENT") == "1" {
+		runChildprocParent()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeCloudflared stands in for `cloudflared access tcp`: it echoes on --url and reports ready on --metrics.
+func runFakeCloudflared(args []string) {
+	var url, metrics string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "--url":
+			url = args[i+1]
+		case "--metrics":
+			metrics = args[i+1]
+		}
+	}
+	ln, err := net.Listen("tcp", url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `{"level":"error","message":"listen failed","error":%q}`+"\n", err.Error())
+		os.Exit(1)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c); c.Close() }()
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":200,"readyConnections":1}`))
+	})
+	fmt.Fprintln(os.Stderr, `{"level":"info","message":"Start Websocket listener"}`)
+	_ = http.ListenAndServe(metrics, mux)
+	os.Exit(1)
+}
+
+// fakeReadyCloudflared installs a cloudflared that re-executes this test binary as runFakeCloudflared.
+func fakeReadyCloudflared(t *testing.T) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	fakeCloudflared(t, fmt.Sprintf("FAKE_CLOUDFLARED=1 exec %q \"$@\"\n", exe))
+}
+
+// fakeCloudflared installs a shell script named cloudflared at the front of PATH.
+func fakeCloudflared(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script fake requires a POSIX shell")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cloudflared"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("write fake cloudflared: %v", err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestLaunchRetriesOnBindConflict(t *testing.T) {
+	fakeCloudflared(t, `echo '{"level":"error","error":"listen tcp 127.0.0.1:1: bind: address already in use","message":"failed to start"}' >&2
+exit 1
+`)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 43000,
+		PortRangeEnd:   43100,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+
+	start := time.Now()
+	_, err = m.GetOrStart("db.example.com", TunnelOptions{})
+	if err == nil || !strings.Contains(err.Error(), "address_in_use") {
+		t.Fatalf("expected address_in_use failure, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("early exit should not wait for the startup timeout")
+	}
+
+	st := m.PortStats()
+	if st.BindConflicts != 2*(maxBindAttempts-1) {
+		t.Fatalf("expected %d bind conflicts, got %+v", 2*(maxBindAttempts-1), st)
+	}
+	if st.InUse != 0 || st.Reservations != 2*maxBindAttempts {
+		t.Fatalf("expected all %d reserved ports to be released, got %+v", 2*maxBindAttempts, st)
+	}
+	if s := m.Status(); len(s) != 1 || s[0].ConsecutiveFailures != 1 {
+		t.Fatalf("bind retries should count as a single breaker failure, got %+v", s)
+	}
+}
+
+func waitForStatus(t *testing.T, m *NodeManager, desc string, ok func([]TunnelStatus) bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !ok(m.Status()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %+v", desc, m.Status())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func replicasReady(n int) func([]TunnelStatus) bool {
+	return func(s []TunnelStatus) bool {
+		if len(s) != 1 {
+			return false
+		}
+		ready := 0
+		for _, r := range s[0].Replicas {
+			if r.State == string(replicaReady) {
+				ready++
+			}
+		}
+		return ready == n
+	}
+}
+
+func TestReplicasBalanceAndSurviveCrash(t *testing.T) {
+	fakeReadyCloudflared(t)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 44000,
+		PortRangeEnd:   44100,
+		Restart:        RestartPolicy{Backoff: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+	opts := TunnelOptions{Replicas: 2}
+
+	first, err := m.GetOrStart("db.example.com", opts)
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	waitForStatus(t, m, "both replicas ready", replicasReady(2))
+
+	second, err := m.GetOrStart("db.example.com", opts)
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	if second.Replica == first.Replica || second.Addr == first.Addr {
+		t.Fatalf("expected the least-loaded replica, got %d (%s) twice", second.Replica, second.Addr)
+	}
+	conn, err := net.Dial("tcp", second.Addr.String())
+	if err != nil {
+		t.Fatalf("dial leased address: %v", err)
+	}
+	conn.Close()
+
+	// Crash the first lease's replica: new connections flow to the survivor while it restarts.
+	m.mu.Lock()
+	crashed := m.nodes["cft-db.example.com"].replicas[first.Replica]
+	_ = crashed.cmd.Process.Kill()
+	m.mu.Unlock()
+	waitForStatus(t, m, "crashed replica to leave ready", replicasReady(1))
+
+	third, err := m.GetOrStart("db.example.com", opts)
+	if err != nil {
+		t.Fatalf("GetOrStart during restart: %v", err)
+	}
+	if third.Replica != second.Replica {
+		t.Fatalf("expected survivor replica %d, got %d", second.Replica, third.Replica)
+	}
+	waitForStatus(t, m, "crashed replica to restart", replicasReady(2))
+	if s := m.Status(); s[0].Replicas[first.Replica].Restarts != 0 || s[0].ActiveConnections != 3 {
+		t.Fatalf("unexpected status after restart: %+v", s)
+	}
+
+	first.Release()
+	first.Release() // idempotent
+	second.Release()
+	third.Release()
+	if s := m.Status(); s[0].ActiveConnections != 0 {
+		t.Fatalf("expected all leases released, got %+v", s)
+	}
+}
+
+func TestGetOrStartTracesLaunch(t *testing.T) {
+	fakeReadyCloudflared(t)
+	collector := tracingtest.NewCollector(t)
+	tracer, err := tracing.New(tracing.Config{Endpoint: collector.URL, SampleRatio: 1, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("tracing.New: %v", err)
+	}
+	defer tracer.Shutdown(context.Background())
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 46600,
+		PortRangeEnd:   46700,
+		Tracer:         tracer,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+
+	ctx, root := tracer.StartServer(context.Background(), "HandleConnection")
+	lease, err := m.GetOrStartContext(ctx, "db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStartContext: %v", err)
+	}
+	defer lease.Release()
+	root.End()
+
+	spans := map[string]tracingtest.Span{}
+	for _, s := range collector.WaitFor(t, "HandleConnection", "GetOrStart", "launchTunnel", "waitForPort") {
+		spans[s.Name] = s
+	}
+	parents := map[string]string{"GetOrStart": "HandleConnection", "launchTunnel": "GetOrStart", "waitForPort": "launchTunnel"}
+	for child, parent := range parents {
+		if spans[child].ParentSpanID != spans[parent].SpanID || spans[child].TraceID != spans[parent].TraceID {
+			t.Fatalf("%s is not a child of %s: %+v", child, parent, spans)
+		}
+	}
+	g, l := spans["GetOrStart"], spans["launchTunnel"]
+	if g.Attributes["sni"] != "db.example.com" || g.Attributes["tunnel.hostname"] != "cft-db.example.com" || g.Attributes["tunnel.port"] != int64(lease.Addr.Port()) {
+		t.Fatalf("unexpected GetOrStart attributes %v", g.Attributes)
+	}
+	if l.Attributes["tunnel.port"] != int64(lease.Addr.Port()) || l.Attributes["tunnel.pid"] == nil || l.StatusCode != 0 {
+		t.Fatalf("unexpected launchTunnel span %+v", l)
+	}
+
+	// A caller that gives up stops waiting for a start; the launch itself is unaffected.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.GetOrStartContext(cancelled, "other.example.com", TunnelOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"tcp-tunnel-proxy/internal/shellwords"
+)
+
+// DefaultArgsTemplate starts an Access TCP tunnel. Readiness checks need --metrics and failure classification
+// needs --output json, so custom templates should keep both.
+const DefaultArgsTemplate = "{{.ExtraArgs}} access tcp --hostname {{.Hostname}} --url {{.Listen}} --metrics {{.Metrics}} --output json"
+
+// ServiceToken is a Cloudflare Access service token. cloudflared receives it in TUNNEL_SERVICE_TOKEN_ID and
+// TUNNEL_SERVICE_TOKEN_SECRET, never on its command line, and it formats as redacted so it cannot be logged.
+type ServiceToken struct {
+	ID     string
+	Secret string
+}
+
+func (t ServiceToken) String() string {
+	if t.ID == "" && t.Secret == "" {
+		return "none"
+	}
+	return "[redacted]"
+}
+
+func (t ServiceToken) GoString() string { return "cloudflaredmanager.ServiceToken{" + t.String() + "}" }
+
+// env returns the variables that hand the token to cloudflared.
+func (t ServiceToken) env() []string {
+	if t.ID == "" {
+		return nil
+	}
+	return []string{"TUNNEL_SERVICE_TOKEN_ID=" + t.ID, "TUNNEL_SERVICE_TOKEN_SECRET=" + t.Secret}
+}
+
+// commandData is what an args template can refer to. Values are shell-quoted, so the rendered template is split
+// back into the same arguments.
+type commandData struct {
+	Hostname  string // tunnel hostname, e.g. cft-db.example.com
+	Listen    string // local address cloudflared listens on
+	Metrics   string // local address of cloudflared's metrics endpoint
+	Replica   int
+	ExtraArgs string // the configured extra arguments, already quoted
+}
+
+// commandSpec renders the cloudflared command line for a replica.
+type commandSpec struct {
+	binary string
+	tmpl   *template.Template
+	extra  string
+}
+
+func newCommandSpec(binary, argsTemplate string, extraArgs []string) (*commandSpec, error) {
+	if binary == "" {
+		binary = "cloudflared"
+	}
+	if strings.TrimSpace(argsTemplate) == "" {
+		argsTemplate = DefaultArgsTemplate
+	}
+	tmpl, err := template.New("cloudflared").Option("missingkey=error").Parse(argsTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("cloudflared args template: %w", err)
+	}
+	c := &commandSpec{binary: binary, tmpl: tmpl, extra: shellwords.Join(extraArgs)}
+	// Render once so unknown fields and unbalanced quotes fail at startup rather than at the first launch.
+	if _, err := c.args(commandData{Hostname: "cft-example.com", Listen: "127.0.0.1:1", Metrics: "127.0.0.1:2"}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *commandSpec) args(d commandData) ([]string, error) {
+	d.Hostname = shellwords.Quote(d.Hostname)
+	d.Listen = shellwords.Quote(d.Listen)
+	d.Metrics = shellwords.Quote(d.Metrics)
+	d.ExtraArgs = c.extra
+	var sb strings.Builder
+	if err := c.tmpl.Execute(&sb, d); err != nil {
+		return nil, fmt.Errorf("cloudflared args template: %w", err)
+	}
+	args, err := shellwords.Split(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("cloudflared args template: %w", err)
+	}
+	return args, nil
+}
@@ -0,0 +1,113 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandSpecArgs(t *testing.T) {
+	c, err := newCommandSpec("", "", []string{"--loglevel", "debug", "--edge-ip-version", "4"})
+	if err != nil {
+		t.Fatalf("newCommandSpec: %v", err)
+	}
+	if c.binary != "cloudflared" {
+		t.Fatalf("default binary: got %q", c.binary)
+	}
+	got, err := c.args(commandData{Hostname: "cft-db.example.com", Listen: "127.0.0.1:20000", Metrics: "127.0.0.1:20001"})
+	if err != nil {
+		t.Fatalf("args: %v", err)
+	}
+	want := []string{"--loglevel", "debug", "--edge-ip-version", "4", "access", "tcp", "--hostname", "cft-db.example.com",
+		"--url", "127.0.0.1:20000", "--metrics", "127.0.0.1:20001", "--output", "json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("args:\n got %q\nwant %q", got, want)
+	}
+
+	c, err = newCommandSpec("/opt/cf", `access tcp --hostname {{.Hostname}} --url {{.Listen}} --metrics {{.Metrics}} --header "X-Replica: {{.Replica}}"`, nil)
+	if err != nil {
+		t.Fatalf("newCommandSpec: %v", err)
+	}
+	got, _ = c.args(commandData{Hostname: "cft-a.example.com", Listen: "127.0.0.1:1", Metrics: "127.0.0.1:2", Replica: 3})
+	if got[len(got)-1] != "X-Replica: 3" || c.binary != "/opt/cf" {
+		t.Fatalf("custom template: got %q (%s)", got, c.binary)
+	}
+
+	for _, bad := range []string{"{{.Hostname", "{{.Nope}}", `access "tcp`} {
+		if _, err := newCommandSpec("", bad, nil); err == nil {
+			t.Fatalf("expected error for template %q", bad)
+		}
+	}
+}
+
+func TestServiceTokenIsRedacted(t *testing.T) {
+	opts := TunnelOptions{Replicas: 1, ServiceToken: ServiceToken{ID: "id-123.access", Secret: "s3cr3t"}}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		out := fmt.Sprintf(format, opts)
+		if strings.Contains(out, "s3cr3t") || strings.Contains(out, "id-123") {
+			t.Fatalf("%s leaked the token: %s", format, out)
+		}
+	}
+	if (ServiceToken{}).String() != "none" || (ServiceToken{}).env() != nil {
+		t.Fatalf("zero token should be empty")
+	}
+}
+
+func TestLaunchUsesBinaryTemplateAndServiceToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script fake requires a POSIX shell")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	dir := t.TempDir()
+	record := filepath.Join(dir, "record")
+	wrapper := filepath.Join(dir, "cf-wrapper")
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$TUNNEL_SERVICE_TOKEN_ID\" \"$TUNNEL_SERVICE_TOKEN_SECRET\" \"$*\" > %q\nFAKE_CLOUDFLARED=1 exec %q \"$@\"\n", record, exe)
+	if err := os.WriteFile(wrapper, []byte(script), 0o755); err != nil {
+		t.Fatalf("write wrapper: %v", err)
+	}
+	t.Setenv("TUNNEL_SERVICE_TOKEN_ID", "inherited")
+
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45600,
+		PortRangeEnd:   45700,
+		Binary:         wrapper,
+		ExtraArgs:      []string{"--loglevel", "debug"},
+		Child:          ChildPolicy{EnvAllowlist: []string{"PATH", "TUNNEL_*"}},
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+
+	lease, err := m.GetOrStart("db.example.com", TunnelOptions{ServiceToken: ServiceToken{ID: "id.access", Secret: "secret value"}})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	defer lease.Release()
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "id.access" || lines[1] != "secret value" {
+		t.Fatalf("token not passed through the environment: %q", lines)
+	}
+	if !strings.HasPrefix(lines[2], "--loglevel debug access tcp --hostname cft-db.example.com --url ") {
+		t.Fatalf("unexpected command line %q", lines[2])
+	}
+	if strings.Contains(lines[2], "secret") {
+		t.Fatalf("secret leaked onto the command line: %q", lines[2])
+	}
+}
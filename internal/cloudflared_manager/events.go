@@ -0,0 +1,146 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType names a tunnel lifecycle transition.
+type EventType string
+
+const (
+	// EventStarting: a cloudflared process was launched and is waiting to become ready.
+	EventStarting EventType = "starting"
+	// EventReady: the process passed its readiness check and accepts connections.
+	EventReady EventType = "ready"
+	// EventFailed: a start failed, or the process exited and will not be restarted. A crash loop carries an
+	// error wrapping ErrRestartsExhausted.
+	EventFailed EventType = "failed"
+	// EventRestarting: the process exited while in use and a restart is scheduled.
+	EventRestarting EventType = "restarting"
+	// EventIdleStopped: the tunnel was stopped after its idle timeout.
+	EventIdleStopped EventType = "idle_stopped"
+	// EventForceStopped: the tunnel was stopped while it may have had connections, on shutdown or eviction.
+	EventForceStopped EventType = "force_stopped"
+)
+
+// EventTypes lists every EventType.
+var EventTypes = []EventType{EventStarting, EventReady, EventFailed, EventRestarting, EventIdleStopped, EventForceStopped}
+
+// ParseEventType accepts the names of EventTypes.
+func ParseEventType(s string) (EventType, error) {
+	for _, t := range EventTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q", s)
+}
+
+// Event is one lifecycle transition of a cloudflared replica.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Replica  int       `json:"replica"`
+	Port     int       `json:"port,omitempty"` // tunnel listen port
+	PID      int       `json:"pid,omitempty"`
+	// Attempt counts consecutive restarts since the replica was last ready; 0 for a first start.
+	Attempt int `json:"attempt"`
+	// Err is why the replica failed or is restarting; nil for the other types.
+	Err error `json:"-"`
+	// Error is Err's text, for JSON consumers.
+	Error string `json:"error,omitempty"`
+}
+
+// eventBus fans events out to subscribers without ever blocking the manager: a subscriber whose buffer is full
+// misses the event.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[*subscription]struct{}
+	closed bool
+}
+
+type subscription struct {
+	ch      chan Event
+	dropped uint64
+}
+
+// Subscribe returns a channel receiving every event published from now on, buffered to hold buffer events
+// (at least 1), and a function that unsubscribes and closes the channel. The channel is also closed by Shutdown.
+// Events that do not fit the buffer are dropped and logged rather than slowing down tunnel management.
+func (m *NodeManager) Subscribe(buffer int) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, max(buffer, 1))}
+	b := &m.events
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	if b.subs == nil {
+		b.subs = make(map[*subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subs[sub]; ok {
+				delete(b.subs, sub)
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+// publish stamps and delivers ev. It never blocks and may be called with m.mu held.
+func (m *NodeManager) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = m.now()
+	}
+	if ev.Err != nil {
+		ev.Error = ev.Err.Error()
+	}
+	b := &m.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+			if sub.dropped == 1 || sub.dropped%100 == 0 {
+				m.logger.Errorf("Event subscriber is not keeping up; %d event(s) dropped so far", sub.dropped)
+			}
+		}
+	}
+}
+
+// closeEvents closes every subscription; later Subscribe calls get a closed channel.
+func (m *NodeManager) closeEvents() {
+	b := &m.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+}
+
+// eventLocked describes r in its current state. Callers hold m.mu.
+func (r *replica) eventLocked(typ EventType, err error) Event {
+	ev := Event{Type: typ, Hostname: r.node.hostname, Replica: r.index, Attempt: r.restarts, Err: err}
+	if r.addrs.valid() {
+		ev.Port = int(r.addrs.listen.Port())
+	}
+	if r.cmd != nil && r.cmd.Process != nil {
+		ev.PID = r.cmd.Process.Pid
+	}
+	return ev
+}
@@ -0,0 +1,127 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event, want EventType) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatalf("event channel closed while waiting for %s", want)
+		}
+		if ev.Type != want {
+			t.Fatalf("expected %s event, got %+v", want, ev)
+		}
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s event", want)
+	}
+	return Event{}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	fakeReadyCloudflared(t)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    200 * time.Millisecond,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 46000,
+		PortRangeEnd:   46100,
+		Restart:        RestartPolicy{Backoff: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	events, unsubscribe := m.Subscribe(16)
+	defer unsubscribe()
+
+	lease, err := m.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	starting := nextEvent(t, events, EventStarting)
+	if starting.Hostname != "cft-db.example.com" || starting.PID == 0 || starting.Port != int(lease.Addr.Port()) || starting.Attempt != 0 {
+		t.Fatalf("unexpected starting event %+v", starting)
+	}
+	nextEvent(t, events, EventReady)
+
+	m.mu.Lock()
+	_ = m.nodes["cft-db.example.com"].replicas[0].cmd.Process.Kill()
+	m.mu.Unlock()
+	restarting := nextEvent(t, events, EventRestarting)
+	if restarting.PID != starting.PID || restarting.Attempt != 1 || restarting.Error == "" {
+		t.Fatalf("unexpected restarting event %+v", restarting)
+	}
+	if restarted := nextEvent(t, events, EventStarting); restarted.Attempt != 1 || restarted.PID == starting.PID {
+		t.Fatalf("unexpected starting event after a crash %+v", restarted)
+	}
+	nextEvent(t, events, EventReady)
+
+	lease.Release()
+	nextEvent(t, events, EventIdleStopped)
+
+	m.Shutdown(context.Background())
+	if _, ok := <-events; ok {
+		t.Fatalf("expected the event channel to be closed by Shutdown")
+	}
+}
+
+func TestLaunchFailureEvent(t *testing.T) {
+	fakeCloudflared(t, "exit 1\n")
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 5 * time.Second,
+		PortRangeStart: 46200,
+		PortRangeEnd:   46300,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+	events, unsubscribe := m.Subscribe(16)
+
+	if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); err == nil {
+		t.Fatalf("expected the start to fail")
+	}
+	nextEvent(t, events, EventStarting)
+	if failed := nextEvent(t, events, EventFailed); failed.Err == nil || failed.Error != failed.Err.Error() {
+		t.Fatalf("failed event should carry the error, got %+v", failed)
+	}
+
+	unsubscribe()
+	unsubscribe() // idempotent
+	if _, ok := <-events; ok {
+		t.Fatalf("expected the event channel to be closed by unsubscribe")
+	}
+}
+
+func TestPublishDropsForSlowSubscribers(t *testing.T) {
+	m, err := NewNodeManager(Config{IdleTimeout: time.Minute, StartupTimeout: time.Second, PortRangeStart: 46400, PortRangeEnd: 46401})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	events, unsubscribe := m.Subscribe(1)
+	defer unsubscribe()
+
+	m.publish(Event{Type: EventReady, Hostname: "a", Err: errors.New("first")})
+	m.publish(Event{Type: EventReady, Hostname: "b"}) // must not block
+	if ev := <-events; ev.Hostname != "a" || ev.Error != "first" || ev.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("expected the second event to be dropped, got %+v", ev)
+	default:
+	}
+
+	m.Shutdown(context.Background())
+	if late, _ := m.Subscribe(1); late != nil {
+		if _, ok := <-late; ok {
+			t.Fatalf("subscribing after Shutdown should return a closed channel")
+		}
+	}
+}
@@ -63,3 +63,8 @@ func deriveValidatedTunnelHostname(sni string) (string, error) {
 	}
 	return derived, nil
 }
+
+// TunnelHostname returns the cloudflared hostname a client SNI is routed to.
+func TunnelHostname(sni string) (string, error) {
+	return deriveValidatedTunnelHostname(sni)
+}
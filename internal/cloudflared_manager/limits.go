@@ -0,0 +1,130 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTooManyTunnels is returned by GetOrStart when MaxTunnels tunnels are busy and no slot frees up in time.
+var ErrTooManyTunnels = errors.New("tunnel limit reached")
+
+// TunnelStats reports tunnel-count limiting.
+type TunnelStats struct {
+	Live      int    `json:"live"`
+	Max       int    `json:"max"` // 0 means unlimited
+	Waiting   int    `json:"waiting"`
+	Evictions uint64 `json:"evictions_total"`
+	Rejected  uint64 `json:"rejected_total"`
+}
+
+// liveLocked reports whether any replica of st is starting or ready.
+func (st *nodeState) liveLocked() bool {
+	for _, r := range st.replicas {
+		if r.state != replicaStopped {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *NodeManager) liveTunnelsLocked() int {
+	n := 0
+	for _, st := range m.nodes {
+		if st.liveLocked() {
+			n++
+		}
+	}
+	return n
+}
+
+// capacityChangedLocked wakes GetOrStart callers queued for a tunnel slot.
+func (m *NodeManager) capacityChangedLocked() {
+	close(m.capacity)
+	m.capacity = make(chan struct{})
+}
+
+// admitLocked makes room for st to start under MaxTunnels: it evicts the least-recently-used idle tunnel, or
+// waits up to MaxTunnelsWait for one to become idle, or until ctx is done. It may release m.mu while waiting but
+// returns holding it.
+func (m *NodeManager) admitLocked(ctx context.Context, st *nodeState) error {
+	var deadline <-chan time.Time
+	for {
+		if m.closed {
+			return fmt.Errorf("node manager shutting down")
+		}
+		if st.liveLocked() || m.liveTunnelsLocked() < m.maxTunnels {
+			return nil
+		}
+		if victim := m.lruIdleLocked(); victim != nil {
+			m.evictions++
+			m.logger.Infof("Tunnel limit %d reached; evicting idle tunnel %s (last used %s ago) for %s",
+				m.maxTunnels, victim.hostname, m.now().Sub(victim.lastUsed).Round(time.Second), st.hostname)
+			victims := m.detachLocked(victim, EventForceStopped)
+			go func() {
+				m.reap(victims)
+				m.forget(victim)
+				m.persistState()
+			}()
+			return nil
+		}
+		if m.maxTunnelsWait <= 0 {
+			m.rejected++
+			return fmt.Errorf("%w (%d tunnels busy) for %s", ErrTooManyTunnels, m.maxTunnels, st.hostname)
+		}
+		if deadline == nil {
+			timer := time.NewTimer(m.maxTunnelsWait)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		capacity := m.capacity
+		m.waiting++
+		m.mu.Unlock()
+		select {
+		case <-capacity:
+			m.mu.Lock()
+			m.waiting--
+		case <-deadline:
+			m.mu.Lock()
+			m.waiting--
+			if st.liveLocked() || m.liveTunnelsLocked() < m.maxTunnels || m.lruIdleLocked() != nil {
+				continue
+			}
+			m.rejected++
+			return fmt.Errorf("%w (%d tunnels busy, waited %s) for %s", ErrTooManyTunnels, m.maxTunnels, m.maxTunnelsWait, st.hostname)
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.waiting--
+			return ctx.Err()
+		}
+	}
+}
+
+// lruIdleLocked returns the live tunnel without connections that was used least recently.
+func (m *NodeManager) lruIdleLocked() *nodeState {
+	var lru *nodeState
+	for _, st := range m.nodes {
+		if st.refCount > 0 || !st.liveLocked() {
+			continue
+		}
+		if lru == nil || st.lastUsed.Before(lru.lastUsed) {
+			lru = st
+		}
+	}
+	return lru
+}
+
+// TunnelStats returns the current tunnel count and limiter counters.
+func (m *NodeManager) TunnelStats() TunnelStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return TunnelStats{
+		Live:      m.liveTunnelsLocked(),
+		Max:       m.maxTunnels,
+		Waiting:   m.waiting,
+		Evictions: m.evictions,
+		Rejected:  m.rejected,
+	}
+}
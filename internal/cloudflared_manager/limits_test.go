@@ -0,0 +1,201 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newLimitedManager(t *testing.T, wait time.Duration) *NodeManager {
+	t.Helper()
+	fakeReadyCloudflared(t)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45000,
+		PortRangeEnd:   45100,
+		MaxTunnels:     1,
+		MaxTunnelsWait: wait,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	return m
+}
+
+func TestMaxTunnelsEvictsLeastRecentlyUsedIdleTunnel(t *testing.T) {
+	m := newLimitedManager(t, 0)
+
+	a, err := m.GetOrStart("a.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart a: %v", err)
+	}
+	if _, err := m.GetOrStart("b.example.com", TunnelOptions{}); !errors.Is(err, ErrTooManyTunnels) {
+		t.Fatalf("expected ErrTooManyTunnels while a is busy, got %v", err)
+	}
+
+	a.Release()
+	b, err := m.GetOrStart("b.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart b after a went idle: %v", err)
+	}
+	defer b.Release()
+
+	st := m.TunnelStats()
+	if st.Live != 1 || st.Evictions != 1 || st.Rejected != 1 {
+		t.Fatalf("unexpected tunnel stats %+v", st)
+	}
+	for _, s := range m.Status() {
+		if s.Hostname == "cft-a.example.com" && s.Replicas[0].State != string(replicaStopped) {
+			t.Fatalf("expected a to be evicted, got %+v", s)
+		}
+	}
+
+	// Existing tunnels are never subject to the cap.
+	again, err := m.GetOrStart("b.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart on a live tunnel: %v", err)
+	}
+	again.Release()
+}
+
+func TestMaxTunnelsQueuesUntilSlotFrees(t *testing.T) {
+	m := newLimitedManager(t, 5*time.Second)
+
+	a, err := m.GetOrStart("a.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart a: %v", err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		lease, err := m.GetOrStart("b.example.com", TunnelOptions{})
+		if err == nil {
+			lease.Release()
+		}
+		got <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.TunnelStats().Waiting != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request for b never queued: %+v", m.TunnelStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Release()
+
+	if err := <-got; err != nil {
+		t.Fatalf("queued GetOrStart failed: %v", err)
+	}
+	if st := m.TunnelStats(); st.Evictions != 1 || st.Waiting != 0 {
+		t.Fatalf("unexpected tunnel stats %+v", st)
+	}
+}
+
+func TestMaxTunnelsWaitDeadline(t *testing.T) {
+	m := newLimitedManager(t, 100*time.Millisecond)
+
+	a, err := m.GetOrStart("a.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart a: %v", err)
+	}
+	defer a.Release()
+
+	start := time.Now()
+	_, err = m.GetOrStart("b.example.com", TunnelOptions{})
+	if !errors.Is(err, ErrTooManyTunnels) {
+		t.Fatalf("expected ErrTooManyTunnels after waiting, got %v", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("rejected after %s, before the wait deadline", waited)
+	}
+}
+
+func TestMaxTunnelsOpenBreakerDoesNotEvict(t *testing.T) {
+	m := newLimitedManager(t, 0)
+
+	a, err := m.GetOrStart("a.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart a: %v", err)
+	}
+	a.Release()
+
+	m.mu.Lock()
+	m.nodes["cft-b.example.com"] = &nodeState{
+		hostname: "cft-b.example.com",
+		changed:  make(chan struct{}),
+		breaker:  circuitBreaker{state: breakerOpen, openedAt: m.now()},
+	}
+	m.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if _, err := m.GetOrStart("b.example.com", TunnelOptions{}); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected ErrCircuitOpen for b, got %v", err)
+		}
+	}
+	if st := m.TunnelStats(); st.Evictions != 0 || st.Live != 1 {
+		t.Fatalf("an open breaker must not evict idle tunnels, got %+v", st)
+	}
+	for _, s := range m.Status() {
+		if s.Hostname == "cft-a.example.com" && s.Replicas[0].State != string(replicaReady) {
+			t.Fatalf("expected a to stay ready, got %+v", s)
+		}
+	}
+}
+
+func TestMaxTunnelsForgetsStoppedHostnames(t *testing.T) {
+	m := newLimitedManager(t, 0)
+
+	busy, err := m.GetOrStart("busy.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart busy: %v", err)
+	}
+	defer busy.Release()
+	// A burst of distinct hostnames that are all turned away must not leave a node behind for each.
+	for i := 0; i < 50; i++ {
+		if _, err := m.GetOrStart(fmt.Sprintf("h%d.example.com", i), TunnelOptions{}); !errors.Is(err, ErrTooManyTunnels) {
+			t.Fatalf("expected ErrTooManyTunnels, got %v", err)
+		}
+	}
+	if n := len(m.Status()); n != 1 {
+		t.Fatalf("rejected hostnames should be forgotten, %d nodes left", n)
+	}
+
+	// An evicted tunnel is forgotten once its process has been reaped.
+	busy.Release()
+	other, err := m.GetOrStart("other.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart other: %v", err)
+	}
+	defer other.Release()
+	waitForStatus(t, m, "evicted tunnel to be forgotten", func(s []TunnelStatus) bool {
+		return len(s) == 1 && s[0].Hostname == "cft-other.example.com"
+	})
+}
+
+func TestMaxTunnelsWaitHonoursContext(t *testing.T) {
+	m := newLimitedManager(t, time.Minute)
+
+	a, err := m.GetOrStart("a.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart a: %v", err)
+	}
+	defer a.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := m.GetOrStartContext(ctx, "b.example.com", TunnelOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller's deadline, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("queued caller kept waiting %s after its context was done", waited)
+	}
+	if st := m.TunnelStats(); st.Waiting != 0 || st.Rejected != 0 {
+		t.Fatalf("unexpected tunnel stats %+v", st)
+	}
+}
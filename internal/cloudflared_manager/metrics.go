@@ -0,0 +1,144 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// metricsProbe queries the cloudflared --metrics listener. cloudflared only reports /ready once its edge
+// connection works, unlike the local TCP listener which accepts immediately.
+type metricsProbe struct {
+	client     *http.Client
+	base       string
+	tunnelAddr string
+}
+
+type readyResponse struct {
+	Status           int `json:"status"`
+	ReadyConnections int `json:"readyConnections"`
+}
+
+func newMetricsProbe(metricsAddr, tunnelAddr string) *metricsProbe {
+	return &metricsProbe{
+		client:     &http.Client{Timeout: 2 * time.Second},
+		base:       "http://" + metricsAddr,
+		tunnelAddr: tunnelAddr,
+	}
+}
+
+// check returns nil when cloudflared reports itself ready. Builds without a /ready endpoint fall back to a
+// healthy /metrics response plus an accepting local listener.
+func (p *metricsProbe) check(ctx context.Context) error {
+	status, body, err := p.get(ctx, "/ready")
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return p.checkFallback(ctx)
+	}
+	var rr readyResponse
+	if json.Unmarshal(body, &rr) == nil && rr.Status != 0 {
+		return fmt.Errorf("cloudflared not ready (status=%d readyConnections=%d)", rr.Status, rr.ReadyConnections)
+	}
+	return fmt.Errorf("cloudflared /ready returned HTTP %d", status)
+}
+
+func (p *metricsProbe) checkFallback(ctx context.Context) error {
+	status, _, err := p.get(ctx, "/metrics")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("cloudflared /metrics returned HTTP %d", status)
+	}
+	dialer := net.Dialer{Timeout: 500 * time.Millisecond}
+	conn, err := dialer.DialContext(ctx, "tcp", p.tunnelAddr)
+	if err != nil {
+		return fmt.Errorf("tunnel listener %s not accepting: %w", p.tunnelAddr, err)
+	}
+	conn.Close()
+	return nil
+}
+
+func (p *metricsProbe) get(ctx context.Context, path string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.base+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, body, nil
+}
+
+// waitForReady polls the metrics endpoint until cloudflared reports ready or the timeout elapses.
+func waitForReady(ctx context.Context, probe *metricsProbe, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probe.check(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for cloudflared readiness: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+}
+
+// monitorLiveness periodically re-checks a running replica and kills its cloudflared after consecutive failures
+// while the hostname has clients; the exit handler then restarts it. Idle tunnels are left to the idle timer.
+func (m *NodeManager) monitorLiveness(ctx context.Context, r *replica, probe *metricsProbe, proc processKiller) {
+	ticker := time.NewTicker(m.livenessInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := probe.check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		m.logger.Errorf("liveness check failed for %s replica %d (%d/%d): %v", r.node.hostname, r.index, failures, m.livenessFailures, err)
+		if failures < m.livenessFailures {
+			continue
+		}
+		failures = 0
+		m.mu.Lock()
+		active := r.node.refCount
+		m.mu.Unlock()
+		if active == 0 {
+			continue
+		}
+		m.logger.Errorf("cloudflared for %s replica %d reported unhealthy with %d active connections; restarting", r.node.hostname, r.index, active)
+		_ = proc.Kill()
+		return
+	}
+}
+
+type processKiller interface {
+	Kill() error
+}
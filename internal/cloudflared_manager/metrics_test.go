@@ -0,0 +1,106 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricsProbeReady(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			http.NotFound(w, r)
+			return
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"status":503,"readyConnections":0}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":200,"readyConnections":1}`))
+	}))
+	defer srv.Close()
+
+	probe := newMetricsProbe(strings.TrimPrefix(srv.URL, "http://"), "127.0.0.1:1")
+	err := probe.check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "status=503") {
+		t.Fatalf("expected not-ready error, got %v", err)
+	}
+	if err := waitForReady(context.Background(), probe, 5*time.Second); err != nil {
+		t.Fatalf("waitForReady error: %v", err)
+	}
+}
+
+func TestMetricsProbeFallsBackWithoutReadyEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			_, _ = w.Write([]byte("# HELP build_info\n"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	metricsAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	tunnelAddr := ln.Addr().String()
+	if err := newMetricsProbe(metricsAddr, tunnelAddr).check(context.Background()); err != nil {
+		t.Fatalf("expected fallback readiness with accepting listener, got %v", err)
+	}
+	ln.Close()
+	if err := newMetricsProbe(metricsAddr, tunnelAddr).check(context.Background()); err == nil {
+		t.Fatalf("expected fallback to fail once the tunnel listener is gone")
+	}
+}
+
+func TestWaitForReadyTimesOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	probe := newMetricsProbe(strings.TrimPrefix(srv.URL, "http://"), "127.0.0.1:1")
+	if err := waitForReady(context.Background(), probe, 100*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout")
+	}
+}
+
+type fakeProcess struct{ killed atomic.Bool }
+
+func (f *fakeProcess) Kill() error {
+	f.killed.Store(true)
+	return nil
+}
+
+func TestMonitorLivenessKillsUnhealthyBusyTunnel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	m, err := NewNodeManager(Config{
+		IdleTimeout: time.Minute, StartupTimeout: time.Second, PortRangeStart: 1, PortRangeEnd: 1,
+		LivenessInterval: 10 * time.Millisecond, LivenessFailures: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	rep := &replica{node: &nodeState{hostname: "cft-db.ratio1.link", refCount: 1}}
+	proc := &fakeProcess{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m.monitorLiveness(ctx, rep, newMetricsProbe(strings.TrimPrefix(srv.URL, "http://"), "127.0.0.1:1"), proc)
+	if !proc.killed.Load() {
+		t.Fatalf("expected unhealthy busy tunnel to be killed")
+	}
+}
@@ -0,0 +1,333 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// childRecord is one running cloudflared as persisted in the state file.
+type childRecord struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Replica   int       `json:"replica"`
+	Listen    string    `json:"listen"`
+	Metrics   string    `json:"metrics"`
+	StartedAt time.Time `json:"started_at"`
+	// ProcStart is the kernel's start time of the process, used to tell a reused PID from our child.
+	ProcStart uint64 `json:"proc_start,omitempty"`
+	// Args is the argv the process was launched with, rendered from the configured ArgsTemplate.
+	Args []string `json:"args,omitempty"`
+	// Pgid is the process group created for the child, or 0 if it shared the proxy's.
+	Pgid int `json:"pgid,omitempty"`
+}
+
+type stateFile struct {
+	Children []childRecord `json:"children"`
+}
+
+func readStateFile(path string) ([]childRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("parse state file %s: %w", path, err)
+	}
+	return sf.Children, nil
+}
+
+// writeStateFile replaces path atomically, so a crash mid-write leaves the previous contents.
+func writeStateFile(path string, children []childRecord) error {
+	if children == nil {
+		children = []childRecord{}
+	}
+	data, err := json.MarshalIndent(stateFile{Children: children}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// SetStateFile changes the state file path; "" stops persisting. A process handing over to its successor
+// stops writing so it does not clobber the new process's entries.
+func (m *NodeManager) SetStateFile(path string) {
+	m.stateMu.Lock()
+	m.stateFile = path
+	m.stateMu.Unlock()
+}
+
+// persistState writes every ready replica to the state file. It must be called without m.mu held.
+func (m *NodeManager) persistState() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if m.stateFile == "" {
+		return
+	}
+
+	var children []childRecord
+	m.mu.Lock()
+	for _, st := range m.nodes {
+		for _, r := range st.replicas {
+			if r.state != replicaReady || r.cmd == nil || r.cmd.Process == nil {
+				continue
+			}
+			children = append(children, childRecord{
+				PID:       r.cmd.Process.Pid,
+				Hostname:  st.hostname,
+				Replica:   r.index,
+				Listen:    r.addrs.listen.String(),
+				Metrics:   r.addrs.metrics.String(),
+				StartedAt: r.startedAt,
+				ProcStart: r.procStart,
+				Args:      r.cmd.Args,
+				Pgid:      r.pgid,
+			})
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Hostname != children[j].Hostname {
+			return children[i].Hostname < children[j].Hostname
+		}
+		return children[i].Replica < children[j].Replica
+	})
+	if err := writeStateFile(m.stateFile, children); err != nil {
+		m.logger.Errorf("failed to write state file %s: %v", m.stateFile, err)
+	}
+}
+
+// RecoverOrphans deals with the cloudflared processes a previous run left behind, as listed in the state file.
+// Healthy ones whose addresses fit the current allocator are adopted as idle tunnels; the rest are killed so
+// their ports return to the pool. Call it once, before serving connections.
+func (m *NodeManager) RecoverOrphans(ctx context.Context) error {
+	m.stateMu.Lock()
+	path := m.stateFile
+	m.stateMu.Unlock()
+	if path == "" {
+		return nil
+	}
+	children, err := readStateFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var adopted, killed int
+	for _, rec := range children {
+		if err := verifyOrphan(rec); err != nil {
+			if strayGroup(rec) {
+				m.logger.Errorf("Killing process group %d left by %s replica %d (pid %d): %v", rec.Pgid, rec.Hostname, rec.Replica, rec.PID, err)
+				killOrphan(rec)
+				killed++
+				continue
+			}
+			m.logger.Infof("Ignoring state entry for %s replica %d (pid %d): %v", rec.Hostname, rec.Replica, rec.PID, err)
+			continue
+		}
+		if err := m.adoptOrphan(ctx, rec); err != nil {
+			m.logger.Errorf("Killing orphaned cloudflared for %s replica %d (pid %d): %v", rec.Hostname, rec.Replica, rec.PID, err)
+			killOrphan(rec)
+			killed++
+			continue
+		}
+		m.logger.Infof("Adopted orphaned cloudflared for %s replica %d (pid %d) on %s", rec.Hostname, rec.Replica, rec.PID, rec.Listen)
+		adopted++
+	}
+	if len(children) > 0 {
+		m.logger.Infof("Orphan recovery finished: %d adopted, %d killed", adopted, killed)
+	}
+	m.persistState()
+	return nil
+}
+
+// verifyOrphan checks that rec's PID is still the process we launched, not a reused PID. The kernel start time
+// identifies it whatever its command line, so children of a custom ArgsTemplate or a wrapper that execs
+// cloudflared are recognized too; the recorded argv is only compared when no start time was recorded.
+func verifyOrphan(rec childRecord) error {
+	if !processAlive(rec.PID) {
+		return errors.New("process is not running")
+	}
+	start, err := procStartTime(rec.PID)
+	if err != nil {
+		return err
+	}
+	if rec.ProcStart != 0 {
+		if start != rec.ProcStart {
+			return errors.New("pid belongs to a different process")
+		}
+		return nil
+	}
+	args, err := procCmdline(rec.PID)
+	if err != nil {
+		return err
+	}
+	if len(rec.Args) == 0 || !slices.Equal(args, rec.Args) {
+		return errors.New("pid is not the cloudflared launched for this tunnel")
+	}
+	return nil
+}
+
+// strayGroup reports whether rec's process is gone but left members in the process group we created for it,
+// such as cloudflared forked by a wrapper script. The kernel does not hand out a PID while a group with that ID
+// exists, so the group is still ours.
+func strayGroup(rec childRecord) bool {
+	return rec.Pgid != 0 && !processAlive(rec.PID) && processGroupAlive(rec.Pgid)
+}
+
+// adoptOrphan takes over a verified orphan as a ready replica. On error nothing has been taken over.
+func (m *NodeManager) adoptOrphan(ctx context.Context, rec childRecord) error {
+	listen, err := netip.ParseAddrPort(rec.Listen)
+	if err != nil {
+		return err
+	}
+	metrics, err := netip.ParseAddrPort(rec.Metrics)
+	if err != nil {
+		return err
+	}
+	if rec.Replica < 0 || rec.Replica >= MaxReplicas {
+		return fmt.Errorf("replica index %d out of range", rec.Replica)
+	}
+	m.mu.Lock()
+	startupTimeout := m.startupTimeout
+	m.mu.Unlock()
+	probe := newMetricsProbe(metrics.String(), listen.String())
+	checkCtx, cancelCheck := context.WithTimeout(ctx, startupTimeout)
+	err = probe.check(checkCtx)
+	cancelCheck()
+	if err != nil {
+		return fmt.Errorf("not healthy: %w", err)
+	}
+	proc, err := os.FindProcess(rec.PID)
+	if err != nil {
+		return err
+	}
+	addrs := tunnelAddrs{listen: listen, metrics: metrics}
+	if !m.addrs.claim(addrs) {
+		return fmt.Errorf("addresses %s/%s are outside the configured range or already in use", listen, metrics)
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		m.addrs.release(addrs)
+		return errors.New("node manager shutting down")
+	}
+	st, ok := m.nodes[rec.Hostname]
+	if !ok {
+		st = &nodeState{hostname: rec.Hostname, changed: make(chan struct{})}
+	}
+	if m.maxTunnels > 0 && !st.liveLocked() && m.liveTunnelsLocked() >= m.maxTunnels {
+		m.mu.Unlock()
+		m.addrs.release(addrs)
+		return fmt.Errorf("tunnel cap of %d reached", m.maxTunnels)
+	}
+	m.nodes[rec.Hostname] = st
+	for len(st.replicas) <= rec.Replica {
+		st.replicas = append(st.replicas, &replica{node: st, index: len(st.replicas), state: replicaStopped})
+	}
+	r := st.replicas[rec.Replica]
+	if r.state != replicaStopped {
+		m.mu.Unlock()
+		m.addrs.release(addrs)
+		return errors.New("replica already running")
+	}
+
+	// There is no exec.Cmd to Wait on for a process we did not start; a stand-in carries the Process so the
+	// rest of the manager can signal and identify it, and exits are detected by polling.
+	procCtx, cancel := context.WithCancel(context.Background())
+	cmd := &exec.Cmd{Path: "cloudflared", Args: rec.Args, Process: proc}
+	exited := make(chan struct{})
+	r.gen++
+	r.state = replicaReady
+	r.cmd = cmd
+	r.cancel = cancel
+	r.exited = exited
+	r.addrs = addrs
+	r.startErr = nil
+	r.restarts = 0
+	r.adopted = true
+	r.startedAt = rec.StartedAt
+	r.procStart = rec.ProcStart
+	r.pgid = rec.Pgid
+	st.lastUsed = m.now()
+	if st.refCount == 0 && st.idleTimer == nil {
+		hostname := st.hostname
+		st.idleTimer = time.AfterFunc(m.idleTimeout, func() {
+			m.stopNode(hostname, false)
+		})
+	}
+	st.notifyLocked()
+	m.mu.Unlock()
+
+	go watchAdopted(procCtx, rec, proc, exited)
+	go m.monitorLiveness(procCtx, r, probe, proc)
+	go func() {
+		<-exited
+		cancel()
+		m.logger.Errorf("adopted cloudflared exited for %s replica %d", rec.Hostname, r.index)
+		m.handleProcessExit(r, cmd, errors.New("adopted process exited"))
+	}()
+	return nil
+}
+
+// watchAdopted closes exited once rec's process is gone, killing it first if ctx is cancelled.
+func watchAdopted(ctx context.Context, rec childRecord, proc *os.Process, exited chan struct{}) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	done := ctx.Done()
+	for processAlive(rec.PID) {
+		select {
+		case <-done:
+			if rec.Pgid == 0 || killProcessGroup(rec.Pgid) != nil {
+				_ = proc.Kill()
+			}
+			done = nil
+		case <-ticker.C:
+		}
+	}
+	close(exited)
+}
+
+// killOrphan kills rec's process, or the whole process group we created for it, and waits briefly for it to
+// go away so its ports can be reused.
+func killOrphan(rec childRecord) {
+	if rec.Pgid == 0 || killProcessGroup(rec.Pgid) != nil {
+		if proc, err := os.FindProcess(rec.PID); err == nil {
+			_ = proc.Kill()
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for (processAlive(rec.PID) || (rec.Pgid != 0 && processGroupAlive(rec.Pgid))) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,211 @@
+//go:build linux
+
+package cloudflaredmanager
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRecoverOrphansAdoptsHealthyTunnel(t *testing.T) {
+	fakeReadyCloudflared(t)
+	state := filepath.Join(t.TempDir(), "state.json")
+	cfg := Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45200,
+		PortRangeEnd:   45300,
+		StateFile:      state,
+	}
+
+	// The first manager is abandoned without shutdown, as if the proxy had crashed.
+	old, err := NewNodeManager(cfg)
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	lease, err := old.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	lease.Release()
+	pid := old.Status()[0].Replicas[0].PID
+	// The state file is written just after the lease is handed out.
+	recs, err := readStateFile(state)
+	for deadline := time.Now().Add(5 * time.Second); len(recs) == 0 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		recs, err = readStateFile(state)
+	}
+	if err != nil || len(recs) != 1 || recs[0].PID != pid || recs[0].ProcStart == 0 {
+		t.Fatalf("unexpected state file: %+v (%v)", recs, err)
+	}
+
+	m, err := NewNodeManager(cfg)
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	if err := m.RecoverOrphans(context.Background()); err != nil {
+		t.Fatalf("RecoverOrphans: %v", err)
+	}
+	status := m.Status()
+	if len(status) != 1 || status[0].Replicas[0].State != "ready" || !status[0].Replicas[0].Adopted || status[0].Replicas[0].PID != pid {
+		t.Fatalf("expected the orphan to be adopted, got %+v", status)
+	}
+	if ps := m.PortStats(); ps.InUse != 2 {
+		t.Fatalf("adopted ports should be claimed, got %+v", ps)
+	}
+
+	adopted, err := m.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart on adopted tunnel: %v", err)
+	}
+	if adopted.Addr != lease.Addr {
+		t.Fatalf("expected the adopted address %s, got %s", lease.Addr, adopted.Addr)
+	}
+	conn, err := net.Dial("tcp", adopted.Addr.String())
+	if err != nil {
+		t.Fatalf("dial adopted tunnel: %v", err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through adopted tunnel failed: %q (%v)", buf, err)
+	}
+	conn.Close()
+	adopted.Release()
+
+	m.Shutdown(context.Background())
+	if processAlive(pid) {
+		t.Fatalf("adopted cloudflared %d still running after shutdown", pid)
+	}
+	if recs, err := readStateFile(state); err != nil || len(recs) != 0 {
+		t.Fatalf("state file should be empty after shutdown, got %+v (%v)", recs, err)
+	}
+	old.Shutdown(context.Background())
+}
+
+func TestRecoverOrphansKillsUnhealthyTunnel(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	rec := childRecord{Hostname: "cft-db.example.com", Listen: "127.0.0.1:45310", Metrics: "127.0.0.1:45311"}
+	orphan := exec.Command(exe, "access", "tcp", "--hostname", rec.Hostname, "--url", rec.Listen, "--metrics", rec.Metrics)
+	orphan.Env = append(os.Environ(), "FAKE_CLOUDFLARED=hang")
+	if err := orphan.Start(); err != nil {
+		t.Fatalf("start orphan: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() { _ = orphan.Wait(); close(exited) }()
+	t.Cleanup(func() { _ = orphan.Process.Kill(); <-exited })
+
+	rec.PID = orphan.Process.Pid
+	rec.ProcStart, err = procStartTime(rec.PID)
+	if err != nil {
+		t.Fatalf("procStartTime: %v", err)
+	}
+	state := filepath.Join(t.TempDir(), "state.json")
+	// A second entry whose PID was reused by an unrelated process (this test) must be left alone.
+	reused := childRecord{PID: os.Getpid(), Hostname: "cft-other.example.com", Listen: "127.0.0.1:45312", Metrics: "127.0.0.1:45313", ProcStart: 1}
+	if err := writeStateFile(state, []childRecord{rec, reused}); err != nil {
+		t.Fatalf("writeStateFile: %v", err)
+	}
+
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 500 * time.Millisecond,
+		PortRangeStart: 45300,
+		PortRangeEnd:   45400,
+		StateFile:      state,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+	if err := m.RecoverOrphans(context.Background()); err != nil {
+		t.Fatalf("RecoverOrphans: %v", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unhealthy orphan was not killed")
+	}
+	if len(m.Status()) != 0 {
+		t.Fatalf("nothing should have been adopted, got %+v", m.Status())
+	}
+	if ps := m.PortStats(); ps.InUse != 0 {
+		t.Fatalf("ports of the killed orphan must not stay claimed, got %+v", ps)
+	}
+	if recs, err := readStateFile(state); err != nil || len(recs) != 0 {
+		t.Fatalf("state file should be rewritten empty, got %+v (%v)", recs, err)
+	}
+}
+
+func TestRecoverOrphansKillsCustomCommandsAndStrayGroups(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	// An orphan launched from a custom ArgsTemplate: its command line has no "--hostname <host>" pair.
+	custom := childRecord{Hostname: "cft-db.example.com", Listen: "127.0.0.1:45410", Metrics: "127.0.0.1:45411"}
+	orphan := exec.Command(exe, "access", "tcp", "--hostname="+custom.Hostname, "--url="+custom.Listen)
+	orphan.Env = append(os.Environ(), "FAKE_CLOUDFLARED=hang")
+	orphan.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := orphan.Start(); err != nil {
+		t.Fatalf("start orphan: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() { _ = orphan.Wait(); close(exited) }()
+	t.Cleanup(func() { _ = orphan.Process.Kill(); <-exited })
+	custom.PID, custom.Pgid, custom.Args = orphan.Process.Pid, orphan.Process.Pid, orphan.Args
+	if custom.ProcStart, err = procStartTime(custom.PID); err != nil {
+		t.Fatalf("procStartTime: %v", err)
+	}
+
+	// A wrapper that forked cloudflared and exited, leaving it behind in the group created for the wrapper.
+	wrapper := exec.Command("/bin/sh", "-c", "sleep 60 >/dev/null 2>&1 &")
+	wrapper.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := wrapper.Run(); err != nil {
+		t.Fatalf("run wrapper: %v", err)
+	}
+	stray := childRecord{PID: wrapper.Process.Pid, Pgid: wrapper.Process.Pid, Hostname: "cft-other.example.com", Listen: "127.0.0.1:45412", Metrics: "127.0.0.1:45413", ProcStart: 1}
+	if !processGroupAlive(stray.Pgid) {
+		t.Fatalf("the process forked by the wrapper should still be running")
+	}
+	t.Cleanup(func() { _ = killProcessGroup(stray.Pgid) })
+
+	state := filepath.Join(t.TempDir(), "state.json")
+	if err := writeStateFile(state, []childRecord{custom, stray}); err != nil {
+		t.Fatalf("writeStateFile: %v", err)
+	}
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 500 * time.Millisecond,
+		PortRangeStart: 45400,
+		PortRangeEnd:   45500,
+		StateFile:      state,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+	if err := m.RecoverOrphans(context.Background()); err != nil {
+		t.Fatalf("RecoverOrphans: %v", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unhealthy orphan with a custom command line was not killed")
+	}
+	if processGroupAlive(stray.Pgid) {
+		t.Fatalf("process group %d left by the wrapper was not killed", stray.Pgid)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+var errOrphanUnsupported = fmt.Errorf("cannot verify process identity on %s", runtime.GOOS)
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	return err == nil && proc.Signal(syscall.Signal(0)) == nil
+}
+
+func procStartTime(pid int) (uint64, error) { return 0, errOrphanUnsupported }
+
+func procCmdline(pid int) ([]string, error) { return nil, errOrphanUnsupported }
+
+func processGroupAlive(pgid int) bool { return false }
+
+func killProcessGroup(pgid int) error { return errOrphanUnsupported }
@@ -0,0 +1,55 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	want := []childRecord{{
+		PID:       1234,
+		Hostname:  "cft-db.example.com",
+		Replica:   1,
+		Listen:    "127.0.0.1:20000",
+		Metrics:   "127.0.0.1:20001",
+		StartedAt: time.Unix(1000, 0).UTC(),
+		ProcStart: 42,
+	}}
+	if err := writeStateFile(path, want); err != nil {
+		t.Fatalf("writeStateFile: %v", err)
+	}
+	got, err := readStateFile(path)
+	if err != nil {
+		t.Fatalf("readStateFile: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp*"))
+	if len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestRecoverOrphansWithoutStateFile(t *testing.T) {
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: time.Second,
+		PortRangeStart: 42000,
+		PortRangeEnd:   42100,
+		StateFile:      filepath.Join(t.TempDir(), "missing.json"),
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	if err := m.RecoverOrphans(context.Background()); err != nil {
+		t.Fatalf("missing state file should not be an error, got %v", err)
+	}
+	if len(m.Status()) != 0 {
+		t.Fatalf("nothing should have been adopted")
+	}
+}
@@ -0,0 +1,205 @@
+package cloudflaredmanager
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// portPool hands out integer slots (ports, or host offsets in loopback mode) from a fixed range in O(1).
+// Never-used slots are taken from a cursor, so large ranges need no upfront allocation; released slots sit in a
+// quarantine queue for a while, so a new tunnel does not bind an endpoint whose previous connections are still
+// in TIME_WAIT, and are then reused in FIFO order.
+type portPool struct {
+	mu    sync.Mutex
+	start int
+	end   int
+
+	next          int // lowest slot never handed out
+	claimedAhead  int // claimed slots at or above next, skipped when the cursor reaches them
+	free          []int
+	quarantine    []quarantinedPort
+	quarantineFor time.Duration
+	inUse         map[int]struct{}
+
+	now   func() time.Time
+	probe func(port int) bool
+
+	reservations  uint64
+	exhausted     uint64
+	busySkipped   uint64
+	bindConflicts uint64
+}
+
+// maxProbeAttempts bounds how many busy candidates one reservation skips, so a mostly unusable range (e.g. loopback
+// addresses that are not configured) fails fast instead of probing every slot.
+const maxProbeAttempts = 64
+
+type quarantinedPort struct {
+	port  int
+	until time.Time
+}
+
+// PortStats reports utilization of the tunnel address allocator. In loopback mode each slot is one address.
+type PortStats struct {
+	Mode          string  `json:"mode"` // ports | loopback
+	Range         string  `json:"range"`
+	Size          int     `json:"size"`
+	InUse         int     `json:"in_use"`
+	Free          int     `json:"free"`
+	Quarantined   int     `json:"quarantined"`
+	Utilization   float64 `json:"utilization"`
+	Reservations  uint64  `json:"reservations_total"`
+	Exhausted     uint64  `json:"exhausted_total"`
+	BusySkipped   uint64  `json:"busy_skipped_total"`
+	BindConflicts uint64  `json:"bind_conflicts_total"`
+}
+
+func newPortPool(start, end int) *portPool {
+	return &portPool{
+		start: start,
+		end:   end,
+		next:  start,
+		inUse: make(map[int]struct{}),
+		now:   time.Now,
+		probe: isPortAvailable,
+	}
+}
+
+// reserve returns a slot that is not handed out and currently bindable. Slots found busy (bound by another
+// process) are quarantined and skipped. When every other slot is quarantined, the longest-quarantined one is
+// borrowed rather than failing.
+func (p *portPool) reserve() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.promoteLocked()
+	attempts := min(p.end-p.next+1+len(p.free)+len(p.quarantine), maxProbeAttempts)
+	for ; attempts > 0; attempts-- {
+		var port int
+		switch {
+		case p.next <= p.end:
+			port = p.next
+			p.next++
+			if _, claimed := p.inUse[port]; claimed {
+				p.claimedAhead--
+				continue
+			}
+		case len(p.free) > 0:
+			port, p.free = p.free[0], p.free[1:]
+		case len(p.quarantine) > 0:
+			port, p.quarantine = p.quarantine[0].port, p.quarantine[1:]
+		}
+		if !p.probe(port) {
+			p.busySkipped++
+			p.quarantineLocked(port)
+			continue
+		}
+		p.inUse[port] = struct{}{}
+		p.reservations++
+		return port, nil
+	}
+	p.exhausted++
+	return 0, fmt.Errorf("no free slots in range %d-%d", p.start, p.end)
+}
+
+// claim marks a specific slot in use, e.g. one still held by an adopted cloudflared. It fails if the slot is
+// outside the range or already handed out.
+func (p *portPool) claim(port int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if port < p.start || port > p.end {
+		return false
+	}
+	if _, ok := p.inUse[port]; ok {
+		return false
+	}
+	if port >= p.next {
+		p.claimedAhead++
+	} else {
+		for i, f := range p.free {
+			if f == port {
+				p.free = append(p.free[:i], p.free[i+1:]...)
+				break
+			}
+		}
+		for i, q := range p.quarantine {
+			if q.port == port {
+				p.quarantine = append(p.quarantine[:i], p.quarantine[i+1:]...)
+				break
+			}
+		}
+	}
+	p.inUse[port] = struct{}{}
+	return true
+}
+
+// release returns a port to the pool via quarantine. Releasing a port that is not reserved is a no-op.
+func (p *portPool) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.inUse[port]; !ok {
+		return
+	}
+	delete(p.inUse, port)
+	p.quarantineLocked(port)
+}
+
+// releaseConflicted releases a port that cloudflared failed to bind.
+func (p *portPool) releaseConflicted(port int) {
+	p.mu.Lock()
+	if _, ok := p.inUse[port]; ok {
+		p.bindConflicts++
+	}
+	p.mu.Unlock()
+	p.release(port)
+}
+
+func (p *portPool) stats() PortStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.promoteLocked()
+	size := p.end - p.start + 1
+	return PortStats{
+		Size:          size,
+		InUse:         len(p.inUse),
+		Free:          len(p.free) + p.end - p.next + 1 - p.claimedAhead,
+		Quarantined:   len(p.quarantine),
+		Utilization:   float64(len(p.inUse)) / float64(size),
+		Reservations:  p.reservations,
+		Exhausted:     p.exhausted,
+		BusySkipped:   p.busySkipped,
+		BindConflicts: p.bindConflicts,
+	}
+}
+
+func (p *portPool) quarantineLocked(port int) {
+	if p.quarantineFor <= 0 {
+		p.free = append(p.free, port)
+		return
+	}
+	p.quarantine = append(p.quarantine, quarantinedPort{port: port, until: p.now().Add(p.quarantineFor)})
+}
+
+// promoteLocked moves ports whose quarantine has expired to the free queue. Entries are appended with a
+// constant duration, so the queue is ordered by expiry.
+func (p *portPool) promoteLocked() {
+	now := p.now()
+	for len(p.quarantine) > 0 && !now.Before(p.quarantine[0].until) {
+		p.free = append(p.free, p.quarantine[0].port)
+		p.quarantine = p.quarantine[1:]
+	}
+}
+
+func isPortAvailable(port int) bool {
+	if port <= 0 {
+		return false
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	_ = ln.Close()
+	return true
+}
@@ -3,6 +3,7 @@ package cloudflaredmanager
 import (
 	"net"
 	"testing"
+	"time"
 )
 
 func TestPortPoolReserveAndRelease(t *testing.T) {
@@ -37,3 +38,96 @@ func TestPortPoolReserveAndRelease(t *testing.T) {
 		t.Fatalf("expected to reuse port %d after release, got %d", port, second)
 	}
 }
+
+func newTestPool(start, end int) (*portPool, *time.Time) {
+	now := time.Unix(1000, 0)
+	p := newPortPool(start, end)
+	p.now = func() time.Time { return now }
+	p.probe = func(int) bool { return true }
+	return p, &now
+}
+
+func TestPortPoolQuarantine(t *testing.T) {
+	pool, now := newTestPool(100, 101)
+	pool.quarantineFor = time.Minute
+
+	a, _ := pool.reserve()
+	b, _ := pool.reserve()
+	if a != 100 || b != 101 {
+		t.Fatalf("expected ports in range order, got %d %d", a, b)
+	}
+	pool.release(a)
+	pool.release(a) // double release is ignored
+
+	st := pool.stats()
+	if st.InUse != 1 || st.Quarantined != 1 || st.Free != 0 || st.Utilization != 0.5 {
+		t.Fatalf("unexpected stats after release: %+v", st)
+	}
+
+	// With nothing free, the quarantined port is borrowed rather than failing.
+	if p, err := pool.reserve(); err != nil || p != a {
+		t.Fatalf("expected to borrow quarantined port %d, got %d (%v)", a, p, err)
+	}
+	if _, err := pool.reserve(); err == nil {
+		t.Fatalf("expected exhaustion")
+	}
+
+	pool.release(a)
+	pool.release(b)
+	*now = now.Add(30 * time.Second)
+	if st := pool.stats(); st.Quarantined != 2 {
+		t.Fatalf("ports left quarantine early: %+v", st)
+	}
+	*now = now.Add(31 * time.Second)
+	st = pool.stats()
+	if st.Quarantined != 0 || st.Free != 2 || st.Reservations != 3 || st.Exhausted != 1 {
+		t.Fatalf("unexpected stats after quarantine expiry: %+v", st)
+	}
+	// Expired ports return in release order.
+	if p, _ := pool.reserve(); p != a {
+		t.Fatalf("expected FIFO reuse of %d, got %d", a, p)
+	}
+}
+
+func TestPortPoolSkipsBusyPorts(t *testing.T) {
+	pool, _ := newTestPool(200, 202)
+	pool.probe = func(port int) bool { return port != 200 }
+
+	if p, err := pool.reserve(); err != nil || p != 201 {
+		t.Fatalf("expected busy port to be skipped, got %d (%v)", p, err)
+	}
+	pool.releaseConflicted(201)
+	st := pool.stats()
+	if st.BusySkipped != 1 || st.BindConflicts != 1 || st.InUse != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestPortPoolClaim(t *testing.T) {
+	pool, _ := newTestPool(300, 303)
+
+	a, _ := pool.reserve() // 300
+	pool.release(a)
+	if !pool.claim(a) || !pool.claim(302) {
+		t.Fatalf("expected to claim a free and a never-used slot")
+	}
+	if pool.claim(302) || pool.claim(299) || pool.claim(304) {
+		t.Fatalf("claim must reject taken or out-of-range slots")
+	}
+	if st := pool.stats(); st.InUse != 2 || st.Free != 2 {
+		t.Fatalf("unexpected stats after claims: %+v", st)
+	}
+	// The cursor skips the claimed slot.
+	if p, _ := pool.reserve(); p != 301 {
+		t.Fatalf("expected 301, got %d", p)
+	}
+	if p, _ := pool.reserve(); p != 303 {
+		t.Fatalf("expected claimed 302 to be skipped, got %d", p)
+	}
+	if _, err := pool.reserve(); err == nil {
+		t.Fatalf("expected exhaustion")
+	}
+	if st := pool.stats(); st.Free != 0 {
+		t.Fatalf("expected no free slots, got %+v", st)
+	}
+}
@@ -0,0 +1,38 @@
+package cloudflaredmanager
+
+import "time"
+
+// Tunables are the NodeManager settings that can change while tunnels are running.
+type Tunables struct {
+	IdleTimeout    time.Duration
+	StartupTimeout time.Duration
+	Restart        RestartPolicy
+}
+
+// Reconfigure applies t without touching running tunnels: the new values take effect at the next launch,
+// restart or idle period, so an idle timer already running keeps its old deadline. Zero durations are ignored,
+// as is a zero Restart; otherwise zero fields of Restart take DefaultRestartPolicy's values.
+func (m *NodeManager) Reconfigure(t Tunables) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.IdleTimeout > 0 {
+		m.idleTimeout = t.IdleTimeout
+	}
+	if t.StartupTimeout > 0 {
+		m.startupTimeout = t.StartupTimeout
+	}
+	if t.Restart != (RestartPolicy{}) {
+		m.restart = t.Restart.withDefaults()
+	}
+}
+
+// Tunables returns the values currently in effect.
+func (m *NodeManager) Tunables() Tunables {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Tunables{
+		IdleTimeout:    m.idleTimeout,
+		StartupTimeout: m.startupTimeout,
+		Restart:        m.restart,
+	}
+}
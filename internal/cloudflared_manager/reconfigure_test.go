@@ -0,0 +1,37 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReconfigureKeepsRunningTunnels(t *testing.T) {
+	fakeReadyCloudflared(t)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Hour,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45400,
+		PortRangeEnd:   45500,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+
+	lease, err := m.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	m.Reconfigure(Tunables{IdleTimeout: 100 * time.Millisecond, Restart: RestartPolicy{MaxRestarts: 7}})
+	if got := m.Tunables(); got.IdleTimeout != 100*time.Millisecond || got.Restart.MaxRestarts != 7 || got.Restart.Backoff != DefaultRestartPolicy.Backoff || got.StartupTimeout != 10*time.Second {
+		t.Fatalf("unexpected tunables after reconfigure: %+v", got)
+	}
+	if s := m.Status(); len(s) != 1 || s[0].ActiveConnections != 1 || !replicasReady(1)(s) {
+		t.Fatalf("reconfigure should leave the running tunnel alone, got %+v", s)
+	}
+
+	// The next idle period uses the new timeout.
+	lease.Release()
+	waitForStatus(t, m, "idle tunnel to stop", func(s []TunnelStatus) bool { return len(s) == 0 })
+}
@@ -0,0 +1,101 @@
+package cloudflaredmanager
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRestartsExhausted is why leases on a replica fail once it crashes more often than the RestartPolicy allows.
+var ErrRestartsExhausted = errors.New("cloudflared restarts exhausted")
+
+// RestartPolicy decides when a crashed cloudflared is relaunched. Delays grow exponentially from Backoff up to
+// MaxBackoff, and a replica that crashes more than MaxRestarts times within Window is treated as crash-looping
+// and given up until the oldest of those crashes leaves the window.
+type RestartPolicy struct {
+	// Backoff is the delay before the first restart; each further crash in the window doubles it.
+	Backoff time.Duration
+	// MaxBackoff caps the delay.
+	MaxBackoff time.Duration
+	// Jitter spreads each delay by up to this fraction either way (0.2 means ±20%) so replicas that crashed
+	// together do not restart in lockstep. It is clamped to [0, 1].
+	Jitter float64
+	// MaxRestarts is the number of crashes tolerated within Window.
+	MaxRestarts int
+	// Window is how far back crashes are counted.
+	Window time.Duration
+}
+
+// DefaultRestartPolicy is used for zero fields of Config.Restart.
+var DefaultRestartPolicy = RestartPolicy{
+	Backoff:     2 * time.Second,
+	MaxBackoff:  time.Minute,
+	Jitter:      0.2,
+	MaxRestarts: 3,
+	Window:      5 * time.Minute,
+}
+
+// withDefaults fills zero fields from DefaultRestartPolicy. Jitter has no zero default so it can be disabled,
+// but is clamped; MaxBackoff is raised to Backoff when smaller.
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultRestartPolicy.Backoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = max(DefaultRestartPolicy.MaxBackoff, p.Backoff)
+	}
+	p.MaxBackoff = max(p.MaxBackoff, p.Backoff)
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	if p.MaxRestarts <= 0 {
+		p.MaxRestarts = DefaultRestartPolicy.MaxRestarts
+	}
+	if p.Window <= 0 {
+		p.Window = DefaultRestartPolicy.Window
+	}
+	return p
+}
+
+// delay is the wait before restarting after the n-th crash in the window (n >= 1). rnd is uniform in [0, 1).
+func (p RestartPolicy) delay(n int, rnd float64) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rnd-1)))
+	}
+	return d
+}
+
+// crashLog remembers recent crash times of one replica. It is guarded by NodeManager.mu.
+type crashLog []time.Time
+
+// record adds a crash at now, forgets those older than window and returns how many remain.
+func (c *crashLog) record(now time.Time, window time.Duration) int {
+	cutoff := now.Add(-window)
+	kept := (*c)[:0]
+	for _, t := range *c {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	*c = append(kept, now)
+	return len(*c)
+}
+
+// clearsAt is when the oldest remembered crash leaves the window.
+func (c crashLog) clearsAt(window time.Duration) time.Time {
+	if len(c) == 0 {
+		return time.Time{}
+	}
+	return c[0].Add(window)
+}
+
+// failLeasesLocked fails every lease handed out for r so their connections are closed rather than left on a dead
+// port. Callers hold m.mu.
+func (r *replica) failLeasesLocked() {
+	if r.failed != nil {
+		close(r.failed)
+		r.failed = nil
+	}
+}
@@ -0,0 +1,99 @@
+package cloudflaredmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyDelay(t *testing.T) {
+	p := RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	p.Jitter = 0
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 60: 5 * time.Second} {
+		if got := p.delay(n, 0.5); got != want {
+			t.Fatalf("delay(%d) = %s, want %s", n, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	if lo, hi := p.delay(1, 0), p.delay(1, 0.999999); lo != 500*time.Millisecond || hi < 1499*time.Millisecond || hi > 1500*time.Millisecond {
+		t.Fatalf("jitter bounds: got %s..%s", lo, hi)
+	}
+}
+
+func TestRestartPolicyDefaults(t *testing.T) {
+	if got := (RestartPolicy{}).withDefaults(); got.Jitter != 0 || got.Backoff != DefaultRestartPolicy.Backoff || got.Window != DefaultRestartPolicy.Window {
+		t.Fatalf("unexpected defaults: %+v", got)
+	}
+	got := RestartPolicy{Backoff: 2 * time.Minute, MaxBackoff: time.Second, Jitter: 3}.withDefaults()
+	if got.MaxBackoff != 2*time.Minute || got.Jitter != 1 {
+		t.Fatalf("max backoff should be raised to backoff and jitter clamped, got %+v", got)
+	}
+}
+
+func TestCrashLogWindow(t *testing.T) {
+	var c crashLog
+	base := time.Unix(1000, 0)
+	for i, want := range []int{1, 2, 3} {
+		if n := c.record(base.Add(time.Duration(i)*time.Minute), 5*time.Minute); n != want {
+			t.Fatalf("crash %d: got %d in window, want %d", i, n, want)
+		}
+	}
+	if n := c.record(base.Add(6*time.Minute), 5*time.Minute); n != 2 {
+		t.Fatalf("crashes older than the window should be forgotten, got %d", n)
+	}
+	if at := c.clearsAt(5 * time.Minute); !at.Equal(base.Add(7 * time.Minute)) {
+		t.Fatalf("clearsAt = %s", at)
+	}
+}
+
+func TestCrashLoopFailsLeases(t *testing.T) {
+	fakeReadyCloudflared(t)
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: 10 * time.Second,
+		PortRangeStart: 45800,
+		PortRangeEnd:   45900,
+		Restart:        RestartPolicy{Backoff: 10 * time.Millisecond, MaxRestarts: 1, Window: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	defer m.Shutdown(context.Background())
+
+	lease, err := m.GetOrStart("db.example.com", TunnelOptions{})
+	if err != nil {
+		t.Fatalf("GetOrStart: %v", err)
+	}
+	defer lease.Release()
+	kill := func() {
+		m.mu.Lock()
+		_ = m.nodes["cft-db.example.com"].replicas[0].cmd.Process.Kill()
+		m.mu.Unlock()
+	}
+
+	// The first crash is within the limit and restarts the tunnel.
+	kill()
+	waitForStatus(t, m, "crashed replica to leave ready", replicasReady(0))
+	waitForStatus(t, m, "crashed replica to restart", replicasReady(1))
+	select {
+	case <-lease.Failed():
+		t.Fatalf("lease failed although the replica was restarted")
+	default:
+	}
+
+	// The second crash in the window exceeds it: the lease fails and new connections fail fast.
+	kill()
+	select {
+	case <-lease.Failed():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lease not failed after a crash loop")
+	}
+	if _, err := m.GetOrStart("db.example.com", TunnelOptions{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the breaker to fail fast, got %v", err)
+	}
+	if s := m.Status(); len(s) != 1 || s[0].Replicas[0].State != string(replicaStopped) {
+		t.Fatalf("crash-looping replica should stay stopped, got %+v", s)
+	}
+}
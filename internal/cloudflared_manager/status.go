@@ -0,0 +1,103 @@
+package cloudflaredmanager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TunnelStatus is a point-in-time view of one managed tunnel hostname.
+type TunnelStatus struct {
+	Hostname            string          `json:"hostname"`
+	ActiveConnections   int             `json:"active_connections"`
+	Breaker             string          `json:"breaker"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	BreakerRetryAt      *time.Time      `json:"breaker_retry_at,omitempty"`
+	Replicas            []ReplicaStatus `json:"replicas"`
+}
+
+// ReplicaStatus is a point-in-time view of one cloudflared replica.
+type ReplicaStatus struct {
+	Index             int    `json:"index"`
+	State             string `json:"state"` // stopped | starting | ready
+	PID               int    `json:"pid,omitempty"`
+	Addr              string `json:"addr,omitempty"`
+	MetricsAddr       string `json:"metrics_addr,omitempty"`
+	ActiveConnections int    `json:"active_connections"`
+	Restarts          int    `json:"restarts"`
+	Adopted           bool   `json:"adopted,omitempty"`
+	LastError         string `json:"last_error,omitempty"`
+	LastErrorCause    string `json:"last_error_cause,omitempty"`
+}
+
+// Status returns a snapshot of every hostname the manager has seen, sorted by hostname.
+func (m *NodeManager) Status() []TunnelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]TunnelStatus, 0, len(m.nodes))
+	for _, st := range m.nodes {
+		s := TunnelStatus{
+			Hostname:            st.hostname,
+			ActiveConnections:   st.refCount,
+			Breaker:             string(st.breaker.current()),
+			ConsecutiveFailures: st.breaker.failures,
+			Replicas:            make([]ReplicaStatus, 0, len(st.replicas)),
+		}
+		if st.breaker.current() == breakerOpen {
+			retryAt := st.breaker.openedAt.Add(m.breakerCooldown)
+			s.BreakerRetryAt = &retryAt
+		}
+		for _, r := range st.replicas {
+			rs := ReplicaStatus{
+				Index:             r.index,
+				State:             string(r.state),
+				ActiveConnections: r.active,
+				Restarts:          r.restarts,
+				Adopted:           r.adopted,
+				LastErrorCause:    string(r.lastErrCause),
+			}
+			if r.cmd != nil && r.cmd.Process != nil {
+				rs.PID = r.cmd.Process.Pid
+			}
+			if r.addrs.valid() {
+				rs.Addr = r.addrs.listen.String()
+				rs.MetricsAddr = r.addrs.metrics.String()
+			}
+			if r.state != replicaReady && r.startErr != nil {
+				rs.LastError = r.startErr.Error()
+			}
+			s.Replicas = append(s.Replicas, rs)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+// PortStats returns utilization counters for the tunnel address allocator.
+func (m *NodeManager) PortStats() PortStats {
+	return m.addrs.stats()
+}
+
+// CheckResponsive reports an error if the manager's lock cannot be taken within timeout, i.e. the manager is
+// wedged. Only one probe is outstanding at a time; while it is still waiting, later calls fail immediately.
+func (m *NodeManager) CheckResponsive(timeout time.Duration) error {
+	if !m.probing.CompareAndSwap(false, true) {
+		return errors.New("node manager lock still held since the previous check")
+	}
+	acquired := make(chan struct{})
+	go func() {
+		m.mu.Lock()
+		m.mu.Unlock()
+		m.probing.Store(false)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("node manager lock not acquired within %s", timeout)
+	}
+}
@@ -0,0 +1,38 @@
+package cloudflaredmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckResponsive(t *testing.T) {
+	m, err := NewNodeManager(Config{
+		IdleTimeout:    time.Minute,
+		StartupTimeout: time.Second,
+		PortRangeStart: 42000,
+		PortRangeEnd:   42100,
+	})
+	if err != nil {
+		t.Fatalf("NewNodeManager: %v", err)
+	}
+	if err := m.CheckResponsive(time.Second); err != nil {
+		t.Fatalf("idle manager should be responsive: %v", err)
+	}
+
+	m.mu.Lock()
+	if err := m.CheckResponsive(50 * time.Millisecond); err == nil {
+		t.Fatalf("expected an error while the lock is held")
+	}
+	if err := m.CheckResponsive(time.Second); err == nil {
+		t.Fatalf("expected an immediate error while the previous probe is still waiting")
+	}
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for m.CheckResponsive(time.Second) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("manager did not recover after the lock was released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,24 +2,72 @@ package connectionhandler
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"sync"
+	"os"
+	"sync/atomic"
+	"tcp-tunnel-proxy/internal/accesslog"
 	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
 	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/ratelimit"
+	"tcp-tunnel-proxy/internal/routes"
+	"tcp-tunnel-proxy/internal/tracing"
+	"tcp-tunnel-proxy/pkg/ech"
 	"time"
 )
 
-// handleConnection drives a single client flow: extract SNI, prepare tunnel, and proxy bytes.
-func HandleConnection(conn net.Conn, manager *cloudflaredmanager.NodeManager, readHelloTimeout time.Duration, logger *logging.Logger) {
+// Options carries per-connection settings shared by all connections of a listener.
+type Options struct {
+	ReadHelloTimeout time.Duration
+	Routes           *routes.Table
+	ECHKeys          *ech.KeySet     // nil disables ECH decryption
+	AccessLog        *accesslog.Sink // nil disables access logging
+	Limiters         *ratelimit.Registry
+	Tracer           *tracing.Tracer // nil disables tracing
+	// LogSampler rate-limits repeated failure messages per client address or tunnel; nil logs them all.
+	LogSampler *logging.Sampler
+}
+
+// handleConnection drives a single client flow: extract SNI, prepare tunnel, and proxy bytes. Every line it logs,
+// including those of the SNI helpers, carries the connection ID and client address, and the SNI and tunnel
+// hostname once they are known.
+func HandleConnection(conn net.Conn, manager *cloudflaredmanager.NodeManager, opts Options, logger *logging.Logger) {
 	defer conn.Close()
 
+	readHelloTimeout := opts.ReadHelloTimeout
+	start := time.Now()
+
 	remote := conn.RemoteAddr().String()
-	logger.Infof("Incoming connection %s", remote)
+	connID := newConnID()
+	logger = logger.With(logging.Field{Key: "conn_id", Value: connID}, logging.Field{Key: "client_addr", Value: remote})
+	logger.Debugf("Incoming connection %s", remote)
+
+	rec := accesslog.Record{Start: start, ClientAddr: remote, ClosedBy: "proxy"}
+	ctx, span := opts.Tracer.StartServer(context.Background(), "HandleConnection",
+		tracing.String("client.address", remote), tracing.String("connection.id", connID))
+	defer func() {
+		rec.Duration = time.Since(start)
+		opts.AccessLog.Log(rec)
+		span.SetAttributes(tracing.String("close.by", rec.ClosedBy), tracing.String("close.reason", rec.CloseReason),
+			tracing.Int("bytes.in", int(rec.BytesIn)), tracing.Int("bytes.out", int(rec.BytesOut)))
+		if rec.ClosedBy == "proxy" {
+			// The proxy refused or failed the connection.
+			span.RecordError(errors.New(rec.CloseReason))
+		}
+		span.End()
+	}()
 
 	_ = conn.SetReadDeadline(time.Now().Add(readHelloTimeout))
-	sni, buffers, sawPGSSLRequest, err := extractSNI(conn, readHelloTimeout)
+	_, sniSpan := opts.Tracer.Start(ctx, "extractSNI")
+	sni, hello, buffers, sawPGSSLRequest, err := extractSNI(conn, readHelloTimeout, logger.Component("sni"))
+	sniSpan.SetAttributes(tracing.Bool("postgres.ssl_request", sawPGSSLRequest))
+	sniSpan.RecordError(err)
+	sniSpan.End()
 	if buffers != nil {
 		defer func() {
 			putInitialBuffers(buffers)
@@ -27,28 +75,72 @@ func HandleConnection(conn net.Conn, manager *cloudflaredmanager.NodeManager, re
 	}
 	if err != nil {
 		_ = conn.SetReadDeadline(time.Time{})
-		logger.Errorf("SNI extraction failed for %s: %v (closing connection)", remote, err)
+		rec.CloseReason = fmt.Sprintf("sni extraction failed: %v", err)
+		logSampled(opts.LogSampler, "sni:"+clientIP(remote), logger.Warnf, "SNI extraction failed for %s: %v (closing connection)", remote, err)
 		if tlsErr := sendTLSAlert(conn, alertUnrecognizedName); tlsErr != nil {
-			logger.Errorf("failed to send TLS alert to %s: %v", remote, tlsErr)
+			logger.Debugf("failed to send TLS alert to %s: %v", remote, tlsErr)
 		}
 		return
 	}
 	_ = conn.SetReadDeadline(time.Time{})
-	_ = conn.SetReadDeadline(time.Time{})
+	sni, hello = resolveECH(opts.ECHKeys, sni, hello, remote, logger)
+	rec.SNI = sni
+	rec.TimeToSNI = time.Since(start)
+	logger = logger.With(logging.Field{Key: "sni", Value: sni})
+	span.SetAttributes(tracing.String("sni", sni))
+
+	logger.Debugf("Resolved %s as SNI=%s", remote, sni)
 
-	logger.Infof("Resolved %s as SNI=%s", remote, sni)
+	// Enforce the route's TLS policy before a tunnel is spawned for a client we would refuse anyway.
+	route := opts.Routes.Lookup(sni)
+	if alert, err := checkTLSPolicy(route, hello); err != nil {
+		rec.CloseReason = fmt.Sprintf("tls policy: %v", err)
+		logSampled(opts.LogSampler, "policy:"+clientIP(remote), logger.Warnf, "TLS policy rejected %s (SNI=%s): %v", remote, sni, err)
+		if tlsErr := sendTLSAlert(conn, alert); tlsErr != nil {
+			logger.Debugf("failed to send TLS alert to %s: %v", remote, tlsErr)
+		}
+		return
+	}
 
-	localPort, err := manager.GetOrStart(sni)
+	rec.TunnelHostname, _ = cloudflaredmanager.TunnelHostname(sni)
+	logger = logger.With(logging.Field{Key: "tunnel", Value: rec.TunnelHostname})
+	span.SetAttributes(tracing.String("tunnel.hostname", rec.TunnelHostname))
+	var tunnelOpts cloudflaredmanager.TunnelOptions
+	if route != nil {
+		tunnelOpts.Replicas = route.Replicas
+		tunnelOpts.ServiceToken = route.ServiceToken
+	}
+	// A start may queue behind the tunnel cap; stop waiting if the client goes away meanwhile.
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	stopWatch := watchClient(conn, cancelWait)
+	lease, err := manager.GetOrStartContext(waitCtx, sni, tunnelOpts)
+	early, clientErr := stopWatch()
+	cancelWait()
 	if err != nil {
-		logger.Errorf("tunnel prep failed for %s: %v", sni, err)
+		if clientErr != nil && errors.Is(err, context.Canceled) {
+			rec.ClosedBy = "client"
+			rec.CloseReason = fmt.Sprintf("client closed while waiting for the tunnel: %v", clientErr)
+			logger.Debugf("%s closed the connection while waiting for the tunnel for %s: %v", remote, sni, clientErr)
+			return
+		}
+		rec.CloseReason = fmt.Sprintf("tunnel prep failed: %v", err)
+		logSampled(opts.LogSampler, "tunnel:"+sni, logger.Errorf, "tunnel prep failed for %s: %v", sni, err)
 		return
 	}
-	defer manager.Release(sni)
+	defer lease.Release()
+	backendAddr := lease.Addr
+	rec.LocalAddr = backendAddr.String()
+	rec.LocalPort = int(backendAddr.Port())
+	rec.TimeToTunnel = time.Since(start)
+	span.SetAttributes(tracing.Int("tunnel.port", rec.LocalPort))
 
-	backendAddr := fmt.Sprintf("127.0.0.1:%d", localPort)
-	backendConn, err := net.Dial("tcp", backendAddr)
+	_, dialSpan := opts.Tracer.Start(ctx, "dialBackend", tracing.String("backend.address", rec.LocalAddr))
+	backendConn, err := net.Dial("tcp", backendAddr.String())
+	dialSpan.RecordError(err)
+	dialSpan.End()
 	if err != nil {
-		logger.Errorf("failed to dial backend %s for %s: %v", backendAddr, sni, err)
+		rec.CloseReason = fmt.Sprintf("backend dial failed: %v", err)
+		logSampled(opts.LogSampler, "dial:"+sni, logger.Errorf, "failed to dial backend %s for %s: %v", backendAddr, sni, err)
 		return
 	}
 	defer backendConn.Close()
@@ -57,16 +149,21 @@ func HandleConnection(conn net.Conn, manager *cloudflaredmanager.NodeManager, re
 	// then stream the TLS ClientHello once the server has answered.
 	if len(buffers.prelude) > 0 {
 		if err := writeAll(backendConn, buffers.prelude); err != nil {
+			rec.CloseReason = fmt.Sprintf("forward prelude failed: %v", err)
 			logger.Errorf("failed to forward prelude bytes to backend for %s: %v", sni, err)
 			return
 		}
+		rec.BytesIn += int64(len(buffers.prelude))
 	}
 
 	var backendReader io.Reader = backendConn
 	if sawPGSSLRequest {
-		prefix, err := consumeBackendPostgresSSLResponse(backendConn, readHelloTimeout)
+		_, pgSpan := opts.Tracer.Start(ctx, "postgresSSLResponse")
+		prefix, err := consumeBackendPostgresSSLResponse(backendConn, readHelloTimeout, logger.Component("sni"))
+		pgSpan.RecordError(err)
+		pgSpan.End()
 		if err != nil {
-			logger.Errorf("backend Postgres SSL response read failed for %s: %v", sni, err)
+			logger.Warnf("backend Postgres SSL response read failed for %s: %v", sni, err)
 		}
 		if len(prefix) > 0 {
 			backendReader = io.MultiReader(bytes.NewReader(prefix), backendConn)
@@ -76,42 +173,159 @@ func HandleConnection(conn net.Conn, manager *cloudflaredmanager.NodeManager, re
 	// Now deliver the TLS ClientHello (and any buffered bytes) to the backend before switching to streaming.
 	if len(buffers.tlsInitial) > 0 {
 		if err := writeAll(backendConn, buffers.tlsInitial); err != nil {
+			rec.CloseReason = fmt.Sprintf("forward TLS initial bytes failed: %v", err)
 			logger.Errorf("failed to forward TLS initial bytes to backend for %s: %v", sni, err)
 			return
 		}
+		rec.BytesIn += int64(len(buffers.tlsInitial))
+	}
+	if len(early) > 0 {
+		if err := writeAll(backendConn, early); err != nil {
+			rec.CloseReason = fmt.Sprintf("forward early client bytes failed: %v", err)
+			logger.Errorf("failed to forward early client bytes to backend for %s: %v", sni, err)
+			return
+		}
+		rec.BytesIn += int64(len(early))
 	}
 	putInitialBuffers(buffers)
 	buffers = nil
 
 	logger.Infof("Proxying %s -> %s via %s", remote, sni, backendAddr)
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// Throttling wraps only the read side of each direction; the half-close handling below still operates on
+	// the underlying TCP connections.
+	upBuckets, downBuckets, releaseThrottles := acquireThrottles(opts.Limiters, route, remote, rec.TunnelHostname)
+	defer releaseThrottles()
+	clientReader := ratelimit.NewReader(conn, upBuckets...)
+	backendReader = ratelimit.NewReader(backendReader, downBuckets...)
+
+	// The first copy to finish tells us which side closed first.
+	type copyResult struct {
+		side string
+		n    int64
+		err  error
+	}
+	results := make(chan copyResult, 2)
 
 	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(backendConn, conn)
+		n, err := io.Copy(backendConn, clientReader)
 		if tcp, ok := backendConn.(*net.TCPConn); ok {
 			_ = tcp.CloseWrite()
 		}
 		if tcp, ok := conn.(*net.TCPConn); ok {
 			_ = tcp.CloseRead()
 		}
+		results <- copyResult{side: "client", n: n, err: err}
 	}()
 
 	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(conn, backendReader)
+		n, err := io.Copy(conn, backendReader)
 		if tcp, ok := backendConn.(*net.TCPConn); ok {
 			_ = tcp.CloseRead()
 		}
 		if tcp, ok := conn.(*net.TCPConn); ok {
 			_ = tcp.CloseWrite()
 		}
+		results <- copyResult{side: "backend", n: n, err: err}
+	}()
+
+	// A tunnel that crashed for good takes the backend port with it; close both sides instead of leaving the
+	// client on a half-closed connection.
+	done := make(chan struct{})
+	defer close(done)
+	var tunnelFailed atomic.Bool
+	go func() {
+		select {
+		case <-lease.Failed():
+			tunnelFailed.Store(true)
+			conn.Close()
+			backendConn.Close()
+		case <-done:
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.side == "client" {
+			rec.BytesIn += res.n
+		} else {
+			rec.BytesOut += res.n
+		}
+		if i == 0 {
+			rec.ClosedBy = res.side
+			rec.CloseReason = "eof"
+			if res.err != nil {
+				rec.CloseReason = res.err.Error()
+			}
+		}
+	}
+	if tunnelFailed.Load() {
+		rec.ClosedBy = "proxy"
+		rec.CloseReason = fmt.Sprintf("tunnel failed: %v", cloudflaredmanager.ErrRestartsExhausted)
+	}
+	logger.Debugf("Connection closed for %s (%s)", remote, sni)
+}
+
+// logSampled logs through logf unless sampler has already let through its burst of messages for key in the
+// current window. The first message after a suppressed run reports how many were dropped.
+func logSampled(sampler *logging.Sampler, key string, logf func(string, ...any), format string, args ...any) {
+	ok, suppressed := sampler.Allow(key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		format += " (%d similar message(s) suppressed)"
+		args = append(args, suppressed)
+	}
+	logf(format, args...)
+}
+
+// newConnID returns a random identifier that correlates the log lines and trace of one connection.
+// watchClient reads from conn in the background and calls cancel if the client closes the connection or it
+// fails. stop ends the watch and returns what the client sent meanwhile, to be forwarded after the initial
+// bytes, and the error that triggered cancel, if any. conn must not be read until stop returns.
+func watchClient(conn net.Conn, cancel context.CancelFunc) (stop func() ([]byte, error)) {
+	var (
+		early   []byte
+		readErr error
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			early = append(early, buf[:n]...)
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					readErr = err
+					cancel()
+				}
+				return
+			}
+		}
 	}()
+	return func() ([]byte, error) {
+		// A deadline in the past unblocks the pending Read.
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+		return early, readErr
+	}
+}
 
-	wg.Wait()
-	logger.Infof("Connection closed for %s (%s)", remote, sni)
+func newConnID() string {
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// clientIP strips the port from a remote address so all connections from one client share a sampling key.
+func clientIP(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
 }
 
 func writeAll(w io.Writer, data []byte) error {
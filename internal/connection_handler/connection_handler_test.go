@@ -2,8 +2,18 @@ package connectionhandler
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/internal/tracing"
+	"tcp-tunnel-proxy/internal/tracing/tracingtest"
 )
 
 type partialWriter struct {
@@ -50,3 +60,144 @@ func TestWriteAllPropagatesErrors(t *testing.T) {
 		t.Fatalf("expected error on second write")
 	}
 }
+
+func TestHandleConnectionTracesRejectedClient(t *testing.T) {
+	collector := tracingtest.NewCollector(t)
+	tracer, err := tracing.New(tracing.Config{Endpoint: collector.URL, SampleRatio: 1, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("tracing.New: %v", err)
+	}
+	defer tracer.Shutdown(context.Background())
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(server, nil, Options{ReadHelloTimeout: time.Second, Tracer: tracer}, logging.New("test"))
+	}()
+	_, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, _ = io.Copy(io.Discard, client) // the TLS alert, then EOF
+	client.Close()
+	<-done
+
+	spans := map[string]tracingtest.Span{}
+	for _, s := range collector.WaitFor(t, "HandleConnection", "extractSNI") {
+		spans[s.Name] = s
+	}
+	root, sni := spans["HandleConnection"], spans["extractSNI"]
+	if sni.ParentSpanID != root.SpanID || root.Kind != int(tracing.KindServer) {
+		t.Fatalf("extractSNI should be a child of the connection span: %+v", spans)
+	}
+	if sni.StatusCode != 2 || root.StatusCode != 2 || root.Attributes["close.by"] != "proxy" || root.Attributes["client.address"] == nil {
+		t.Fatalf("rejected connection should be traced as failed: %+v", spans)
+	}
+}
+
+func TestLogSampledLimitsPerClient(t *testing.T) {
+	sampler := logging.NewSampler(1, time.Hour)
+	var lines []string
+	logf := func(format string, args ...any) { lines = append(lines, fmt.Sprintf(format, args...)) }
+
+	for i := 0; i < 3; i++ {
+		logSampled(sampler, "sni:"+clientIP("192.0.2.7:5000"), logf, "SNI extraction failed for %s", "192.0.2.7")
+	}
+	logSampled(sampler, "sni:"+clientIP("192.0.2.8:5000"), logf, "SNI extraction failed for %s", "192.0.2.8")
+	if len(lines) != 2 || lines[0] != "SNI extraction failed for 192.0.2.7" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+
+	logSampled(nil, "sni:192.0.2.7", logf, "unsampled")
+	if lines[len(lines)-1] != "unsampled" {
+		t.Fatalf("a nil sampler should log, got %q", lines)
+	}
+}
+
+func TestHandleConnectionCorrelatesLogLines(t *testing.T) {
+	logging.Setup("json")
+	defer logging.Setup("plain")
+	if err := logging.SetLevels("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.SetLevels("info")
+
+	var buf bytes.Buffer
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(server, nil, Options{ReadHelloTimeout: 200 * time.Millisecond}, logging.NewWithWriter("connection", &buf))
+	}()
+	// A PostgreSQL SSLRequest (logged by the SNI helpers) followed by something that is not a ClientHello.
+	_, _ = client.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f})
+	_, _ = io.ReadFull(client, make([]byte, 1))
+	_, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, _ = io.Copy(io.Discard, client)
+	client.Close()
+	<-done
+
+	components := map[string]bool{}
+	var connID any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry struct {
+			Component string         `json:"component"`
+			Fields    map[string]any `json:"fields"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		components[entry.Component] = true
+		if connID == nil {
+			connID = entry.Fields["conn_id"]
+		}
+		if entry.Fields["conn_id"] == nil || entry.Fields["conn_id"] != connID || entry.Fields["client_addr"] == nil {
+			t.Fatalf("line not tied to the connection: %s", line)
+		}
+	}
+	if !components["connection"] || !components["sni"] {
+		t.Fatalf("expected lines from the connection and sni components, got %v:\n%s", components, buf.String())
+	}
+}
+
+func TestWatchClientKeepsEarlyBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := watchClient(server, cancel)
+	if _, err := client.Write([]byte("early")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	early, err := stop()
+	if err != nil || string(early) != "early" {
+		t.Fatalf("expected the early bytes and no error, got %q (%v)", early, err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("a client that is still connected must not cancel the wait")
+	}
+	// The connection is usable again after the watch.
+	go func() { _, _ = client.Write([]byte("more")) }()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "more" {
+		t.Fatalf("read after stop: %q (%v)", buf, err)
+	}
+}
+
+func TestWatchClientCancelsOnClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := watchClient(server, cancel)
+	client.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closing the client did not cancel the wait")
+	}
+	if _, err := stop(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF from stop, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package connectionhandler
+
+import (
+	"errors"
+
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/pkg/clienthello"
+	"tcp-tunnel-proxy/pkg/ech"
+)
+
+// resolveECH returns the SNI and ClientHello to route on. When the client offered ECH and one of our keys
+// decrypts it, the inner ClientHello wins; otherwise the outer (public name) hello is used unchanged, which is
+// what the backend will also fall back to when it rejects ECH.
+func resolveECH(keys *ech.KeySet, outerSNI string, outer *clienthello.ClientHello, remote string, logger *logging.Logger) (string, *clienthello.ClientHello) {
+	if keys == nil || !outer.HasECH() {
+		return outerSNI, outer
+	}
+	inner, err := keys.Decrypt(outer)
+	if err != nil {
+		if !errors.Is(err, ech.ErrNoECH) {
+			logger.Debugf("ECH not decrypted for %s (outer SNI=%s): %v; routing on outer SNI", remote, outerSNI, err)
+		}
+		return outerSNI, outer
+	}
+	sni, err := inner.ServerName()
+	if err != nil {
+		logger.Warnf("ECH inner ClientHello from %s has no usable SNI: %v; routing on outer SNI", remote, err)
+		return outerSNI, outer
+	}
+	logger.Debugf("ECH accepted for %s: outer SNI=%s inner SNI=%s", remote, outerSNI, sni)
+	return sni, inner
+}
@@ -0,0 +1,136 @@
+package connectionhandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/pkg/ech"
+)
+
+// TestECHRoutesOnInnerSNIAndForwardsUnchanged drives a crypto/tls ECH client through extractSNI/resolveECH,
+// then replays the untouched bytes to a crypto/tls backend holding the same keys and checks ECH is accepted.
+func TestECHRoutesOnInnerSNIAndForwardsUnchanged(t *testing.T) {
+	const innerName, publicName = "db-123.ratio1.link", "public.ratio1.link"
+	key, err := ech.GenerateKey(publicName, 9)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	keys, err := ech.NewKeySet([]ech.Key{key})
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	cert, roots := selfSignedCert(t, innerName, publicName)
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backendLn.Close()
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		srv := tls.Server(c, &tls.Config{
+			Certificates:             []tls.Certificate{cert},
+			EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{{Config: key.Config, PrivateKey: key.PrivateKey}},
+		})
+		if srv.Handshake() == nil {
+			_, _ = srv.Write([]byte("ok"))
+		}
+		srv.Close()
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	defer proxyLn.Close()
+	routed := make(chan string, 1)
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sni, hello, bufs, _, err := extractSNI(conn, 5*time.Second, logging.New("sni"))
+		if err != nil {
+			routed <- "error: " + err.Error()
+			return
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		sni, _ = resolveECH(keys, sni, hello, conn.RemoteAddr().String(), logging.New("test"))
+		routed <- sni
+
+		backend, err := net.Dial("tcp", backendLn.Addr().String())
+		if err != nil {
+			return
+		}
+		defer backend.Close()
+		_ = writeAll(backend, bufs.tlsInitial)
+		go func() { _, _ = io.Copy(backend, conn) }()
+		_, _ = io.Copy(conn, backend)
+	}()
+
+	client, err := tls.Dial("tcp", proxyLn.Addr().String(), &tls.Config{
+		ServerName:                     innerName,
+		RootCAs:                        roots,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: keys.ConfigList(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake through proxy failed: %v", err)
+	}
+	defer client.Close()
+
+	if got := <-routed; got != innerName {
+		t.Fatalf("routed on %q, want inner SNI %q", got, innerName)
+	}
+	if !client.ConnectionState().ECHAccepted {
+		t.Fatalf("backend did not accept ECH")
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read through proxy = %q, %v", buf, err)
+	}
+}
+
+func selfSignedCert(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, roots
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"tcp-tunnel-proxy/internal/logging"
+	"tcp-tunnel-proxy/pkg/clienthello"
 )
 
 const (
@@ -19,6 +20,10 @@ const (
 	defaultTLSCap     = 4096
 	maxPreludeCap     = 8192
 	maxTLSCap         = 65536
+
+	// maxClientHelloSize caps the ClientHello body reassembled from several records. Real ones, post-quantum
+	// key shares included, are a few KiB.
+	maxClientHelloSize = 1 << 16
 )
 
 type initialBuffers struct {
@@ -27,7 +32,6 @@ type initialBuffers struct {
 }
 
 var (
-	logger         = logging.New("sni")
 	initialBufPool = sync.Pool{
 		New: func() any {
 			return &initialBuffers{
@@ -82,48 +86,32 @@ func putReader(br *bufio.Reader) {
 }
 
 // extractSNI reads the initial bytes (handling PROXY headers and PostgreSQL SSLRequest) and returns
-// the parsed SNI plus the bytes that must be replayed to the backend.
-func extractSNI(conn net.Conn, readHelloTimeout time.Duration) (string, *initialBuffers, bool, error) {
+// the parsed SNI and ClientHello plus the bytes that must be replayed to the backend.
+func extractSNI(conn net.Conn, readHelloTimeout time.Duration, logger *logging.Logger) (string, *clienthello.ClientHello, *initialBuffers, bool, error) {
 	reader := getReader(conn)
 	defer putReader(reader)
 	bufs := getInitialBuffers() // holds prelude + TLS bytes to replay
 
 	if err := maybeConsumeProxyHeader(reader, &bufs.prelude); err != nil {
-		return "", bufs, false, err
+		return "", nil, bufs, false, err
 	}
 
-	sawPGSSLRequest, err := maybeHandlePostgresSSLRequest(reader, &bufs.prelude, conn, readHelloTimeout)
+	sawPGSSLRequest, err := maybeHandlePostgresSSLRequest(reader, &bufs.prelude, conn, readHelloTimeout, logger)
 	if err != nil {
-		return "", bufs, sawPGSSLRequest, err
-	}
-
-	header := make([]byte, 5)
-	if _, err := io.ReadFull(reader, header); err != nil {
-		return "", bufs, sawPGSSLRequest, fmt.Errorf("reading TLS header: %w", err)
+		return "", nil, bufs, sawPGSSLRequest, err
 	}
-	bufs.tlsInitial = append(bufs.tlsInitial, header...)
 
-	if header[0] != 0x16 { // TLS Handshake
-		return "", bufs, sawPGSSLRequest, errors.New("not a TLS handshake record")
-	}
-
-	length := int(header[3])<<8 | int(header[4])
-	if length <= 0 || length > 1<<15 {
-		return "", bufs, sawPGSSLRequest, fmt.Errorf("invalid TLS record length %d", length)
-	}
-
-	body := make([]byte, length)
-	if _, err := io.ReadFull(reader, body); err != nil {
-		return "", bufs, sawPGSSLRequest, fmt.Errorf("reading TLS body: %w", err)
+	msg, err := readClientHelloMessage(reader, &bufs.tlsInitial)
+	if err != nil {
+		return "", nil, bufs, sawPGSSLRequest, err
 	}
-	bufs.tlsInitial = append(bufs.tlsInitial, body...)
-
-	sni, err := parseClientHelloForSNI(body)
+	hello, err := clienthello.Parse(msg)
 	if err != nil {
-		return "", bufs, sawPGSSLRequest, err
+		return "", nil, bufs, sawPGSSLRequest, err
 	}
-	if sni == "" {
-		return "", bufs, sawPGSSLRequest, errors.New("no SNI present")
+	sni, err := hello.ServerName()
+	if err != nil {
+		return "", nil, bufs, sawPGSSLRequest, err
 	}
 
 	// Preserve any bytes bufio.Reader has already pulled from the socket so the backend sees an unbroken stream.
@@ -134,11 +122,11 @@ func extractSNI(conn net.Conn, readHelloTimeout time.Duration) (string, *initial
 		}
 	}
 
-	return sni, bufs, sawPGSSLRequest, nil
+	return sni, hello, bufs, sawPGSSLRequest, nil
 }
 
 // maybeHandlePostgresSSLRequest consumes a PostgreSQL SSLRequest prefix (if present) and sends the acceptance byte.
-func maybeHandlePostgresSSLRequest(r *bufio.Reader, consumed *[]byte, conn net.Conn, readHelloTimeout time.Duration) (bool, error) {
+func maybeHandlePostgresSSLRequest(r *bufio.Reader, consumed *[]byte, conn net.Conn, readHelloTimeout time.Duration, logger *logging.Logger) (bool, error) {
 	const sslRequestLen = 8
 
 	peek, err := r.Peek(sslRequestLen)
@@ -162,7 +150,7 @@ func maybeHandlePostgresSSLRequest(r *bufio.Reader, consumed *[]byte, conn net.C
 		return false, nil
 	}
 
-	logger.Infof("PostgreSQL SSLRequest detected; responding with acceptance")
+	logger.Debugf("PostgreSQL SSLRequest detected; responding with acceptance")
 	req := make([]byte, sslRequestLen)
 	if _, err := io.ReadFull(r, req); err != nil {
 		return true, fmt.Errorf("read postgres SSLRequest: %w", err)
@@ -178,7 +166,7 @@ func maybeHandlePostgresSSLRequest(r *bufio.Reader, consumed *[]byte, conn net.C
 }
 
 // consumeBackendPostgresSSLResponse reads the backend's single-byte SSL response so we can inject it before TLS bytes.
-func consumeBackendPostgresSSLResponse(conn net.Conn, readHelloTimeout time.Duration) ([]byte, error) {
+func consumeBackendPostgresSSLResponse(conn net.Conn, readHelloTimeout time.Duration, logger *logging.Logger) ([]byte, error) {
 	var buf [1]byte
 
 	_ = conn.SetReadDeadline(time.Now().Add(readHelloTimeout))
@@ -189,11 +177,11 @@ func consumeBackendPostgresSSLResponse(conn net.Conn, readHelloTimeout time.Dura
 		return nil, err
 	}
 	if buf[0] == 'S' {
-		logger.Infof("Backend Postgres SSL response: accepted TLS (S)")
+		logger.Debugf("Backend Postgres SSL response: accepted TLS (S)")
 		return nil, err
 	}
 
-	logger.Infof("Backend Postgres first byte after SSLRequest: 0x%02x (%q)", buf[0], buf[0])
+	logger.Debugf("Backend Postgres first byte after SSLRequest: 0x%02x (%q)", buf[0], buf[0])
 	return buf[:1], err
 }
 
@@ -242,110 +230,58 @@ func maybeConsumeProxyHeader(r *bufio.Reader, consumed *[]byte) error {
 	return nil
 }
 
-// parseClientHelloForSNI extracts the SNI from a TLS ClientHello record payload.
-func parseClientHelloForSNI(record []byte) (string, error) {
-	if len(record) < 4 {
-		return "", errors.New("TLS record too short for handshake")
-	}
-	if record[0] != 0x01 {
-		return "", errors.New("first handshake message is not ClientHello")
-	}
-
-	handshakeLen := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
-	if handshakeLen+4 > len(record) {
-		return "", errors.New("truncated ClientHello")
-	}
-	data := record[4 : 4+handshakeLen]
-	offset := 0
-
-	if len(data) < 34 {
-		return "", errors.New("ClientHello too short")
-	}
-	offset += 2  // version
-	offset += 32 // random
-
-	if offset >= len(data) {
-		return "", errors.New("malformed ClientHello (session id length missing)")
-	}
-	sidLen := int(data[offset])
-	offset++
-	if offset+sidLen > len(data) {
-		return "", errors.New("malformed ClientHello (session id)")
-	}
-	offset += sidLen
-
-	if offset+2 > len(data) {
-		return "", errors.New("malformed ClientHello (cipher suites length)")
-	}
-	csLen := int(data[offset])<<8 | int(data[offset+1])
-	offset += 2
-	if offset+csLen > len(data) {
-		return "", errors.New("malformed ClientHello (cipher suites)")
-	}
-	offset += csLen
-
-	if offset >= len(data) {
-		return "", errors.New("malformed ClientHello (compression length)")
-	}
-	compLen := int(data[offset])
-	offset++
-	if offset+compLen > len(data) {
-		return "", errors.New("malformed ClientHello (compression methods)")
-	}
-	offset += compLen
-
-	if offset+2 > len(data) {
-		return "", errors.New("ClientHello missing extensions length")
-	}
-	extLen := int(data[offset])<<8 | int(data[offset+1])
-	offset += 2
-	if offset+extLen > len(data) {
-		return "", errors.New("ClientHello extensions truncated")
-	}
-	exts := data[offset : offset+extLen]
-
-	for len(exts) >= 4 {
-		extType := int(exts[0])<<8 | int(exts[1])
-		extDataLen := int(exts[2])<<8 | int(exts[3])
-		exts = exts[4:]
-		if extDataLen > len(exts) {
-			return "", errors.New("extension length overflow")
+// readClientHelloMessage reads TLS handshake records until they hold the whole first handshake message, which
+// a client may split across several records, and returns their combined payload. Every byte read is appended to
+// consumed for replay.
+func readClientHelloMessage(r *bufio.Reader, consumed *[]byte) ([]byte, error) {
+	var msg []byte
+	need := 4 // the handshake header, until it tells us the message length
+	for len(msg) < need {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("reading TLS header: %w", err)
 		}
-		extData := exts[:extDataLen]
-		exts = exts[extDataLen:]
-
-		if extType == 0 { // server_name
-			if len(extData) < 2 {
-				return "", errors.New("SNI extension too short")
-			}
-			listLen := int(extData[0])<<8 | int(extData[1])
-			if listLen+2 > len(extData) {
-				return "", errors.New("SNI list length invalid")
-			}
-			names := extData[2 : 2+listLen]
-			for len(names) >= 3 {
-				nameType := names[0]
-				nameLen := int(names[1])<<8 | int(names[2])
-				names = names[3:]
-				if nameLen > len(names) {
-					return "", errors.New("SNI name length invalid")
-				}
-				name := string(names[:nameLen])
-				names = names[nameLen:]
-				if nameType == 0 {
-					return name, nil
-				}
+		*consumed = append(*consumed, header...)
+		if header[0] != 0x16 { // TLS Handshake
+			return nil, errors.New("not a TLS handshake record")
+		}
+		length := int(header[3])<<8 | int(header[4])
+		if length <= 0 || length > 1<<15 {
+			return nil, fmt.Errorf("invalid TLS record length %d", length)
+		}
+		if len(msg)+length > maxClientHelloSize+4 {
+			return nil, fmt.Errorf("ClientHello exceeds %d bytes", maxClientHelloSize)
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, length)...)
+		if _, err := io.ReadFull(r, msg[start:]); err != nil {
+			return nil, fmt.Errorf("reading TLS body: %w", err)
+		}
+		*consumed = append(*consumed, msg[start:]...)
+		if len(msg) >= 4 {
+			need = 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if need > maxClientHelloSize+4 {
+				return nil, fmt.Errorf("ClientHello of %d bytes exceeds %d", need-4, maxClientHelloSize)
 			}
-			return "", errors.New("SNI extension present but no host name found")
 		}
 	}
+	return msg, nil
+}
 
-	return "", errors.New("SNI not found in ClientHello")
+// parseClientHelloForSNI extracts the SNI from a TLS ClientHello record payload.
+func parseClientHelloForSNI(record []byte) (string, error) {
+	hello, err := clienthello.Parse(record)
+	if err != nil {
+		return "", err
+	}
+	return hello.ServerName()
 }
 
 // TLS alert constants (subset) for sending minimal alerts on parse failures.
 const (
 	alertLevelFatal        = 2
+	alertProtocolVersion   = 70
+	alertInsufficientSec   = 71
 	alertUnrecognizedName  = 112
 	tlsAlertContentType    = 21
 	tlsVersion12Major      = 0x03
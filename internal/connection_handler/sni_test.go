@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"tcp-tunnel-proxy/internal/logging"
 )
 
 func TestParseClientHelloForSNI(t *testing.T) {
@@ -71,7 +73,7 @@ func TestMaybeHandlePostgresSSLRequest(t *testing.T) {
 	conn := newMockConn(req)
 	reader := bufio.NewReader(bytes.NewReader(req))
 	var consumed []byte
-	saw, err := maybeHandlePostgresSSLRequest(reader, &consumed, conn, time.Second)
+	saw, err := maybeHandlePostgresSSLRequest(reader, &consumed, conn, time.Second, logging.New("sni"))
 	if err != nil {
 		t.Fatalf("maybeHandlePostgresSSLRequest error: %v", err)
 	}
@@ -91,7 +93,7 @@ func TestMaybeHandlePostgresSSLRequestIgnoresNonSSLRequest(t *testing.T) {
 	conn := newMockConn(data)
 	reader := bufio.NewReader(bytes.NewReader(data))
 	var consumed []byte
-	saw, err := maybeHandlePostgresSSLRequest(reader, &consumed, conn, time.Second)
+	saw, err := maybeHandlePostgresSSLRequest(reader, &consumed, conn, time.Second, logging.New("sni"))
 	if err != nil {
 		t.Fatalf("maybeHandlePostgresSSLRequest error: %v", err)
 	}
@@ -105,7 +107,7 @@ func TestMaybeHandlePostgresSSLRequestIgnoresNonSSLRequest(t *testing.T) {
 
 func TestConsumeBackendPostgresSSLResponse(t *testing.T) {
 	acceptConn := newMockConn([]byte("S"))
-	prefix, err := consumeBackendPostgresSSLResponse(acceptConn, time.Second)
+	prefix, err := consumeBackendPostgresSSLResponse(acceptConn, time.Second, logging.New("sni"))
 	if err != nil && err != io.EOF {
 		t.Fatalf("consumeBackendPostgresSSLResponse accept error: %v", err)
 	}
@@ -114,7 +116,7 @@ func TestConsumeBackendPostgresSSLResponse(t *testing.T) {
 	}
 
 	rejectConn := newMockConn([]byte("N"))
-	prefix, err = consumeBackendPostgresSSLResponse(rejectConn, time.Second)
+	prefix, err = consumeBackendPostgresSSLResponse(rejectConn, time.Second, logging.New("sni"))
 	if err != nil && err != io.EOF {
 		t.Fatalf("consumeBackendPostgresSSLResponse reject error: %v", err)
 	}
@@ -123,6 +125,51 @@ func TestConsumeBackendPostgresSSLResponse(t *testing.T) {
 	}
 }
 
+func TestExtractSNIReassemblesSplitClientHello(t *testing.T) {
+	host := "db.ratio1.link"
+	msg := buildClientHelloRecord(host, true)
+	// The first record ends inside the handshake header, so its length is only known after the second.
+	var stream []byte
+	for _, chunk := range [][]byte{msg[:3], msg[3:20], msg[20:]} {
+		stream = append(stream, wrapTLSRecord(0x16, chunk)...)
+	}
+	stream = append(stream, wrapTLSRecord(0x17, []byte("early"))...)
+
+	sni, hello, bufs, _, err := extractSNI(newMockConn(stream), time.Second, logging.New("sni"))
+	if err != nil {
+		t.Fatalf("extractSNI returned error: %v", err)
+	}
+	if sni != host {
+		t.Fatalf("extractSNI = %q, want %q", sni, host)
+	}
+	if !bytes.Equal(hello.Raw, msg) {
+		t.Fatalf("hello.Raw is not the reassembled message")
+	}
+	if !bytes.Equal(bufs.tlsInitial, stream) {
+		t.Fatalf("replay bytes differ from what the client sent")
+	}
+}
+
+func TestExtractSNIRejectsBadContinuation(t *testing.T) {
+	msg := buildClientHelloRecord("db.ratio1.link", true)
+	tooBig := []byte{0x01, 0x02, 0x00, 0x00} // claims a 128 KiB ClientHello
+
+	cases := map[string][]byte{
+		"oversized":        wrapTLSRecord(0x16, tooBig),
+		"not a handshake":  append(wrapTLSRecord(0x16, msg[:10]), wrapTLSRecord(0x17, msg[10:])...),
+		"truncated stream": wrapTLSRecord(0x16, msg[:10]),
+	}
+	for name, stream := range cases {
+		if _, _, _, _, err := extractSNI(newMockConn(stream), time.Second, logging.New("sni")); err == nil {
+			t.Errorf("%s: extractSNI unexpectedly succeeded", name)
+		}
+	}
+}
+
+func wrapTLSRecord(contentType byte, payload []byte) []byte {
+	return append([]byte{contentType, 0x03, 0x01, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+}
+
 func buildClientHelloRecord(host string, includeSNI bool) []byte {
 	var body bytes.Buffer
 	body.Write([]byte{0x03, 0x03})             // version
@@ -0,0 +1,56 @@
+package connectionhandler
+
+import (
+	"net"
+
+	"tcp-tunnel-proxy/configs"
+	"tcp-tunnel-proxy/internal/ratelimit"
+	"tcp-tunnel-proxy/internal/routes"
+)
+
+// acquireThrottles returns the upload (client -> backend) and download buckets that apply to a connection,
+// plus a release func for the shared ones. Client IP buckets are scoped by route; tunnel buckets are keyed on the
+// direction and tunnel hostname alone, so every route resolving to a tunnel draws from one aggregate bucket.
+func acquireThrottles(reg *ratelimit.Registry, route *routes.Route, clientAddr, tunnelHostname string) (up, down []*ratelimit.Bucket, release func()) {
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	if reg == nil || route == nil {
+		return nil, nil, release
+	}
+
+	add := func(bw *configs.Bandwidth, key string, shared bool) {
+		if bw == nil {
+			return
+		}
+		pick := func(rate int64, dir string) *ratelimit.Bucket {
+			if rate <= 0 {
+				return nil
+			}
+			if !shared {
+				return ratelimit.NewBucket(rate)
+			}
+			b, rel := reg.Acquire(dir+"|"+key, rate)
+			releases = append(releases, rel)
+			return b
+		}
+		if b := pick(bw.UploadBytesPerSec, "up"); b != nil {
+			up = append(up, b)
+		}
+		if b := pick(bw.DownloadBytesPerSec, "down"); b != nil {
+			down = append(down, b)
+		}
+	}
+
+	clientIP := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		clientIP = host
+	}
+	add(route.Throttle.Connection, "", false)
+	add(route.Throttle.ClientIP, "ip:"+route.Match+"|"+clientIP, true)
+	add(route.Throttle.Tunnel, "tunnel:"+tunnelHostname, true)
+	return up, down, release
+}
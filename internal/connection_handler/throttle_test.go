@@ -0,0 +1,96 @@
+package connectionhandler
+
+import (
+	"testing"
+
+	"tcp-tunnel-proxy/configs"
+	"tcp-tunnel-proxy/internal/ratelimit"
+	"tcp-tunnel-proxy/internal/routes"
+)
+
+func TestAcquireThrottlesScopes(t *testing.T) {
+	table, err := routes.New([]configs.Route{{
+		Match: "*.ratio1.link",
+		Throttle: configs.Throttle{
+			Connection: &configs.Bandwidth{UploadBytesPerSec: 1000},
+			ClientIP:   &configs.Bandwidth{UploadBytesPerSec: 2000, DownloadBytesPerSec: 2000},
+			Tunnel:     &configs.Bandwidth{DownloadBytesPerSec: 5000},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("routes.New error: %v", err)
+	}
+	route := table.Lookup("db.ratio1.link")
+	reg := ratelimit.NewRegistry()
+
+	up1, down1, release1 := acquireThrottles(reg, route, "198.51.100.1:4000", "cft-db.ratio1.link")
+	up2, _, release2 := acquireThrottles(reg, route, "198.51.100.1:4001", "cft-db.ratio1.link")
+	_, down3, release3 := acquireThrottles(reg, route, "198.51.100.2:4000", "cft-db.ratio1.link")
+
+	if len(up1) != 2 || len(down1) != 2 {
+		t.Fatalf("got %d upload / %d download buckets, want 2/2", len(up1), len(down1))
+	}
+	if up1[0] == up2[0] {
+		t.Fatalf("per-connection bucket must not be shared")
+	}
+	if up1[1] != up2[1] {
+		t.Fatalf("client IP bucket must be shared by connections from the same IP")
+	}
+	if down1[0] == down3[0] {
+		t.Fatalf("client IP bucket must not be shared across IPs")
+	}
+	if down1[1] != down3[1] {
+		t.Fatalf("tunnel bucket must be shared by every client of the tunnel")
+	}
+
+	release1()
+	release2()
+	release3()
+	if reg.Len() != 0 {
+		t.Fatalf("registry still holds %d buckets after release", reg.Len())
+	}
+}
+
+func TestAcquireThrottlesWithoutRoute(t *testing.T) {
+	up, down, release := acquireThrottles(ratelimit.NewRegistry(), nil, "198.51.100.1:4000", "cft-db.ratio1.link")
+	defer release()
+	if len(up) != 0 || len(down) != 0 {
+		t.Fatalf("expected no buckets without a route")
+	}
+}
+
+func TestAcquireThrottlesTunnelBucketSpansRoutes(t *testing.T) {
+	limits := configs.Throttle{
+		ClientIP: &configs.Bandwidth{UploadBytesPerSec: 2000},
+		Tunnel:   &configs.Bandwidth{DownloadBytesPerSec: 5000},
+	}
+	slower := limits
+	slower.Tunnel = &configs.Bandwidth{DownloadBytesPerSec: 3000}
+	table, err := routes.New([]configs.Route{
+		{Match: "db.ratio1.link", Throttle: limits},
+		{Match: "*.ratio1.link", Throttle: slower},
+	})
+	if err != nil {
+		t.Fatalf("routes.New error: %v", err)
+	}
+	exact, wildcard := table.Lookup("db.ratio1.link"), table.Lookup("other.ratio1.link")
+	if exact == wildcard {
+		t.Fatalf("expected two different routes")
+	}
+	reg := ratelimit.NewRegistry()
+
+	up1, down1, release1 := acquireThrottles(reg, exact, "198.51.100.1:4000", "cft-db.ratio1.link")
+	defer release1()
+	up2, down2, release2 := acquireThrottles(reg, wildcard, "198.51.100.1:4001", "cft-db.ratio1.link")
+	defer release2()
+
+	if down1[0] != down2[0] {
+		t.Fatalf("routes resolving to the same tunnel must share its bucket, whatever rate they set")
+	}
+	if rate := down1[0].Rate(); rate != 3000 {
+		t.Fatalf("shared tunnel bucket should run at the lowest rate, got %d", rate)
+	}
+	if up1[0] == up2[0] {
+		t.Fatalf("client IP buckets must stay scoped to their route")
+	}
+}
@@ -0,0 +1,32 @@
+package connectionhandler
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"tcp-tunnel-proxy/internal/routes"
+	"tcp-tunnel-proxy/pkg/clienthello"
+)
+
+// checkTLSPolicy validates the ClientHello against the route policy. On rejection it returns the TLS alert
+// description to send (protocol_version or insufficient_security) and a descriptive error.
+func checkTLSPolicy(route *routes.Route, hello *clienthello.ClientHello) (byte, error) {
+	if route == nil {
+		return 0, nil
+	}
+	if route.MinTLSVersion != 0 {
+		if maxVersion := hello.MaxVersion(); maxVersion < route.MinTLSVersion {
+			return alertProtocolVersion, fmt.Errorf("client max TLS version %s below route minimum %s",
+				tls.VersionName(maxVersion), tls.VersionName(route.MinTLSVersion))
+		}
+	}
+	if route.CipherSuites != nil {
+		for _, id := range hello.CipherSuites {
+			if _, ok := route.CipherSuites[id]; ok {
+				return 0, nil
+			}
+		}
+		return alertInsufficientSec, fmt.Errorf("client offered no acceptable cipher suites (%d offered)", len(hello.CipherSuites))
+	}
+	return 0, nil
+}
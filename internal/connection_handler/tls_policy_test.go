@@ -0,0 +1,101 @@
+package connectionhandler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"testing"
+
+	"tcp-tunnel-proxy/configs"
+	"tcp-tunnel-proxy/internal/routes"
+	"tcp-tunnel-proxy/pkg/clienthello"
+)
+
+func TestParseClientHelloVersionsAndSuites(t *testing.T) {
+	record := buildPolicyClientHello(tls.VersionTLS12, []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12}, []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+
+	hello, err := clienthello.Parse(record)
+	if err != nil {
+		t.Fatalf("clienthello.Parse error: %v", err)
+	}
+	if sni, err := hello.ServerName(); err != nil || sni != "db.ratio1.link" {
+		t.Fatalf("ServerName = %q, %v", sni, err)
+	}
+	if hello.Version != tls.VersionTLS12 {
+		t.Fatalf("Version = %x", hello.Version)
+	}
+	if got := hello.MaxVersion(); got != tls.VersionTLS13 {
+		t.Fatalf("MaxVersion = %x, want TLS 1.3", got)
+	}
+	if len(hello.CipherSuites) != 2 {
+		t.Fatalf("CipherSuites = %v", hello.CipherSuites)
+	}
+}
+
+func TestCheckTLSPolicy(t *testing.T) {
+	table, err := routes.New([]configs.Route{
+		{Match: "*.strict.link", MinTLSVersion: "1.2", SecureCiphersOnly: true},
+		{Match: "*", MinTLSVersion: "1.0"},
+	})
+	if err != nil {
+		t.Fatalf("routes.New error: %v", err)
+	}
+	strict := table.Lookup("db.strict.link")
+
+	cases := []struct {
+		name     string
+		legacy   uint16
+		versions []uint16
+		suites   []uint16
+		route    *routes.Route
+		alert    byte
+	}{
+		{"tls13 accepted", tls.VersionTLS12, []uint16{tls.VersionTLS13}, []uint16{tls.TLS_AES_128_GCM_SHA256}, strict, 0},
+		{"tls10 rejected", tls.VersionTLS10, nil, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}, strict, alertProtocolVersion},
+		{"tls11 via supported_versions rejected", tls.VersionTLS12, []uint16{tls.VersionTLS11}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}, strict, alertProtocolVersion},
+		{"weak ciphers rejected", tls.VersionTLS12, nil, []uint16{tls.TLS_RSA_WITH_RC4_128_SHA, tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}, strict, alertInsufficientSec},
+		{"catch-all allows tls10", tls.VersionTLS10, nil, []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}, table.Lookup("db.other.link"), 0},
+		{"no route allows anything", tls.VersionTLS10, nil, []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}, nil, 0},
+	}
+	for _, tc := range cases {
+		hello, err := clienthello.Parse(buildPolicyClientHello(tc.legacy, tc.versions, tc.suites))
+		if err != nil {
+			t.Fatalf("%s: clienthello.Parse error: %v", tc.name, err)
+		}
+		alert, err := checkTLSPolicy(tc.route, hello)
+		if alert != tc.alert {
+			t.Fatalf("%s: alert = %d (err=%v), want %d", tc.name, alert, err, tc.alert)
+		}
+		if (err != nil) != (tc.alert != 0) {
+			t.Fatalf("%s: unexpected error state %v", tc.name, err)
+		}
+	}
+}
+
+// buildPolicyClientHello builds a ClientHello with SNI db.ratio1.link and optional supported_versions.
+func buildPolicyClientHello(legacy uint16, versions []uint16, suites []uint16) []byte {
+	var body bytes.Buffer
+	body.Write([]byte{byte(legacy >> 8), byte(legacy)})
+	body.Write(bytes.Repeat([]byte{0x02}, 32))
+	body.WriteByte(0x00)
+	body.Write([]byte{byte(len(suites) * 2 >> 8), byte(len(suites) * 2)})
+	for _, s := range suites {
+		body.Write([]byte{byte(s >> 8), byte(s)})
+	}
+	body.Write([]byte{0x01, 0x00})
+
+	var exts bytes.Buffer
+	name := []byte("db.ratio1.link")
+	exts.Write([]byte{0x00, 0x00, 0x00, byte(len(name) + 5), 0x00, byte(len(name) + 3), 0x00, 0x00, byte(len(name))})
+	exts.Write(name)
+	if len(versions) > 0 {
+		exts.Write([]byte{0x00, 43, 0x00, byte(len(versions)*2 + 1), byte(len(versions) * 2)})
+		for _, v := range versions {
+			exts.Write([]byte{byte(v >> 8), byte(v)})
+		}
+	}
+	body.Write([]byte{byte(exts.Len() >> 8), byte(exts.Len())})
+	body.Write(exts.Bytes())
+
+	record := []byte{0x01, byte(body.Len() >> 16), byte(body.Len() >> 8), byte(body.Len())}
+	return append(record, body.Bytes()...)
+}
@@ -0,0 +1,158 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// handler is the slog.Handler behind Logger. It writes either the plain format
+//
+//	2006/01/02 15:04:05.000000 [INFO][component] key=value ... message
+//
+// or one JSON object per line with ts, level, component, msg and, if any, fields. The format is read per
+// record, so Setup switches existing loggers too.
+type handler struct {
+	component string
+	out       *syncWriter
+	attrs     []slog.Attr // from WithAttrs, keys already qualified by their groups
+	group     string      // prefix for keys added later, "" or ending in "."
+}
+
+var bufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= levelFor(h.component)
+}
+
+func (h *handler) WithAttrs(as []slog.Attr) slog.Handler {
+	if len(as) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(as))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range as {
+		h2.attrs = appendAttr(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func (h *handler) withComponent(component string) *handler {
+	h2 := *h
+	h2.component = component
+	return &h2
+}
+
+func (h *handler) Handle(_ context.Context, r slog.Record) error {
+	fields := make([]slog.Attr, 0, len(h.attrs)+r.NumAttrs())
+	fields = append(fields, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendAttr(fields, h.group, a)
+		return true
+	})
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if jsonFormat.Load() {
+		h.writeJSON(buf, r, fields)
+	} else {
+		h.writePlain(buf, r, fields)
+	}
+	_, err := h.out.Write(buf.Bytes())
+	return err
+}
+
+func (h *handler) writePlain(buf *bytes.Buffer, r slog.Record, fields []slog.Attr) {
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05.000000"))
+	buf.WriteString(" [")
+	buf.WriteString(r.Level.String())
+	buf.WriteString("]")
+	if h.component != "" {
+		buf.WriteString("[")
+		buf.WriteString(h.component)
+		buf.WriteString("]")
+	}
+	if len(fields) > 0 {
+		buf.WriteString(" ")
+		for _, a := range fields {
+			fmt.Fprintf(buf, "%s=%v ", a.Key, value(a.Value))
+		}
+	}
+	buf.WriteString(r.Message)
+	buf.WriteByte('\n')
+}
+
+func (h *handler) writeJSON(buf *bytes.Buffer, r slog.Record, fields []slog.Attr) {
+	buf.WriteString(`{"component":`)
+	writeJSONValue(buf, h.component)
+	if len(fields) > 0 {
+		buf.WriteString(`,"fields":{`)
+		for i, a := range fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONValue(buf, a.Key)
+			buf.WriteByte(':')
+			writeJSONValue(buf, value(a.Value))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, r.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, r.Message)
+	buf.WriteString(`,"ts":`)
+	writeJSONValue(buf, r.Time.UTC().Format(time.RFC3339Nano))
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// appendAttr flattens a (possibly grouped) attribute into dotted keys.
+func appendAttr(dst []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range group {
+			dst = appendAttr(dst, prefix, ga)
+		}
+		return dst
+	}
+	if a.Equal(slog.Attr{}) {
+		return dst
+	}
+	a.Key = prefix + a.Key
+	return append(dst, a)
+}
+
+// value returns what to print for v; errors are written as their message.
+func value(v slog.Value) any {
+	if err, ok := v.Any().(error); ok {
+		return err.Error()
+	}
+	return v.Any()
+}
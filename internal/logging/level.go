@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is a message severity; a logger writes messages at or above its component's level.
+type Level = slog.Level
+
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// ParseLevel accepts debug, info, warn (or warning) and error in any case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (must be debug|info|warn|error)", s)
+}
+
+// levelSpec is the global level plus per-component overrides. It is replaced as a whole, never mutated.
+type levelSpec struct {
+	global     Level
+	components map[string]Level
+}
+
+var levels atomic.Pointer[levelSpec]
+
+func init() {
+	levels.Store(&levelSpec{global: LevelInfo})
+}
+
+func levelFor(component string) Level {
+	spec := levels.Load()
+	if l, ok := spec.components[component]; ok {
+		return l
+	}
+	return spec.global
+}
+
+// ParseLevels checks a level spec: a comma-separated list of a global level and component=level overrides, e.g.
+// "warn,sni=debug,node_manager=info". The global level may be omitted and defaults to info.
+func ParseLevels(spec string) error {
+	_, err := parseLevels(spec)
+	return err
+}
+
+func parseLevels(spec string) (*levelSpec, error) {
+	out := &levelSpec{global: LevelInfo, components: map[string]Level{}}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, lvl, ok := strings.Cut(part, "=")
+		if !ok {
+			l, err := ParseLevel(part)
+			if err != nil {
+				return nil, err
+			}
+			out.global = l
+			continue
+		}
+		component = strings.TrimSpace(component)
+		if component == "" {
+			return nil, fmt.Errorf("missing component in %q", part)
+		}
+		l, err := ParseLevel(lvl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", component, err)
+		}
+		out.components[component] = l
+	}
+	return out, nil
+}
+
+// SetLevels applies a level spec (see ParseLevels) to every logger, replacing all earlier overrides.
+func SetLevels(spec string) error {
+	parsed, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	levels.Store(parsed)
+	return nil
+}
+
+// Levels returns the spec in effect, in the form SetLevels accepts.
+func Levels() string {
+	spec := levels.Load()
+	parts := []string{strings.ToLower(spec.global.String())}
+	components := make([]string, 0, len(spec.components))
+	for c := range spec.components {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	for _, c := range components {
+		parts = append(parts, c+"="+strings.ToLower(spec.components[c].String()))
+	}
+	return strings.Join(parts, ",")
+}
@@ -1,13 +1,17 @@
+// Package logging provides component loggers built on log/slog that write the proxy's plain or JSON line
+// formats, with per-component levels (see SetLevels) and sampling of repetitive messages (see Sampler).
 package logging
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 )
 
 type Field struct {
@@ -15,103 +19,132 @@ type Field struct {
 	Value any
 }
 
+// Logger writes messages for one component. Attributes added with With are written on every line.
 type Logger struct {
 	component string
-	format    string
-	out       io.Writer
+	sl        *slog.Logger
 }
 
-var defaultFormat = "plain"
-var defaultWriter io.Writer = os.Stdout
+var jsonFormat atomic.Bool
 
-// Setup configures the default logger output/format.
+// defaultOut is shared by every logger created with New, so concurrent lines never interleave.
+var defaultOut = &syncWriter{w: os.Stdout}
+
+// Setup configures the default logger output/format. It may be called again at runtime; every logger,
+// including ones created earlier, switches format with its next line.
 func Setup(format string) {
 	if strings.EqualFold(format, "json") {
-		defaultFormat = "json"
 		log.SetFlags(0)
-		log.SetOutput(os.Stdout)
+		log.SetOutput(defaultOut)
+		jsonFormat.Store(true)
 		return
 	}
-	defaultFormat = "plain"
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.SetOutput(os.Stdout)
+	log.SetOutput(defaultOut)
+	jsonFormat.Store(false)
+}
+
+// SetOutput sends the output of every logger created with New, and of the standard log package, to w
+// (standard output by default).
+func SetOutput(w io.Writer) {
+	defaultOut.mu.Lock()
+	defaultOut.w = w
+	defaultOut.mu.Unlock()
+	log.SetOutput(defaultOut)
 }
 
 // New returns a component-specific logger using the default format/output.
 func New(component string) *Logger {
-	return &Logger{
-		component: component,
-		format:    defaultFormat,
-		out:       defaultWriter,
-	}
+	return newLogger(component, defaultOut)
+}
+
+// NewWithWriter returns a component-specific logger writing to w instead of standard output. Lines are written
+// whole, one Write call each.
+func NewWithWriter(component string, w io.Writer) *Logger {
+	return newLogger(component, &syncWriter{w: w})
+}
+
+func newLogger(component string, out *syncWriter) *Logger {
+	return &Logger{component: component, sl: slog.New(&handler{component: component, out: out})}
+}
+
+// With returns a logger that adds fields to every message, e.g. to tie all lines of one connection together.
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{component: l.component, sl: slog.New(l.sl.Handler().WithAttrs(attrs(fields)))}
+}
+
+// Component returns a logger for another component that keeps l's fields; its level follows that component.
+func (l *Logger) Component(component string) *Logger {
+	h := l.sl.Handler().(*handler).withComponent(component)
+	return &Logger{component: component, sl: slog.New(h)}
+}
+
+// Enabled reports whether l writes messages at level.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= levelFor(l.component)
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields...)
 }
 
 func (l *Logger) Info(msg string, fields ...Field) {
-	l.log("INFO", msg, fields...)
+	l.log(LevelInfo, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields...)
 }
 
 func (l *Logger) Error(msg string, fields ...Field) {
-	l.log("ERROR", msg, fields...)
+	l.log(LevelError, msg, fields...)
+}
+
+func (l *Logger) Debugf(format string, args ...any) {
+	if l.Enabled(LevelDebug) {
+		l.log(LevelDebug, fmt.Sprintf(format, args...))
+	}
 }
 
 func (l *Logger) Infof(format string, args ...any) {
-	l.log("INFO", fmt.Sprintf(format, args...))
+	if l.Enabled(LevelInfo) {
+		l.log(LevelInfo, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *Logger) Warnf(format string, args ...any) {
+	if l.Enabled(LevelWarn) {
+		l.log(LevelWarn, fmt.Sprintf(format, args...))
+	}
 }
 
 func (l *Logger) Errorf(format string, args ...any) {
-	l.log("ERROR", fmt.Sprintf(format, args...))
+	l.log(LevelError, fmt.Sprintf(format, args...))
 }
 
-func (l *Logger) log(level, msg string, fields ...Field) {
-	if l.format == "json" {
-		l.writeJSON(level, msg, fields...)
-		return
-	}
-	l.writePlain(level, msg, fields...)
-}
-
-func (l *Logger) writePlain(level, msg string, fields ...Field) {
-	var sb strings.Builder
-	sb.WriteString("[")
-	sb.WriteString(level)
-	sb.WriteString("]")
-	if l.component != "" {
-		sb.WriteString("[")
-		sb.WriteString(l.component)
-		sb.WriteString("]")
-	}
-	if len(fields) > 0 {
-		sb.WriteString(" ")
-		for i, f := range fields {
-			sb.WriteString(fmt.Sprintf("%s=%v", f.Key, f.Value))
-			if i != len(fields)-1 {
-				sb.WriteString(" ")
-			}
-		}
-		sb.WriteString(" ")
-	}
-	sb.WriteString(msg)
-	log.Print(sb.String())
+func (l *Logger) log(level Level, msg string, fields ...Field) {
+	l.sl.LogAttrs(context.Background(), level, msg, attrs(fields)...)
 }
 
-func (l *Logger) writeJSON(level, msg string, fields ...Field) {
-	entry := map[string]any{
-		"ts":        time.Now().UTC().Format(time.RFC3339Nano),
-		"level":     level,
-		"component": l.component,
-		"msg":       msg,
+func attrs(fields []Field) []slog.Attr {
+	if len(fields) == 0 {
+		return nil
 	}
-	if len(fields) > 0 {
-		m := make(map[string]any, len(fields))
-		for _, f := range fields {
-			m[f.Key] = f.Value
-		}
-		entry["fields"] = m
-	}
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return
+	out := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		out[i] = slog.Any(f.Key, f.Value)
 	}
-	data = append(data, '\n')
-	_, _ = l.out.Write(data)
+	return out
+}
+
+// syncWriter serializes whole lines from every logger sharing an output.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
 }
@@ -0,0 +1,191 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureJSON(t *testing.T, component string) (*Logger, *bytes.Buffer) {
+	t.Helper()
+	jsonFormat.Store(true)
+	t.Cleanup(func() {
+		jsonFormat.Store(false)
+		_ = SetLevels("info")
+	})
+	var buf bytes.Buffer
+	return newLogger(component, &syncWriter{w: &buf}), &buf
+}
+
+func levelsWritten(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var out []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		out = append(out, entry["level"].(string))
+	}
+	return out
+}
+
+func TestLevelFiltering(t *testing.T) {
+	l, buf := captureJSON(t, "connection")
+	emit := func() {
+		l.Debugf("debug %d", 1)
+		l.Info("info")
+		l.Warnf("warn %d", 1)
+		l.Error("error")
+	}
+
+	emit()
+	if got := strings.Join(levelsWritten(t, buf), ","); got != "INFO,WARN,ERROR" {
+		t.Fatalf("default level wrote %s", got)
+	}
+
+	buf.Reset()
+	if err := SetLevels("error,connection=debug"); err != nil {
+		t.Fatal(err)
+	}
+	emit()
+	if got := strings.Join(levelsWritten(t, buf), ","); got != "DEBUG,INFO,WARN,ERROR" {
+		t.Fatalf("component override wrote %s", got)
+	}
+
+	buf.Reset()
+	if err := SetLevels("debug,connection=warn"); err != nil {
+		t.Fatal(err)
+	}
+	emit()
+	if got := strings.Join(levelsWritten(t, buf), ","); got != "WARN,ERROR" {
+		t.Fatalf("warn override wrote %s", got)
+	}
+	if !New("sni").Enabled(LevelDebug) {
+		t.Fatalf("other components should follow the global level")
+	}
+}
+
+func TestPlainFormat(t *testing.T) {
+	jsonFormat.Store(false)
+	var buf bytes.Buffer
+	l := newLogger("connection", &syncWriter{w: &buf})
+
+	l.Infof("Proxying %s", "db")
+	l.Info("closed", Field{Key: "bytes", Value: 42}, Field{Key: "err", Value: errors.New("eof")})
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	// Drop the "2006/01/02 15:04:05.000000 " timestamp.
+	if got := lines[0][27:]; got != "[INFO][connection]Proxying db" {
+		t.Fatalf("plain line = %q", got)
+	}
+	if got := lines[1][27:]; got != "[INFO][connection] bytes=42 err=eof closed" {
+		t.Fatalf("plain line with fields = %q", got)
+	}
+}
+
+func TestWithAndComponent(t *testing.T) {
+	l, buf := captureJSON(t, "connection")
+	conn := l.With(Field{Key: "conn_id", Value: "abc"}, Field{Key: "client_addr", Value: "192.0.2.1:5000"})
+	conn.Info("first", Field{Key: "n", Value: 1})
+	conn.Component("sni").Debug("hidden")
+	if err := SetLevels("info,sni=debug"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Component("sni").Debug("parsed")
+	l.Info("unbound")
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %s", len(entries), buf.String())
+	}
+	first := entries[0]["fields"].(map[string]any)
+	if first["conn_id"] != "abc" || first["client_addr"] != "192.0.2.1:5000" || first["n"] != float64(1) {
+		t.Fatalf("child fields missing: %v", entries[0])
+	}
+	if entries[1]["component"] != "sni" || entries[1]["level"] != "DEBUG" || entries[1]["fields"].(map[string]any)["conn_id"] != "abc" {
+		t.Fatalf("component logger should keep fields and use its own level: %v", entries[1])
+	}
+	if _, ok := entries[2]["fields"]; ok {
+		t.Fatalf("With must not change the parent logger: %v", entries[2])
+	}
+	for _, key := range []string{"ts", "level", "component", "msg"} {
+		if _, ok := entries[2][key]; !ok {
+			t.Fatalf("JSON line missing %q: %v", key, entries[2])
+		}
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	t.Cleanup(func() { _ = SetLevels("info") })
+	if err := SetLevels(" Warning , sni=DEBUG,node_manager=error "); err != nil {
+		t.Fatalf("SetLevels: %v", err)
+	}
+	if got := Levels(); got != "warn,node_manager=error,sni=debug" {
+		t.Fatalf("Levels() = %q", got)
+	}
+	if err := SetLevels("sni=debug"); err != nil || Levels() != "info,sni=debug" {
+		t.Fatalf("a spec without a global level should default to info, got %q (err=%v)", Levels(), err)
+	}
+	for _, bad := range []string{"loud", "sni=", "=debug", "sni=verbose"} {
+		if err := SetLevels(bad); err == nil {
+			t.Fatalf("SetLevels(%q) should fail", bad)
+		}
+	}
+	if got := Levels(); got != "info,sni=debug" {
+		t.Fatalf("a rejected spec changed the levels to %q", got)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewSampler(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := s.Allow("sni:10.0.0.1"); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("allowed %d of 5 in one window, want 2", allowed)
+	}
+	if ok, _ := s.Allow("sni:10.0.0.2"); !ok {
+		t.Fatalf("keys should be sampled independently")
+	}
+
+	now = now.Add(time.Minute)
+	if ok, suppressed := s.Allow("sni:10.0.0.1"); !ok || suppressed != 3 {
+		t.Fatalf("next window: got %v/%d, want true/3", ok, suppressed)
+	}
+	if _, suppressed := s.Allow("sni:10.0.0.1"); suppressed != 0 {
+		t.Fatalf("suppressed count should be reported once, got %d", suppressed)
+	}
+
+	s.Configure(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if ok, _ := s.Allow("sni:10.0.0.1"); !ok {
+			t.Fatalf("a burst of 0 should disable sampling")
+		}
+	}
+	var nilSampler *Sampler
+	if ok, _ := nilSampler.Allow("x"); !ok {
+		t.Fatalf("a nil sampler should allow everything")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package logging
+
+import "os"
+
+// NotifyReopen is a no-op where there is no reopen signal; files still rotate by size and age.
+func NotifyReopen(c chan<- os.Signal) {}
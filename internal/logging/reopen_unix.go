@@ -0,0 +1,14 @@
+//go:build unix
+
+package logging
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyReopen relays the signal asking to reopen log files (SIGUSR1) to c.
+func NotifyReopen(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,284 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotation configures when a log file is rotated and what happens to the rotated files. The zero value never
+// rotates.
+type Rotation struct {
+	MaxSize    int64         // rotate before a write would grow the file past this many bytes; 0 disables
+	MaxAge     time.Duration // rotate once the file has been written for this long; 0 disables
+	MaxBackups int           // rotated files to keep; 0 keeps all
+	Compress   bool          // gzip rotated files
+}
+
+// rotatedTime is the suffix appended to rotated files, e.g. proxy.log.2026-10-18T14-12-58.123.
+const rotatedTime = "2006-01-02T15-04-05.000"
+
+// File is a log file opened for append that rotates itself according to its Rotation. Reopen closes and
+// reopens the path, for external tools such as logrotate that move the file away.
+type File struct {
+	path string
+	rot  Rotation
+	now  func() time.Time
+
+	mu      sync.Mutex
+	f       *os.File // nil after Close, or after a failed rotation or reopen until the next Write opens it again
+	closed  bool
+	size    int64
+	started time.Time // when this process started writing the current file
+	holdoff time.Time // no rotation before this, after a failed one
+
+	post sync.Mutex     // serializes compression and pruning of rotated files
+	wg   sync.WaitGroup // in-flight compression and pruning
+}
+
+var (
+	filesMu sync.Mutex
+	files   = map[*File]struct{}{}
+)
+
+// OpenFile opens path for append, creating it if needed.
+func OpenFile(path string, rot Rotation) (*File, error) {
+	f := &File{path: path, rot: rot, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	filesMu.Lock()
+	files[f] = struct{}{}
+	filesMu.Unlock()
+	return f, nil
+}
+
+// ReopenFiles reopens every File that is open, e.g. after logrotate moved them away.
+func ReopenFiles() error {
+	filesMu.Lock()
+	open := make([]*File, 0, len(files))
+	for f := range files {
+		open = append(open, f)
+	}
+	filesMu.Unlock()
+	var errs []error
+	for _, f := range open {
+		errs = append(errs, f.Reopen())
+	}
+	return errors.Join(errs...)
+}
+
+// OpenOutput returns the writer for dest: "stdout", "stderr" or a file path rotated according to rot. Closing
+// stdout or stderr is a no-op.
+func OpenOutput(dest string, rot Rotation) (io.WriteCloser, error) {
+	switch dest {
+	case "", "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+	return OpenFile(dest, rot)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("open log file: %w", err)
+	}
+	f.f, f.size, f.started = file, info.Size(), f.now()
+	return nil
+}
+
+// Write appends p, rotating first if the file is due. A single write is never split across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.f != nil && f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the path rather than losing lines; the file is reopened below if needed.
+			fmt.Fprintf(os.Stderr, "log rotation of %s failed: %v\n", f.path, err)
+			f.holdoff = f.now().Add(rotateHoldoff)
+		}
+	}
+	if f.f == nil {
+		// A failed rotation or reopen left no file open. Retry on every write so logging resumes once the
+		// path is usable again.
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) due(next int) bool {
+	if f.size == 0 || f.now().Before(f.holdoff) {
+		return false
+	}
+	if f.rot.MaxSize > 0 && f.size+int64(next) > f.rot.MaxSize {
+		return true
+	}
+	return f.rot.MaxAge > 0 && f.now().Sub(f.started) >= f.rot.MaxAge
+}
+
+// rotateHoldoff is how long a file keeps growing after a failed rotation before the next attempt.
+const rotateHoldoff = time.Minute
+
+// rotate moves the current file aside and starts a new one. If the new file cannot be opened f.f is left nil for
+// Write to retry. Callers hold f.mu.
+func (f *File) rotate() error {
+	rotated := f.rotatedName()
+	closeErr := f.f.Close()
+	f.f = nil
+	if err := os.Rename(f.path, rotated); err != nil {
+		return errors.Join(closeErr, err)
+	}
+	f.wg.Add(1)
+	go f.postRotate(rotated)
+	return errors.Join(closeErr, f.open())
+}
+
+// rotatedName returns a name for the current file that no earlier backup uses, compressed or not. Clashing
+// timestamps are moved forward a millisecond at a time so the name still sorts and prunes with the others.
+func (f *File) rotatedName() string {
+	t := f.now().UTC()
+	for {
+		name := f.path + "." + t.Format(rotatedTime)
+		if !exists(name) && !exists(name+".gz") {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// postRotate compresses a rotated file and removes the oldest beyond MaxBackups, off the write path.
+func (f *File) postRotate(rotated string) {
+	defer f.wg.Done()
+	f.post.Lock()
+	defer f.post.Unlock()
+	if f.rot.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compressing rotated log %s failed: %v\n", rotated, err)
+		}
+	}
+	if f.rot.MaxBackups > 0 {
+		backups, err := f.backups()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "listing rotated logs of %s failed: %v\n", f.path, err)
+			return
+		}
+		for _, name := range backups[:max(len(backups)-f.rot.MaxBackups, 0)] {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// backups lists the rotated files of f, oldest first.
+func (f *File) backups() ([]string, error) {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotatedTime, strings.TrimSuffix(suffix, ".gz")); err != nil {
+			continue
+		}
+		out = append(out, filepath.Join(dir, e.Name()))
+	}
+	// The timestamp format sorts chronologically.
+	sort.Strings(out)
+	return out, nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Reopen closes the file and opens its path again, creating it if it was moved away.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.f != nil {
+		_ = f.f.Close()
+		f.f = nil
+	}
+	return f.open()
+}
+
+// Close closes the file after pending compression and pruning finish.
+func (f *File) Close() error {
+	filesMu.Lock()
+	delete(files, f)
+	filesMu.Unlock()
+	f.mu.Lock()
+	f.closed = true
+	var err error
+	if f.f != nil {
+		err = f.f.Close()
+		f.f = nil
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileRotatesBySizeAndKeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { now = now.Add(time.Second); return now }
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n", "a line longer than max\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := readFile(t, path); got != "a line longer than max\n" {
+		t.Fatalf("current file = %q", got)
+	}
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	if got := readFile(t, backups[0]) + readFile(t, backups[1]); got != "line-3\nline-4\n" {
+		t.Fatalf("kept backups hold %q, want the newest lines", got)
+	}
+}
+
+func TestFileRotatesByAgeAndCompresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	f, err := OpenFile(path, Rotation{MaxAge: time.Hour, Compress: true})
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.now = func() time.Time { return now }
+	f.started = now
+
+	f.Write([]byte("old\n"))
+	now = now.Add(time.Hour)
+	f.Write([]byte("new\n"))
+	f.Close()
+
+	if got := readFile(t, path); got != "new\n" {
+		t.Fatalf("current file = %q", got)
+	}
+	rotated := path + "." + now.Format(rotatedTime)
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Fatalf("uncompressed rotated file should be removed, stat err=%v", err)
+	}
+	gz, err := os.Open(rotated + ".gz")
+	if err != nil {
+		t.Fatalf("compressed rotated file: %v", err)
+	}
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if string(data) != "old\n" {
+		t.Fatalf("compressed content = %q", data)
+	}
+}
+
+func TestReopenFilesAfterExternalRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+	w, err := OpenOutput(path, Rotation{})
+	if err != nil {
+		t.Fatalf("OpenOutput: %v", err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("still old\n"))
+	if err := ReopenFiles(); err != nil {
+		t.Fatalf("ReopenFiles: %v", err)
+	}
+	w.Write([]byte("after\n"))
+
+	if got := readFile(t, path+".1"); got != "before\nstill old\n" {
+		t.Fatalf("moved file = %q", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Fatalf("reopened file = %q", got)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := OpenOutput(path, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	SetOutput(w)
+	defer SetOutput(os.Stdout)
+
+	New("main").Infof("to the file")
+	if got := readFile(t, path); !strings.HasSuffix(got, "[INFO][main]to the file\n") {
+		t.Fatalf("log file = %q", got)
+	}
+}
+
+func TestFileRecoversFromFailedReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, Rotation{})
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+	// Something else takes the path, so reopening it fails.
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err == nil {
+		t.Fatalf("Reopen onto a directory should fail")
+	}
+	if _, err := f.Write([]byte("lost\n")); err == nil {
+		t.Fatalf("Write should fail while the path is unusable")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write should reopen the path once it is usable again: %v", err)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Fatalf("reopened file = %q", got)
+	}
+}
+
+func TestFileRotationNeverOverwritesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 4})
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now } // every rotation falls in the same millisecond
+
+	for _, line := range []string{"one\n", "two\n", "six\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	f.Close()
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || readFile(t, backups[0]) != "one\n" || readFile(t, backups[1]) != "two\n" {
+		t.Fatalf("expected both backups to survive in order, got %v", backups)
+	}
+}
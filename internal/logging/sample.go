@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// Sampler rate-limits repetitive messages: within each interval the first burst messages for a key are allowed
+// and the rest are suppressed. The number suppressed is reported with the next allowed message for that key, so
+// operators still see how noisy a source was. A nil Sampler, or one with a burst of 0, allows everything.
+type Sampler struct {
+	mu       sync.Mutex
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+
+	windowStart time.Time
+	counts      map[string]int
+	suppressed  map[string]int
+}
+
+// NewSampler returns a Sampler allowing burst messages per key per interval.
+func NewSampler(burst int, interval time.Duration) *Sampler {
+	s := &Sampler{now: time.Now}
+	s.Configure(burst, interval)
+	return s
+}
+
+// Configure changes the limits at runtime and starts a new window.
+func (s *Sampler) Configure(burst int, interval time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.burst = max(burst, 0)
+	s.interval = interval
+	s.windowStart = time.Time{}
+	s.counts = nil
+}
+
+// Allow reports whether a message for key should be written and, if so, how many messages for key were
+// suppressed since the last one written.
+func (s *Sampler) Allow(key string) (bool, int) {
+	if s == nil {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.burst == 0 || s.interval <= 0 {
+		return true, 0
+	}
+	now := s.now()
+	if s.counts == nil || now.Sub(s.windowStart) >= s.interval {
+		// Suppressed counts carry over only for keys seen in the window that just ended, which keeps memory
+		// bounded by recent distinct keys; a source that went quiet loses its count.
+		pending := make(map[string]int)
+		for k, n := range s.suppressed {
+			if s.counts[k] > 0 {
+				pending[k] = n
+			}
+		}
+		s.windowStart = now
+		s.counts = make(map[string]int)
+		s.suppressed = pending
+	}
+	s.counts[key]++
+	if s.counts[key] > s.burst {
+		s.suppressed[key]++
+		return false, 0
+	}
+	n := s.suppressed[key]
+	delete(s.suppressed, key)
+	return true, n
+}
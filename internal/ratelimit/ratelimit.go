@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	minChunk = 512
+	maxChunk = 32 * 1024
+)
+
+// Bucket is a token bucket measured in bytes. Consumers reserve tokens after the fact and sleep off any
+// deficit, so one bucket can be shared fairly by many connections (e.g. all clients of a tunnel).
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewBucket returns a bucket refilled at bytesPerSec with a one-second burst.
+func NewBucket(bytesPerSec int64) *Bucket {
+	rate := float64(bytesPerSec)
+	burst := rate
+	if burst < minChunk {
+		burst = minChunk
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Rate returns the current refill rate in bytes per second.
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// setRate changes the refill rate. Tokens accrued so far are kept, up to the new burst.
+func (b *Bucket) setRate(bytesPerSec int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+	b.rate = float64(bytesPerSec)
+	b.burst = max(b.rate, minChunk)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// chunk is the largest read allowed per call so a single read never accrues more than ~100ms of debt.
+func (b *Bucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := int(b.rate / 10)
+	if c < minChunk {
+		return minChunk
+	}
+	if c > maxChunk {
+		return maxChunk
+	}
+	return c
+}
+
+// reserve takes n tokens and returns how long the caller must wait to stay within the rate.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Reader throttles reads from an underlying reader through one or more buckets. Throttling the read side
+// applies TCP backpressure to the sender and leaves Close/CloseWrite handling to the owner of the conn.
+type Reader struct {
+	r       io.Reader
+	buckets []*Bucket
+	chunk   int
+}
+
+// NewReader wraps r; with no buckets it returns r unchanged.
+func NewReader(r io.Reader, buckets ...*Bucket) io.Reader {
+	if len(buckets) == 0 {
+		return r
+	}
+	chunk := maxChunk
+	for _, b := range buckets {
+		if c := b.chunk(); c < chunk {
+			chunk = c
+		}
+	}
+	return &Reader{r: r, buckets: buckets, chunk: chunk}
+}
+
+func (t *Reader) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		var sleep func(time.Duration)
+		for _, b := range t.buckets {
+			if d := b.reserve(n); d > wait {
+				wait = d
+				sleep = b.sleep
+			}
+		}
+		if wait > 0 {
+			sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// Registry hands out buckets shared by key (e.g. per client IP or per tunnel hostname) and forgets them once
+// no connection holds them.
+type Registry struct {
+	mu      sync.Mutex
+	buckets map[string]*sharedBucket
+}
+
+type sharedBucket struct {
+	bucket *Bucket
+	rates  map[int64]int // holders per requested rate; the bucket runs at the lowest
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{buckets: make(map[string]*sharedBucket)}
+}
+
+// Acquire returns the bucket for key, creating it at bytesPerSec if needed, and a release func that must be
+// called when the caller stops using it. Holders asking for different rates share one bucket running at the
+// lowest of them, so the key's aggregate never exceeds any holder's limit; the rate goes back up as the slower
+// holders release.
+func (r *Registry) Acquire(key string, bytesPerSec int64) (*Bucket, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sb, ok := r.buckets[key]
+	if !ok {
+		sb = &sharedBucket{bucket: NewBucket(bytesPerSec), rates: make(map[int64]int)}
+		r.buckets[key] = sb
+	} else if bytesPerSec < sb.bucket.Rate() {
+		sb.bucket.setRate(bytesPerSec)
+	}
+	sb.rates[bytesPerSec]++
+	var once sync.Once
+	return sb.bucket, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if sb.rates[bytesPerSec]--; sb.rates[bytesPerSec] == 0 {
+				delete(sb.rates, bytesPerSec)
+			}
+			if len(sb.rates) == 0 {
+				delete(r.buckets, key)
+				return
+			}
+			if lowest := slices.Min(slices.Collect(maps.Keys(sb.rates))); lowest != sb.bucket.Rate() {
+				sb.bucket.setRate(lowest)
+			}
+		})
+	}
+}
+
+// Len returns the number of live shared buckets.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buckets)
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the code under test sleeps.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept += d
+	c.t = c.t.Add(d)
+}
+
+func newFakeBucket(rate int64, clock *fakeClock) *Bucket {
+	b := NewBucket(rate)
+	b.now = clock.now
+	b.sleep = clock.sleep
+	b.last = clock.t
+	return b
+}
+
+func TestReaderEnforcesRateAfterBurst(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := newFakeBucket(100_000, clock)
+
+	payload := bytes.Repeat([]byte("x"), 300_000)
+	n, err := io.Copy(io.Discard, NewReader(bytes.NewReader(payload), b))
+	if err != nil || n != int64(len(payload)) {
+		t.Fatalf("copy = %d, %v", n, err)
+	}
+	// One second of burst is free; the remaining 200KB at 100KB/s must take ~2s.
+	if clock.slept < 1900*time.Millisecond || clock.slept > 2100*time.Millisecond {
+		t.Fatalf("slept %v, want ~2s", clock.slept)
+	}
+}
+
+func TestReaderUsesSlowestBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	fast := newFakeBucket(1_000_000, clock)
+	slow := newFakeBucket(10_000, clock)
+
+	payload := bytes.Repeat([]byte("x"), 30_000)
+	if _, err := io.Copy(io.Discard, NewReader(bytes.NewReader(payload), fast, slow)); err != nil {
+		t.Fatalf("copy error: %v", err)
+	}
+	if clock.slept < 1900*time.Millisecond {
+		t.Fatalf("slept %v, want the 10KB/s bucket to dominate (~2s)", clock.slept)
+	}
+}
+
+func TestReaderCapsChunkSize(t *testing.T) {
+	b := NewBucket(5_000)
+	r := NewReader(bytes.NewReader(make([]byte, 10_000)), b)
+	buf := make([]byte, 8192)
+	n, _ := r.Read(buf)
+	if n != minChunk {
+		t.Fatalf("read %d bytes, want chunk of %d", n, minChunk)
+	}
+}
+
+func TestNewReaderWithoutBucketsIsPassthrough(t *testing.T) {
+	src := bytes.NewReader(nil)
+	if NewReader(src) != io.Reader(src) {
+		t.Fatalf("expected passthrough reader")
+	}
+}
+
+func TestRegistrySharesAndReleases(t *testing.T) {
+	reg := NewRegistry()
+	a, releaseA := reg.Acquire("tunnel:cft-db.ratio1.link", 1000)
+	b, releaseB := reg.Acquire("tunnel:cft-db.ratio1.link", 1000)
+	if a != b {
+		t.Fatalf("expected the same bucket for the same key and rate")
+	}
+	c, releaseC := reg.Acquire("tunnel:cft-db.ratio1.link", 500)
+	if c != a || a.Rate() != 500 {
+		t.Fatalf("expected the shared bucket to slow down to the lower rate, got rate %d", a.Rate())
+	}
+	releaseA()
+	releaseA() // idempotent
+	if reg.Len() != 1 {
+		t.Fatalf("Len = %d after one release, want 1", reg.Len())
+	}
+	releaseC()
+	if a.Rate() != 1000 {
+		t.Fatalf("expected the rate to recover once the slower holder released, got %d", a.Rate())
+	}
+	releaseB()
+	if reg.Len() != 0 {
+		t.Fatalf("Len = %d after all releases, want 0", reg.Len())
+	}
+}
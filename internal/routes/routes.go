@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"tcp-tunnel-proxy/configs"
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+)
+
+// Route is the compiled form of configs.Route used on the connection hot path.
+type Route struct {
+	Match         string
+	MinTLSVersion uint16              // 0 means no minimum
+	CipherSuites  map[uint16]struct{} // nil means any offered suite is acceptable
+	Throttle      configs.Throttle
+	Replicas      int // cloudflared processes for the tunnel; 0 means 1
+	ServiceToken  cloudflaredmanager.ServiceToken
+}
+
+// Table resolves an SNI to the first matching route.
+type Table struct {
+	routes []*Route
+}
+
+// New compiles route configuration into a lookup table.
+func New(cfgs []configs.Route) (*Table, error) {
+	t := &Table{routes: make([]*Route, 0, len(cfgs))}
+	for i, rc := range cfgs {
+		r := &Route{Match: strings.ToLower(strings.TrimSpace(rc.Match)), Throttle: rc.Throttle, Replicas: rc.Replicas}
+		if rc.ServiceToken != nil {
+			id, secret, err := rc.ServiceToken.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			r.ServiceToken = cloudflaredmanager.ServiceToken{ID: id, Secret: secret}
+		}
+		if rc.MinTLSVersion != "" {
+			v, err := configs.ParseTLSVersion(rc.MinTLSVersion)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			r.MinTLSVersion = v
+		}
+		if len(rc.CipherSuites) > 0 || rc.SecureCiphersOnly {
+			r.CipherSuites = make(map[uint16]struct{})
+		}
+		for _, name := range rc.CipherSuites {
+			id, err := configs.ParseCipherSuite(name)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			if rc.SecureCiphersOnly && !configs.SecureCipherSuite(id) {
+				continue
+			}
+			r.CipherSuites[id] = struct{}{}
+		}
+		if rc.SecureCiphersOnly && len(rc.CipherSuites) == 0 {
+			for _, cs := range tls.CipherSuites() {
+				r.CipherSuites[cs.ID] = struct{}{}
+			}
+		}
+		t.routes = append(t.routes, r)
+	}
+	return t, nil
+}
+
+// Lookup returns the first route matching sni, or nil when none applies.
+func (t *Table) Lookup(sni string) *Route {
+	if t == nil {
+		return nil
+	}
+	sni = strings.ToLower(strings.TrimSpace(sni))
+	for _, r := range t.routes {
+		if matches(r.Match, sni) {
+			return r
+		}
+	}
+	return nil
+}
+
+func matches(pattern, sni string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(sni, pattern[1:]) && len(sni) > len(pattern)-1
+	default:
+		return pattern == sni
+	}
+}
@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"tcp-tunnel-proxy/configs"
+)
+
+func TestRoutesLookupWildcards(t *testing.T) {
+	table, err := New([]configs.Route{{Match: "exact.link"}, {Match: "*.wild.link"}})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if r := table.Lookup("EXACT.link"); r == nil || r.Match != "exact.link" {
+		t.Fatalf("exact lookup failed: %+v", r)
+	}
+	if r := table.Lookup("a.b.wild.link"); r == nil || r.Match != "*.wild.link" {
+		t.Fatalf("wildcard lookup failed: %+v", r)
+	}
+	if r := table.Lookup("wild.link"); r != nil {
+		t.Fatalf("wildcard must not match the bare suffix, got %+v", r)
+	}
+}
+
+func TestRoutesResolveServiceToken(t *testing.T) {
+	t.Setenv("ROUTE_TOKEN_ID", "id.access")
+	t.Setenv("ROUTE_TOKEN_SECRET", "s3cr3t")
+	table, err := New([]configs.Route{{Match: "*", ServiceToken: &configs.ServiceTokenRef{ID: "env:ROUTE_TOKEN_ID", Secret: "env:ROUTE_TOKEN_SECRET"}}})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if tok := table.Lookup("db.example.com").ServiceToken; tok.ID != "id.access" || tok.Secret != "s3cr3t" {
+		t.Fatalf("token not resolved: %v", tok)
+	}
+
+	t.Setenv("ROUTE_TOKEN_SECRET", "")
+	if _, err := New([]configs.Route{{Match: "*", ServiceToken: &configs.ServiceTokenRef{ID: "env:ROUTE_TOKEN_ID", Secret: "env:ROUTE_TOKEN_SECRET"}}}); err == nil {
+		t.Fatalf("expected error for an empty secret")
+	}
+}
+
+func TestRoutesSecureCiphersOnlyFiltersListedSuites(t *testing.T) {
+	table, err := New([]configs.Route{{
+		Match:             "*",
+		SecureCiphersOnly: true,
+		CipherSuites:      []string{"TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"},
+	}})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	suites := table.Lookup("db.example.com").CipherSuites
+	if _, ok := suites[tls.TLS_AES_128_GCM_SHA256]; !ok || len(suites) != 1 {
+		t.Fatalf("expected only the secure listed suite, got %v", suites)
+	}
+}
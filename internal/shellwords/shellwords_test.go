@@ -0,0 +1,42 @@
+package shellwords
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	cases := map[string][]string{
+		"":                                       nil,
+		"  --loglevel   debug ":                  {"--loglevel", "debug"},
+		`--header 'X-A: b c' "d\"e"`:             {"--header", "X-A: b c", `d"e`},
+		`a\ b 'it'\''s' "x"y`:                    {"a b", "it's", "xy"},
+		`"" ''`:                                  {"", ""},
+		"--protocol\thttp2\n--edge-ip-version 4": {"--protocol", "http2", "--edge-ip-version", "4"},
+	}
+	for in, want := range cases {
+		got, err := Split(in)
+		if err != nil {
+			t.Fatalf("Split(%q): %v", in, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Split(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for _, bad := range []string{`'open`, `"open`, `trailing\`} {
+		if _, err := Split(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestJoinRoundTrip(t *testing.T) {
+	args := []string{"plain", "with space", "it's", `$HOME`, "", `back\slash`, "--flag=a|b"}
+	got, err := Split(Join(args))
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Fatalf("round trip: got %q, want %q", got, args)
+	}
+}
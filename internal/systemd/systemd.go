@@ -0,0 +1,137 @@
+// Package systemd implements the parts of the systemd service protocol the proxy uses: socket activation
+// (LISTEN_FDS), readiness and status notifications (NOTIFY_SOCKET) and the watchdog (WATCHDOG_USEC).
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first descriptor passed by socket activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// Sockets returns the sockets passed by socket activation, keyed by the listener names in wanted. A socket is
+// matched by its FileDescriptorName=; sockets with any other name fill the wanted names not yet matched, in
+// order. The LISTEN_* variables are removed from the environment so children do not see them.
+func Sockets(wanted ...string) (map[string]*os.File, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	out := make(map[string]*os.File)
+	var unmatched []*os.File
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		if slices.Contains(wanted, name) && out[name] == nil {
+			out[name] = f
+		} else {
+			unmatched = append(unmatched, f)
+		}
+	}
+	for _, name := range wanted {
+		if out[name] == nil && len(unmatched) > 0 {
+			out[name], unmatched = unmatched[0], unmatched[1:]
+		}
+	}
+	for _, f := range unmatched {
+		f.Close()
+	}
+	if len(unmatched) > 0 {
+		return out, fmt.Errorf("%d activated sockets not used (expected at most %d)", len(unmatched), len(wanted))
+	}
+	return out, nil
+}
+
+// Notifier sends state updates to the service manager. The zero value (and a Notifier created without
+// NOTIFY_SOCKET) discards them.
+type Notifier struct {
+	addr string
+}
+
+// NewNotifier returns a Notifier for $NOTIFY_SOCKET.
+func NewNotifier() *Notifier {
+	return &Notifier{addr: os.Getenv("NOTIFY_SOCKET")}
+}
+
+// Enabled reports whether notifications go anywhere.
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.addr != ""
+}
+
+// Notify sends one or more newline-separated KEY=VALUE assignments, e.g. "READY=1".
+func (n *Notifier) Notify(state string) error {
+	if !n.Enabled() {
+		return nil
+	}
+	addr := n.addr
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often WATCHDOG=1 should be sent (half of WATCHDOG_USEC), or 0 when the
+// watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Heartbeat sends STATUS= every interval and, when watchdog is set, WATCHDOG=1 as long as check passes. A
+// failing check withholds the ping, so systemd restarts a process that is stuck. It returns when ctx is done.
+func (n *Notifier) Heartbeat(ctx context.Context, interval time.Duration, watchdog bool, check func() error, status func() string, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		state := "STATUS=" + status()
+		if watchdog {
+			if err := check(); err != nil {
+				onError(err)
+			} else {
+				state += "\nWATCHDOG=1"
+			}
+		}
+		if err := n.Notify(state); err != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("SYSTEMD_SOCKETS_HELPER") == "1" {
+		runSocketsHelper()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runSocketsHelper plays a socket-activated process and prints name=address for every socket it received.
+func runSocketsHelper() {
+	// systemd sets LISTEN_PID after fork; the test cannot know our PID in advance.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	socks, err := Sockets("proxy", "admin")
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	for name, f := range socks {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s=%s\n", name, ln.Addr())
+	}
+	fmt.Printf("env=%q\n", os.Getenv("LISTEN_FDS"))
+}
+
+// fakeNotifySocket listens like systemd's notify socket and returns the received datagrams.
+func fakeNotifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets not available")
+	}
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func receive(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no notification received")
+		return ""
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+	n := NewNotifier()
+	if !n.Enabled() {
+		t.Fatalf("notifier should be enabled with NOTIFY_SOCKET set")
+	}
+	if err := n.Notify("READY=1\nSTATUS=ok"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := receive(t, msgs); got != "READY=1\nSTATUS=ok" {
+		t.Fatalf("unexpected notification %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if n := NewNotifier(); n.Enabled() || n.Notify("READY=1") != nil {
+		t.Fatalf("notifier without NOTIFY_SOCKET should be a silent no-op")
+	}
+	var zero *Notifier
+	if zero.Notify("READY=1") != nil {
+		t.Fatalf("nil notifier should be a no-op")
+	}
+}
+
+func TestNotifierAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	name := fmt.Sprintf("tcp-tunnel-proxy-test-%d", os.Getpid())
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen abstract socket: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	if err := NewNotifier().Notify("WATCHDOG=1"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Fatalf("unexpected datagram %q (%v)", buf[:n], err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "20000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 10*time.Second {
+		t.Fatalf("WatchdogInterval = %s, want 10s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := WatchdogInterval(); got != 10*time.Second {
+		t.Fatalf("WatchdogInterval for our PID = %s, want 10s", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := WatchdogInterval(); got != 0 {
+		t.Fatalf("watchdog meant for another process should be disabled, got %s", got)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := WatchdogInterval(); got != 0 {
+		t.Fatalf("watchdog should be disabled without WATCHDOG_USEC, got %s", got)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+	var healthy atomic.Bool
+	healthy.Store(true)
+	var errs atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewNotifier().Heartbeat(ctx, 20*time.Millisecond, true,
+			func() error {
+				if healthy.Load() {
+					return nil
+				}
+				return errors.New("stuck")
+			},
+			func() string { return "2 tunnels, 5 connections" },
+			func(error) { errs.Add(1) })
+	}()
+
+	if got := receive(t, msgs); got != "STATUS=2 tunnels, 5 connections\nWATCHDOG=1" {
+		t.Fatalf("unexpected healthy heartbeat %q", got)
+	}
+	healthy.Store(false)
+	for {
+		got := receive(t, msgs)
+		if !strings.Contains(got, "WATCHDOG=1") {
+			if got != "STATUS=2 tunnels, 5 connections" {
+				t.Fatalf("unexpected unhealthy heartbeat %q", got)
+			}
+			break
+		}
+	}
+	cancel()
+	<-done
+	if errs.Load() == 0 {
+		t.Fatalf("failed checks should be reported")
+	}
+}
+
+func TestSocketsIgnoresOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	socks, err := Sockets("proxy")
+	if err != nil || socks != nil {
+		t.Fatalf("sockets for another PID must be ignored, got %v (%v)", socks, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Fatalf("LISTEN_FDS should be removed from the environment")
+	}
+}
+
+func TestSocketsActivation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("descriptor passing not available")
+	}
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File: %v", err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	cmd := exec.Command(exe)
+	cmd.ExtraFiles = files
+	// The first socket is named for the admin listener; the second carries the socket unit's default name.
+	cmd.Env = append(os.Environ(), "SYSTEMD_SOCKETS_HELPER=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=admin:tcp-tunnel-proxy.socket")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("helper failed: %v\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(lines)
+	want := []string{"admin=" + addrs[0], `env=""`, "proxy=" + addrs[1]}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("helper reported\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
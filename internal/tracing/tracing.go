@@ -0,0 +1,182 @@
+// Package tracing records spans and exports them to an OpenTelemetry collector over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Attr is a span attribute. Values are strings, bools, ints, int64s or float64s.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attr    { return Attr{key, value} }
+func Int(key string, value int) Attr   { return Attr{key, int64(value)} }
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+)
+
+// Config configures a Tracer.
+type Config struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, e.g. http://localhost:4318; /v1/traces is appended
+	// unless the URL already has a path.
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the fraction of traces recorded, 0-1. The decision is taken for the root span from its
+	// trace ID and inherited by its children.
+	SampleRatio float64
+	// BatchSize is the most spans per export request (default 512).
+	BatchSize int
+	// FlushInterval is how long a finished span may wait for its batch to fill (default 5s).
+	FlushInterval time.Duration
+	// Timeout bounds each export request (default 10s).
+	Timeout time.Duration
+}
+
+// Tracer creates spans and hands finished, sampled ones to its exporter. A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	ratio float64
+	exp   *exporter
+}
+
+// New validates cfg and starts the exporter; Shutdown flushes it.
+func New(cfg Config) (*Tracer, error) {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio must be 0-1, got %g", cfg.SampleRatio)
+	}
+	exp, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{ratio: cfg.SampleRatio, exp: exp}, nil
+}
+
+// Shutdown exports the spans still queued, waiting at most until ctx is done. Spans ended later are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exp.shutdown(ctx)
+}
+
+// Start begins an internal span, as a child of the span in ctx if there is one.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	return t.start(ctx, name, KindInternal, attrs)
+}
+
+// StartServer begins a span for handling an inbound request, usually the root of a trace.
+func (t *Tracer) StartServer(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	return t.start(ctx, name, KindServer, attrs)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind Kind, attrs []Attr) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample keeps a trace when the low 8 bytes of its ID fall below ratio of their range, as the OpenTelemetry
+// TraceIDRatioBased sampler does, so every service sampling at the same ratio agrees.
+func (t *Tracer) sample(id [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.ratio*(1<<63))
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span started into ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Span is one timed operation. Its methods are safe for concurrent use and do nothing on a nil Span.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []Attr
+	errMsg   string
+	hasError bool
+	ended    bool
+}
+
+// SetAttributes adds or overrides attributes.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// RecordError marks the span failed with err; a nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasError = true
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export; later calls are no-ops.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		s.tracer.exp.enqueue(s)
+	}
+}
+
+// TraceID returns the span's trace ID in hex, for correlating logs with traces.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", s.traceID)
+}
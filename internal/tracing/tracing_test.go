@@ -0,0 +1,129 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/internal/tracing"
+	"tcp-tunnel-proxy/internal/tracing/tracingtest"
+)
+
+func TestExportToCollector(t *testing.T) {
+	c := tracingtest.NewCollector(t)
+	tr, err := tracing.New(tracing.Config{Endpoint: c.URL, ServiceName: "proxy-test", SampleRatio: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx, root := tr.StartServer(context.Background(), "HandleConnection", tracing.String("sni", "db.example.com"))
+	_, child := tr.Start(ctx, "GetOrStart", tracing.Int("port", 20000))
+	child.SetAttributes(tracing.Bool("cached", true), tracing.Int("port", 20002))
+	child.RecordError(errors.New("circuit breaker open"))
+	child.End()
+	child.End() // idempotent
+	root.End()
+
+	// Shutdown flushes even though the flush interval has not passed.
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	spans := c.WaitFor(t, "HandleConnection", "GetOrStart")
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", spans)
+	}
+	byName := map[string]tracingtest.Span{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	r, g := byName["HandleConnection"], byName["GetOrStart"]
+	if r.TraceID != root.TraceID() || g.TraceID != r.TraceID || g.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Fatalf("spans not linked: root %+v child %+v", r, g)
+	}
+	if r.Kind != int(tracing.KindServer) || g.Kind != int(tracing.KindInternal) || r.Service != "proxy-test" {
+		t.Fatalf("unexpected kinds or service: %+v %+v", r, g)
+	}
+	if r.Attributes["sni"] != "db.example.com" || g.Attributes["port"] != int64(20002) || g.Attributes["cached"] != true {
+		t.Fatalf("unexpected attributes: %v %v", r.Attributes, g.Attributes)
+	}
+	if g.StatusCode != 2 || g.StatusMsg != "circuit breaker open" || r.StatusCode != 0 {
+		t.Fatalf("unexpected status: %+v %+v", r, g)
+	}
+	if !g.End.After(g.Start) && !g.End.Equal(g.Start) || r.End.Before(g.End) {
+		t.Fatalf("unexpected timing: root %s-%s child %s-%s", r.Start, r.End, g.Start, g.End)
+	}
+
+	// Spans ended after Shutdown are dropped.
+	_, late := tr.Start(context.Background(), "late")
+	late.End()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.Spans()); n != 2 {
+		t.Fatalf("expected no export after shutdown, got %d spans", n)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	c := tracingtest.NewCollector(t)
+	tr, err := tracing.New(tracing.Config{Endpoint: c.URL + "/v1/traces", SampleRatio: 0})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, root := tr.StartServer(context.Background(), "dropped")
+	_, child := tr.Start(ctx, "dropped-child")
+	child.End()
+	root.End()
+	if root.TraceID() == "" {
+		t.Fatalf("unsampled spans still carry a trace ID")
+	}
+
+	half, err := tracing.New(tracing.Config{Endpoint: c.URL, SampleRatio: 0.5, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		_, s := half.Start(context.Background(), "maybe")
+		s.End()
+	}
+	if err := half.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	n := 0
+	for _, s := range c.Spans() {
+		if s.Name != "maybe" {
+			t.Fatalf("unsampled span exported: %+v", s)
+		}
+		n++
+	}
+	if n < 50 || n > 150 {
+		t.Fatalf("expected about half of 200 traces sampled, got %d", n)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *tracing.Tracer
+	ctx, s := tr.Start(context.Background(), "noop")
+	s.SetAttributes(tracing.String("k", "v"))
+	s.RecordError(errors.New("ignored"))
+	s.End()
+	if s != nil || tracing.SpanFromContext(ctx) != nil || s.TraceID() != "" {
+		t.Fatalf("nil tracer should not create spans")
+	}
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	for _, cfg := range []tracing.Config{
+		{Endpoint: "localhost:4318", SampleRatio: 1},
+		{Endpoint: "http://localhost:4318", SampleRatio: 1.5},
+	} {
+		if _, err := tracing.New(cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package tracingtest provides an in-process OTLP/HTTP collector for tests.
+package tracingtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Span is the part of an exported span tests look at.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Start, End   time.Time
+	Attributes   map[string]any // strings, bools, int64s and float64s
+	StatusCode   int
+	StatusMsg    string
+	Service      string
+}
+
+// Collector accepts OTLP/JSON trace exports on /v1/traces.
+type Collector struct {
+	URL string // base URL to use as the exporter endpoint
+
+	srv   *httptest.Server
+	mu    sync.Mutex
+	spans []Span
+	added chan struct{}
+}
+
+// NewCollector starts a collector that is closed when the test ends.
+func NewCollector(t testing.TB) *Collector {
+	c := &Collector{added: make(chan struct{}, 1)}
+	c.srv = httptest.NewServer(http.HandlerFunc(c.handle))
+	c.URL = c.srv.URL
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+// Spans returns everything received so far.
+func (c *Collector) Spans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span(nil), c.spans...)
+}
+
+// WaitFor waits until a span with each of names has arrived and returns all spans received.
+func (c *Collector) WaitFor(t testing.TB, names ...string) []Span {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		spans := c.Spans()
+		seen := map[string]bool{}
+		for _, s := range spans {
+			seen[s.Name] = true
+		}
+		missing := ""
+		for _, n := range names {
+			if !seen[n] {
+				missing = n
+				break
+			}
+		}
+		if missing == "" {
+			return spans
+		}
+		select {
+		case <-c.added:
+		case <-deadline:
+			t.Fatalf("span %q not exported; got %d span(s)", missing, len(spans))
+		}
+	}
+}
+
+type request struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID           string     `json:"traceId"`
+				SpanID            string     `json:"spanId"`
+				ParentSpanID      string     `json:"parentSpanId"`
+				Name              string     `json:"name"`
+				Kind              int        `json:"kind"`
+				StartTimeUnixNano string     `json:"startTimeUnixNano"`
+				EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+				Attributes        []keyValue `json:"attributes"`
+				Status            struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue"`
+		BoolValue   *bool    `json:"boolValue"`
+		IntValue    *string  `json:"intValue"`
+		DoubleValue *float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+func (c *Collector) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "expected a JSON POST to /v1/traces", http.StatusBadRequest)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var got []Span
+	for _, rs := range req.ResourceSpans {
+		service, _ := attrs(rs.Resource.Attributes)["service.name"].(string)
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				got = append(got, Span{
+					TraceID:      s.TraceID,
+					SpanID:       s.SpanID,
+					ParentSpanID: s.ParentSpanID,
+					Name:         s.Name,
+					Kind:         s.Kind,
+					Start:        unixNano(s.StartTimeUnixNano),
+					End:          unixNano(s.EndTimeUnixNano),
+					Attributes:   attrs(s.Attributes),
+					StatusCode:   s.Status.Code,
+					StatusMsg:    s.Status.Message,
+					Service:      service,
+				})
+			}
+		}
+	}
+	c.mu.Lock()
+	c.spans = append(c.spans, got...)
+	c.mu.Unlock()
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+}
+
+func attrs(kvs []keyValue) map[string]any {
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		switch v := kv.Value; {
+		case v.StringValue != nil:
+			m[kv.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			m[kv.Key] = *v.BoolValue
+		case v.IntValue != nil:
+			var n int64
+			_ = json.Unmarshal([]byte(*v.IntValue), &n)
+			m[kv.Key] = n
+		case v.DoubleValue != nil:
+			m[kv.Key] = *v.DoubleValue
+		}
+	}
+	return m
+}
+
+func unixNano(s string) time.Time {
+	var n int64
+	_ = json.Unmarshal([]byte(s), &n)
+	return time.Unix(0, n)
+}
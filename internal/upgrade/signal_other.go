@@ -0,0 +1,8 @@
+//go:build !unix
+
+package upgrade
+
+import "os"
+
+// Notify is a no-op where there is no upgrade signal; upgrades can still be triggered via the admin endpoint.
+func Notify(c chan<- os.Signal) {}
@@ -0,0 +1,288 @@
+// Package upgrade re-executes the running binary with its listening sockets, so a new version can start
+// accepting connections before the old process stops.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envListeners = "TUNNEL_PROXY_UPGRADE_LISTENERS" // name=fd,... of inherited listening sockets
+	envReady     = "TUNNEL_PROXY_UPGRADE_READY"     // fd of the pipe the new process writes to once it accepts
+)
+
+// ErrInProgress is returned by Upgrade when an upgrade has already been started (or completed) by this process.
+var ErrInProgress = errors.New("upgrade already in progress")
+
+// Upgrader tracks the listeners a process hands to its successor. When the process was itself started by
+// Upgrade, Listen returns the inherited sockets instead of binding new ones.
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	ready     *os.File // nil once Ready has reported back
+	child     bool     // started by Upgrade
+	listeners map[string]net.Listener
+	names     []string // registration order, so descriptors are passed in a stable order
+	upgrading bool
+}
+
+// New returns an Upgrader, picking up sockets passed by a parent process. The handoff variables are removed
+// from the environment so they do not leak into children.
+func New() (*Upgrader, error) {
+	u := &Upgrader{inherited: make(map[string]*os.File), listeners: make(map[string]net.Listener)}
+	spec, hasSpec := os.LookupEnv(envListeners)
+	readySpec, hasReady := os.LookupEnv(envReady)
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+	if hasSpec {
+		fds, err := parseListeners(spec)
+		if err != nil {
+			return nil, err
+		}
+		for name, fd := range fds {
+			u.inherited[name] = os.NewFile(uintptr(fd), name)
+		}
+	}
+	if hasReady {
+		fd, err := strconv.Atoi(readySpec)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid %s %q", envReady, readySpec)
+		}
+		u.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+		u.child = true
+	}
+	return u, nil
+}
+
+// parseListeners parses "name=fd,name=fd".
+func parseListeners(spec string) (map[string]int, error) {
+	out := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		if item == "" {
+			continue
+		}
+		name, fdStr, ok := strings.Cut(item, "=")
+		fd, err := strconv.Atoi(fdStr)
+		if !ok || name == "" || err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid %s entry %q", envListeners, item)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("duplicate %s entry %q", envListeners, name)
+		}
+		out[name] = fd
+	}
+	return out, nil
+}
+
+// Adopt offers a listening socket obtained elsewhere (e.g. from systemd socket activation) under name. Listen
+// uses it unless a socket of that name was inherited from a parent process, which takes precedence.
+func (u *Upgrader) Adopt(name string, f *os.File) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.inherited[name]; ok {
+		f.Close()
+		return
+	}
+	u.inherited[name] = f
+}
+
+// Inherited reports whether this process was started by Upgrade.
+func (u *Upgrader) Inherited() bool {
+	return u.child
+}
+
+// Listen returns the TCP listener registered under name: the one inherited from the parent if there is one,
+// otherwise a new one bound to addr. Listeners obtained here are passed on by Upgrade.
+func (u *Upgrader) Listen(name, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.listeners[name]; ok {
+		return nil, fmt.Errorf("listener %q already registered", name)
+	}
+	var ln net.Listener
+	if f, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %q: %w", name, err)
+		}
+		if _, ok := ln.(*net.TCPListener); !ok {
+			ln.Close()
+			return nil, fmt.Errorf("inherited listener %q is not a TCP listener", name)
+		}
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.listeners[name] = ln
+	u.names = append(u.names, name)
+	return ln, nil
+}
+
+// Register makes ln the listener passed on under name, replacing any earlier one (e.g. after a configuration
+// reload moved it to another address). Closing the replaced listener is up to the caller.
+func (u *Upgrader) Register(name string, ln net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.listeners[name]; !ok {
+		u.names = append(u.names, name)
+	}
+	u.listeners[name] = ln
+}
+
+// Forget stops passing on the listener registered under name.
+func (u *Upgrader) Forget(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.listeners[name]; !ok {
+		return
+	}
+	delete(u.listeners, name)
+	for i, n := range u.names {
+		if n == name {
+			u.names = append(u.names[:i:i], u.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Ready tells the parent, if any, that this process is accepting connections, and closes inherited or adopted
+// sockets that were not claimed with Listen (e.g. a listener the new configuration no longer uses).
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+// Upgrade starts the current executable (as found on disk now, so a replaced binary is picked up) with the
+// same arguments and environment, passing every registered listener. Service manager variables that describe
+// this process (LISTEN_*, WATCHDOG_PID) are not passed on. It returns the new PID once the new
+// process has called Ready, or an error if it exits or fails to become ready within timeout, in which case it is
+// killed and this process carries on as before.
+func (u *Upgrader) Upgrade(timeout time.Duration) (int, error) {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, ErrInProgress
+	}
+	u.upgrading = true
+	names := append([]string(nil), u.names...)
+	listeners := make([]net.Listener, len(names))
+	for i, name := range names {
+		listeners[i] = u.listeners[name]
+	}
+	u.mu.Unlock()
+
+	pid, err := u.start(names, listeners, timeout)
+	if err != nil {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}
+	return pid, err
+}
+
+func (u *Upgrader) start(names []string, listeners []net.Listener, timeout time.Duration) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("locate executable: %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	spec := make([]string, 0, len(names))
+	for i, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %q cannot be passed on", names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, fmt.Errorf("listener %q: %w", names[i], err)
+		}
+		files = append(files, f)
+		// ExtraFiles[i] becomes descriptor 3+i in the child.
+		spec = append(spec, fmt.Sprintf("%s=%d", names[i], 2+len(files)))
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(envListeners, envReady, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID"),
+		envListeners+"="+strings.Join(spec, ","),
+		envReady+"="+strconv.Itoa(2+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start %s: %w", exe, err)
+	}
+	// Our copy of the write end must be closed, or a new process that dies would never produce EOF.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }() // also reaps the new process should it exit while we drain
+	readCh := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := io.ReadFull(readyR, b[:])
+		readCh <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-readCh:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		_ = cmd.Process.Kill()
+		return 0, fmt.Errorf("new process %d exited before becoming ready: %v", cmd.Process.Pid, <-exited)
+	case err := <-exited:
+		return 0, fmt.Errorf("new process %d exited before becoming ready: %v", cmd.Process.Pid, err)
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		return 0, fmt.Errorf("new process %d not ready within %s", cmd.Process.Pid, timeout)
+	}
+}
+
+func environWithout(keys ...string) []string {
+	return slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(keys, name)
+	})
+}
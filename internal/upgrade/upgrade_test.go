@@ -0,0 +1,206 @@
+package upgrade
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("UPGRADE_HELPER") {
+	case "":
+		os.Exit(m.Run())
+	case "serve":
+		runServeHelper()
+	case "fail":
+		os.Exit(3)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+}
+
+// runServeHelper plays the upgraded process: it claims the inherited "proxy" listener and answers "new".
+func runServeHelper() {
+	u, err := New()
+	if err != nil || !u.Inherited() {
+		os.Exit(4)
+	}
+	ln, err := u.Listen("proxy", "")
+	if err != nil {
+		os.Exit(5)
+	}
+	if err := u.Ready(); err != nil || !u.Inherited() {
+		os.Exit(6)
+	}
+	time.AfterFunc(time.Minute, func() { os.Exit(0) })
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			os.Exit(0)
+		}
+		_, _ = c.Write([]byte("new"))
+		c.Close()
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	got, err := parseListeners("proxy=3,admin=4")
+	if err != nil || !reflect.DeepEqual(got, map[string]int{"proxy": 3, "admin": 4}) {
+		t.Fatalf("parseListeners = %v, %v", got, err)
+	}
+	for _, bad := range []string{"proxy", "proxy=x", "proxy=1", "=3", "a=3,a=4"} {
+		if _, err := parseListeners(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpgradeHandsOverListener(t *testing.T) {
+	t.Setenv("UPGRADE_HELPER", "serve")
+	u, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if u.Inherited() {
+		t.Fatalf("test process should not look inherited")
+	}
+	ln, err := u.Listen("proxy", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	unused, err := u.Listen("admin", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	pid, err := u.Upgrade(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	t.Cleanup(func() {
+		if p, err := os.FindProcess(pid); err == nil {
+			_ = p.Kill()
+		}
+	})
+	if _, err := u.Upgrade(time.Second); !errors.Is(err, ErrInProgress) {
+		t.Fatalf("second upgrade should be refused, got %v", err)
+	}
+
+	// Once the old process stops accepting, the new one serves the same address.
+	addr := ln.Addr().String()
+	ln.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial after handoff: %v", err)
+	}
+	b, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(b) != "new" {
+		t.Fatalf("expected the new process to answer, got %q", b)
+	}
+
+	// The listener the new process did not claim was closed there, so it is gone with ours.
+	unusedAddr := unused.Addr().String()
+	unused.Close()
+	if c, err := net.DialTimeout("tcp", unusedAddr, time.Second); err == nil {
+		c.Close()
+		t.Fatalf("unclaimed listener %s still accepting", unusedAddr)
+	}
+}
+
+func TestUpgradeFailures(t *testing.T) {
+	for _, tc := range []struct {
+		helper string
+		want   string
+	}{
+		{"fail", "exited before becoming ready"},
+		{"hang", "not ready within"},
+	} {
+		t.Run(tc.helper, func(t *testing.T) {
+			t.Setenv("UPGRADE_HELPER", tc.helper)
+			u, err := New()
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			ln, err := u.Listen("proxy", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer ln.Close()
+			if _, err := u.Upgrade(500 * time.Millisecond); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected %q error, got %v", tc.want, err)
+			}
+			// A failed upgrade can be retried.
+			if _, err := u.Upgrade(500 * time.Millisecond); errors.Is(err, ErrInProgress) {
+				t.Fatalf("failed upgrade should allow a retry")
+			}
+		})
+	}
+}
+
+func TestListenUsesAdoptedSocket(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer orig.Close()
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+
+	u, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u.Adopt("proxy", f)
+	ln, err := u.Listen("proxy", "127.0.0.1:1") // the address is ignored for adopted sockets
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != orig.Addr().String() {
+		t.Fatalf("expected adopted socket %s, got %s", orig.Addr(), ln.Addr())
+	}
+	if _, err := u.Listen("proxy", "127.0.0.1:0"); err == nil {
+		t.Fatalf("registering a name twice should fail")
+	}
+}
+
+func TestRegisterAndForget(t *testing.T) {
+	u, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	proxy, err := u.Listen("proxy", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer proxy.Close()
+	admin, err := u.Listen("admin", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer admin.Close()
+	moved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer moved.Close()
+
+	u.Register("proxy", moved)
+	u.Forget("admin")
+	u.Forget("missing")
+	if len(u.names) != 1 || u.names[0] != "proxy" || u.listeners["proxy"] != moved {
+		t.Fatalf("expected only the moved proxy listener, got %v %v", u.names, u.listeners)
+	}
+	u.Register("admin", admin)
+	if strings.Join(u.names, ",") != "proxy,admin" {
+		t.Fatalf("re-registered listener should be passed on again, got %v", u.names)
+	}
+}
@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+	"tcp-tunnel-proxy/internal/logging"
+)
+
+// Config controls where and how tunnel events are delivered.
+type Config struct {
+	URL string // http or https endpoint receiving POSTed batches
+	// Types restricts delivery to these events; empty means all.
+	Types []cloudflaredmanager.EventType
+	// BatchSize is the most events sent in one request (default 20).
+	BatchSize int
+	// FlushInterval is how long an event may wait for a batch to fill up (default 2s).
+	FlushInterval time.Duration
+	// MaxRetries is how often a failed request is retried before the batch is dropped; 0 sends once.
+	MaxRetries int
+	// Timeout bounds each request (default 10s).
+	Timeout time.Duration
+}
+
+// Payload is the JSON body of every request.
+type Payload struct {
+	Events []cloudflaredmanager.Event `json:"events"`
+}
+
+// Sink batches tunnel events and POSTs them to a webhook.
+type Sink struct {
+	url           string
+	types         map[cloudflaredmanager.EventType]bool
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration // delay before the first retry, doubled per attempt up to maxRetryBackoff
+	client        *http.Client
+	logger        *logging.Logger
+}
+
+const maxRetryBackoff = 30 * time.Second
+
+// New validates cfg and returns a sink; call Run to start delivering.
+func New(cfg Config) (*Sink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("webhook url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook url %q must be an absolute http or https URL", cfg.URL)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 20
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 2 * time.Second
+	}
+	cfg.MaxRetries = max(cfg.MaxRetries, 0)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	s := &Sink{
+		url:           cfg.URL,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		maxRetries:    cfg.MaxRetries,
+		retryBackoff:  time.Second,
+		client:        &http.Client{Timeout: cfg.Timeout},
+		logger:        logging.New("webhook"),
+	}
+	if len(cfg.Types) > 0 {
+		s.types = make(map[cloudflaredmanager.EventType]bool, len(cfg.Types))
+		for _, t := range cfg.Types {
+			s.types[t] = true
+		}
+	}
+	return s, nil
+}
+
+// Run delivers events until the channel is closed or ctx is done, then sends what is still batched.
+// Requests are sent one at a time, so while a batch is being retried new events queue up in the channel.
+func (s *Sink) Run(ctx context.Context, events <-chan cloudflaredmanager.Event) {
+	var batch []cloudflaredmanager.Event
+	timer := time.NewTimer(s.flushInterval)
+	timer.Stop()
+	flush := func(ctx context.Context) {
+		timer.Stop()
+		if len(batch) > 0 {
+			s.send(ctx, batch)
+			batch = nil
+		}
+	}
+	// The final flush gets one attempt-sized grace period even though ctx is done.
+	final := func() {
+		fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.client.Timeout)
+		defer cancel()
+		flush(fctx)
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				final()
+				return
+			}
+			if s.types != nil && !s.types[ev.Type] {
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(s.flushInterval)
+			}
+			batch = append(batch, ev)
+			if len(batch) >= s.batchSize {
+				flush(ctx)
+			}
+		case <-timer.C:
+			flush(ctx)
+		case <-ctx.Done():
+			final()
+			return
+		}
+	}
+}
+
+// send posts one batch, retrying network errors, 429s and 5xx responses with exponential backoff.
+func (s *Sink) send(ctx context.Context, batch []cloudflaredmanager.Event) {
+	body, err := json.Marshal(Payload{Events: batch})
+	if err != nil {
+		s.logger.Errorf("Dropping %d event(s): %v", len(batch), err)
+		return
+	}
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= s.maxRetries || ctx.Err() != nil {
+			s.logger.Errorf("Dropping %d event(s) after %d attempt(s): %v", len(batch), attempt+1, err)
+			return
+		}
+		s.logger.Errorf("Webhook delivery failed (attempt %d/%d), retrying in %s: %v", attempt+1, s.maxRetries+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			s.logger.Errorf("Dropping %d event(s): %v", len(batch), ctx.Err())
+			return
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+func (s *Sink) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tcp-tunnel-proxy")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook returned %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
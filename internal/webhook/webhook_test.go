@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	cloudflaredmanager "tcp-tunnel-proxy/internal/cloudflared_manager"
+)
+
+// recorder is a webhook endpoint that fails the first failures requests with 503.
+type recorder struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	batches  [][]cloudflaredmanager.Event
+	got      chan struct{}
+}
+
+func newRecorder(failures int) (*recorder, *httptest.Server) {
+	rec := &recorder{failures: failures, got: make(chan struct{}, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.attempts++
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if rec.attempts <= rec.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rec.batches = append(rec.batches, p.Events)
+		rec.got <- struct{}{}
+	}))
+	return rec, srv
+}
+
+func (rec *recorder) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-rec.got:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no batch delivered")
+	}
+}
+
+func TestSinkBatchesAndFilters(t *testing.T) {
+	rec, srv := newRecorder(0)
+	defer srv.Close()
+	s, err := New(Config{URL: srv.URL, BatchSize: 2, FlushInterval: 50 * time.Millisecond,
+		Types: []cloudflaredmanager.EventType{cloudflaredmanager.EventFailed, cloudflaredmanager.EventRestarting}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	events := make(chan cloudflaredmanager.Event, 8)
+	done := make(chan struct{})
+	go func() { s.Run(context.Background(), events); close(done) }()
+
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventReady, Hostname: "skipped"}
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventRestarting, Hostname: "a", Attempt: 1, Error: "exit status 1"}
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventFailed, Hostname: "a", Attempt: 4}
+	rec.wait(t) // full batch
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventFailed, Hostname: "b"}
+	rec.wait(t) // flushed by the interval
+	close(events)
+	<-done
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.batches) != 2 || len(rec.batches[0]) != 2 || len(rec.batches[1]) != 1 {
+		t.Fatalf("unexpected batches %+v", rec.batches)
+	}
+	if first := rec.batches[0][0]; first.Hostname != "a" || first.Attempt != 1 || first.Error != "exit status 1" {
+		t.Fatalf("unexpected event %+v", first)
+	}
+}
+
+func TestSinkRetries(t *testing.T) {
+	rec, srv := newRecorder(2)
+	defer srv.Close()
+	s, err := New(Config{URL: srv.URL, BatchSize: 1, MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.retryBackoff = 10 * time.Millisecond
+	events := make(chan cloudflaredmanager.Event, 1)
+	go s.Run(context.Background(), events)
+	defer close(events)
+
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventFailed, Hostname: "a"}
+	rec.wait(t)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.attempts != 3 {
+		t.Fatalf("expected two retries, got %d attempts", rec.attempts)
+	}
+}
+
+func TestSinkGivesUp(t *testing.T) {
+	rec, srv := newRecorder(100)
+	defer srv.Close()
+	s, err := New(Config{URL: srv.URL, BatchSize: 1, MaxRetries: 1})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.retryBackoff = 10 * time.Millisecond
+	events := make(chan cloudflaredmanager.Event, 1)
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventFailed}
+	close(events)
+	s.Run(context.Background(), events)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.attempts != 2 || len(rec.batches) != 0 {
+		t.Fatalf("expected the batch dropped after one retry, got %d attempts", rec.attempts)
+	}
+}
+
+func TestSinkFlushesOnCancel(t *testing.T) {
+	rec, srv := newRecorder(0)
+	defer srv.Close()
+	s, err := New(Config{URL: srv.URL, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan cloudflaredmanager.Event, 1)
+	done := make(chan struct{})
+	go func() { s.Run(ctx, events); close(done) }()
+	events <- cloudflaredmanager.Event{Type: cloudflaredmanager.EventForceStopped}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	rec.wait(t)
+}
+
+func TestNewRejectsBadURL(t *testing.T) {
+	for _, u := range []string{"", "ftp://example.com", "/relative", "http://"} {
+		if _, err := New(Config{URL: u}); err == nil {
+			t.Fatalf("expected error for %q", u)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Package clienthello parses TLS ClientHello handshake messages into a structured form.
+//
+// Parse checks the framing only: every length prefix is bounds-checked, the message must end exactly where its
+// fields and extension list do, and duplicate extensions are rejected (RFC 8446 section 4.2). Extension bodies
+// are kept undecoded; the typed accessors (ServerName, SupportedVersions, ...) decode one on demand and reject
+// a body they do not consume exactly. Parsed byte slices alias the input buffer; callers that retain a
+// ClientHello beyond the lifetime of the input must copy it.
+package clienthello
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Extension type codepoints understood by the typed decoders.
+const (
+	ExtensionServerName           uint16 = 0
+	ExtensionSupportedGroups      uint16 = 10
+	ExtensionSignatureAlgorithms  uint16 = 13
+	ExtensionALPN                 uint16 = 16
+	ExtensionSupportedVersions    uint16 = 43
+	ExtensionKeyShare             uint16 = 51
+	ExtensionECHOuterExtensions   uint16 = 0xfd00
+	ExtensionEncryptedClientHello uint16 = 0xfe0d
+)
+
+const handshakeTypeClientHello = 0x01
+
+var (
+	// ErrNotClientHello is returned when the handshake message type is not client_hello.
+	ErrNotClientHello = errors.New("clienthello: first handshake message is not ClientHello")
+	// ErrTruncated is returned when the handshake header announces more bytes than were supplied.
+	ErrTruncated = errors.New("clienthello: truncated ClientHello")
+	// ErrNoServerName is returned by ServerName when no host_name entry is present.
+	ErrNoServerName = errors.New("clienthello: SNI not found in ClientHello")
+)
+
+// ClientHello is the structured form of a TLS ClientHello message.
+type ClientHello struct {
+	Version            uint16 // legacy_version
+	Random             []byte // 32 bytes
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+	Extensions         []Extension // in wire order
+
+	// Raw is the complete handshake message, including the 4-byte handshake header.
+	Raw []byte
+}
+
+// Extension is a raw TLS extension as it appeared on the wire.
+type Extension struct {
+	Type uint16
+	Data []byte
+	// Offset is the position of Data within ClientHello.Raw.
+	Offset int
+}
+
+// KeyShare is a single key_share entry.
+type KeyShare struct {
+	Group       uint16
+	KeyExchange []byte
+}
+
+// Parse decodes a handshake message (handshake header plus body), as carried in the payload of one or more
+// TLS handshake records. Bytes following the ClientHello message are ignored.
+func Parse(msg []byte) (*ClientHello, error) {
+	if len(msg) < 4 {
+		return nil, fmt.Errorf("clienthello: handshake message too short (%d bytes)", len(msg))
+	}
+	if msg[0] != handshakeTypeClientHello {
+		return nil, ErrNotClientHello
+	}
+	bodyLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if 4+bodyLen > len(msg) {
+		return nil, ErrTruncated
+	}
+	ch := &ClientHello{Raw: msg[:4+bodyLen]}
+	r := reader(msg[4 : 4+bodyLen])
+
+	var ok bool
+	if ch.Version, ok = r.uint16(); !ok {
+		return nil, malformed("version")
+	}
+	if ch.Random, ok = r.bytes(32); !ok {
+		return nil, malformed("random")
+	}
+	if ch.SessionID, ok = r.vector8(); !ok || len(ch.SessionID) > 32 {
+		return nil, malformed("session id")
+	}
+	suites, ok := r.vector16()
+	if !ok || len(suites) == 0 || len(suites)%2 != 0 {
+		return nil, malformed("cipher suites")
+	}
+	ch.CipherSuites = make([]uint16, 0, len(suites)/2)
+	for sr := reader(suites); !sr.empty(); {
+		v, _ := sr.uint16()
+		ch.CipherSuites = append(ch.CipherSuites, v)
+	}
+	comp, ok := r.vector8()
+	if !ok || len(comp) == 0 {
+		return nil, malformed("compression methods")
+	}
+	ch.CompressionMethods = comp
+
+	// Extensions are optional in pre-TLS 1.3 ClientHellos.
+	if r.empty() {
+		return ch, nil
+	}
+	exts, ok := r.vector16()
+	if !ok || !r.empty() {
+		return nil, malformed("extensions")
+	}
+	extsStart := len(ch.Raw) - len(exts)
+	seen := make(map[uint16]struct{})
+	for er := reader(exts); !er.empty(); {
+		typ, ok := er.uint16()
+		if !ok {
+			return nil, malformed("extension type")
+		}
+		data, ok := er.vector16()
+		if !ok {
+			return nil, malformed("extension length")
+		}
+		if _, dup := seen[typ]; dup {
+			return nil, fmt.Errorf("clienthello: duplicate extension %d", typ)
+		}
+		seen[typ] = struct{}{}
+		offset := extsStart + len(exts) - len(er) - len(data)
+		ch.Extensions = append(ch.Extensions, Extension{Type: typ, Data: data, Offset: offset})
+	}
+	return ch, nil
+}
+
+// Extension returns the body of the extension with the given type, if present.
+func (ch *ClientHello) Extension(typ uint16) ([]byte, bool) {
+	for _, ext := range ch.Extensions {
+		if ext.Type == typ {
+			return ext.Data, true
+		}
+	}
+	return nil, false
+}
+
+// ServerName returns the host_name entry of the server_name extension.
+func (ch *ClientHello) ServerName() (string, error) {
+	data, ok := ch.Extension(ExtensionServerName)
+	if !ok {
+		return "", ErrNoServerName
+	}
+	return ParseServerName(data)
+}
+
+// ALPNProtocols returns the protocols offered in the application_layer_protocol_negotiation extension.
+func (ch *ClientHello) ALPNProtocols() ([]string, error) {
+	data, ok := ch.Extension(ExtensionALPN)
+	if !ok {
+		return nil, nil
+	}
+	return ParseALPN(data)
+}
+
+// SupportedVersions returns the versions listed in the supported_versions extension, GREASE included.
+func (ch *ClientHello) SupportedVersions() ([]uint16, error) {
+	data, ok := ch.Extension(ExtensionSupportedVersions)
+	if !ok {
+		return nil, nil
+	}
+	return ParseSupportedVersions(data)
+}
+
+// KeyShares returns the client_shares of the key_share extension.
+func (ch *ClientHello) KeyShares() ([]KeyShare, error) {
+	data, ok := ch.Extension(ExtensionKeyShare)
+	if !ok {
+		return nil, nil
+	}
+	return ParseKeyShares(data)
+}
+
+// SignatureAlgorithms returns the schemes listed in the signature_algorithms extension.
+func (ch *ClientHello) SignatureAlgorithms() ([]uint16, error) {
+	data, ok := ch.Extension(ExtensionSignatureAlgorithms)
+	if !ok {
+		return nil, nil
+	}
+	return ParseSignatureAlgorithms(data)
+}
+
+// HasECH reports whether the client sent an encrypted_client_hello extension.
+func (ch *ClientHello) HasECH() bool {
+	_, ok := ch.Extension(ExtensionEncryptedClientHello)
+	return ok
+}
+
+// ECH decodes the encrypted_client_hello extension, returning nil if it is absent.
+func (ch *ClientHello) ECH() (*ECHExtension, error) {
+	data, ok := ch.Extension(ExtensionEncryptedClientHello)
+	if !ok {
+		return nil, nil
+	}
+	return ParseECH(data)
+}
+
+// MaxVersion returns the highest TLS version the client offers. supported_versions takes precedence over
+// legacy_version (RFC 8446 section 4.2.1); GREASE values are ignored. A malformed supported_versions
+// extension yields legacy_version.
+func (ch *ClientHello) MaxVersion() uint16 {
+	versions, err := ch.SupportedVersions()
+	if err != nil || len(versions) == 0 {
+		return ch.Version
+	}
+	var max uint16
+	for _, v := range versions {
+		if !IsGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// IsGREASE reports whether v is a reserved GREASE value (RFC 8701).
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ParseServerName decodes a server_name extension body and returns its host_name entry.
+func ParseServerName(data []byte) (string, error) {
+	r := reader(data)
+	list, ok := r.vector16()
+	if !ok || !r.empty() || len(list) == 0 {
+		return "", malformed("server_name list")
+	}
+	var host string
+	for lr := reader(list); !lr.empty(); {
+		nameType, ok := lr.uint8()
+		if !ok {
+			return "", malformed("server_name type")
+		}
+		name, ok := lr.vector16()
+		if !ok {
+			return "", malformed("server_name entry")
+		}
+		if nameType == 0 && host == "" {
+			if len(name) == 0 {
+				return "", malformed("empty host_name")
+			}
+			host = string(name)
+		}
+	}
+	if host == "" {
+		return "", errors.New("clienthello: SNI extension present but no host name found")
+	}
+	return host, nil
+}
+
+// ParseALPN decodes an application_layer_protocol_negotiation extension body.
+func ParseALPN(data []byte) ([]string, error) {
+	r := reader(data)
+	list, ok := r.vector16()
+	if !ok || !r.empty() || len(list) == 0 {
+		return nil, malformed("ALPN list")
+	}
+	var protos []string
+	for lr := reader(list); !lr.empty(); {
+		p, ok := lr.vector8()
+		if !ok || len(p) == 0 {
+			return nil, malformed("ALPN protocol")
+		}
+		protos = append(protos, string(p))
+	}
+	return protos, nil
+}
+
+// ParseSupportedVersions decodes a ClientHello supported_versions extension body.
+func ParseSupportedVersions(data []byte) ([]uint16, error) {
+	r := reader(data)
+	list, ok := r.vector8()
+	if !ok || !r.empty() || len(list) == 0 || len(list)%2 != 0 {
+		return nil, malformed("supported_versions")
+	}
+	return uint16List(list), nil
+}
+
+// ParseSignatureAlgorithms decodes a signature_algorithms extension body.
+func ParseSignatureAlgorithms(data []byte) ([]uint16, error) {
+	r := reader(data)
+	list, ok := r.vector16()
+	if !ok || !r.empty() || len(list) == 0 || len(list)%2 != 0 {
+		return nil, malformed("signature_algorithms")
+	}
+	return uint16List(list), nil
+}
+
+// ParseKeyShares decodes a ClientHello key_share extension body.
+func ParseKeyShares(data []byte) ([]KeyShare, error) {
+	r := reader(data)
+	list, ok := r.vector16()
+	if !ok || !r.empty() {
+		return nil, malformed("key_share list")
+	}
+	var shares []KeyShare
+	for lr := reader(list); !lr.empty(); {
+		group, ok := lr.uint16()
+		if !ok {
+			return nil, malformed("key_share group")
+		}
+		key, ok := lr.vector16()
+		if !ok || len(key) == 0 {
+			return nil, malformed("key_share key_exchange")
+		}
+		shares = append(shares, KeyShare{Group: group, KeyExchange: key})
+	}
+	return shares, nil
+}
+
+// ECHClientHelloType distinguishes the outer and inner forms of the encrypted_client_hello extension.
+const (
+	ECHTypeOuter uint8 = 0
+	ECHTypeInner uint8 = 1
+)
+
+// ECHExtension is a decoded encrypted_client_hello extension (draft-ietf-tls-esni section 5). Only Type is
+// set for the inner variant.
+type ECHExtension struct {
+	Type     uint8
+	KDFID    uint16
+	AEADID   uint16
+	ConfigID uint8
+	Enc      []byte
+	Payload  []byte
+}
+
+// ParseECH decodes an encrypted_client_hello extension body sent in a ClientHello.
+func ParseECH(data []byte) (*ECHExtension, error) {
+	r := reader(data)
+	typ, ok := r.uint8()
+	if !ok {
+		return nil, malformed("encrypted_client_hello type")
+	}
+	ext := &ECHExtension{Type: typ}
+	switch typ {
+	case ECHTypeInner:
+		if !r.empty() {
+			return nil, malformed("inner encrypted_client_hello")
+		}
+		return ext, nil
+	case ECHTypeOuter:
+	default:
+		return nil, fmt.Errorf("clienthello: unknown encrypted_client_hello type %d", typ)
+	}
+	if ext.KDFID, ok = r.uint16(); !ok {
+		return nil, malformed("encrypted_client_hello cipher suite")
+	}
+	if ext.AEADID, ok = r.uint16(); !ok {
+		return nil, malformed("encrypted_client_hello cipher suite")
+	}
+	if ext.ConfigID, ok = r.uint8(); !ok {
+		return nil, malformed("encrypted_client_hello config id")
+	}
+	if ext.Enc, ok = r.vector16(); !ok {
+		return nil, malformed("encrypted_client_hello enc")
+	}
+	if ext.Payload, ok = r.vector16(); !ok || len(ext.Payload) == 0 || !r.empty() {
+		return nil, malformed("encrypted_client_hello payload")
+	}
+	return ext, nil
+}
+
+func uint16List(b []byte) []uint16 {
+	out := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		out = append(out, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return out
+}
+
+func malformed(what string) error {
+	return fmt.Errorf("clienthello: malformed ClientHello (%s)", what)
+}
@@ -0,0 +1,181 @@
+package clienthello
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureGoClientHello runs a crypto/tls client against a pipe and returns the handshake message it sends.
+func captureGoClientHello(t testing.TB, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("read record body: %v", err)
+	}
+	return body
+}
+
+func TestParseGoClientHello(t *testing.T) {
+	msg := captureGoClientHello(t, &tls.Config{
+		ServerName: "db.ratio1.link",
+		NextProtos: []string{"h2", "postgresql"},
+		MinVersion: tls.VersionTLS12,
+	})
+
+	ch, err := Parse(msg)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if ch.Version != tls.VersionTLS12 {
+		t.Fatalf("Version = %#04x, want TLS 1.2 legacy_version", ch.Version)
+	}
+	if len(ch.Random) != 32 || len(ch.CipherSuites) == 0 || len(ch.CompressionMethods) != 1 {
+		t.Fatalf("unexpected fixed fields: random=%d suites=%d comp=%v", len(ch.Random), len(ch.CipherSuites), ch.CompressionMethods)
+	}
+	if !bytes.Equal(ch.Raw, msg) {
+		t.Fatalf("Raw does not cover the full message")
+	}
+
+	if name, err := ch.ServerName(); err != nil || name != "db.ratio1.link" {
+		t.Fatalf("ServerName = %q, %v", name, err)
+	}
+	if alpn, err := ch.ALPNProtocols(); err != nil || len(alpn) != 2 || alpn[1] != "postgresql" {
+		t.Fatalf("ALPNProtocols = %v, %v", alpn, err)
+	}
+	if ch.MaxVersion() != tls.VersionTLS13 {
+		t.Fatalf("MaxVersion = %#04x, want TLS 1.3", ch.MaxVersion())
+	}
+	if shares, err := ch.KeyShares(); err != nil || len(shares) == 0 {
+		t.Fatalf("KeyShares = %v, %v", shares, err)
+	}
+	if algs, err := ch.SignatureAlgorithms(); err != nil || len(algs) == 0 {
+		t.Fatalf("SignatureAlgorithms = %v, %v", algs, err)
+	}
+	if ch.HasECH() {
+		t.Fatalf("HasECH reported true without ECH config")
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	valid := captureGoClientHello(t, &tls.Config{ServerName: "db.ratio1.link"})
+
+	cases := map[string][]byte{
+		"empty":            nil,
+		"not client hello": append([]byte{0x02}, valid[1:]...),
+		"truncated":        valid[:len(valid)-1],
+		"short body":       {0x01, 0x00, 0x00, 0x02, 0x03, 0x03},
+	}
+	for name, msg := range cases {
+		if _, err := Parse(msg); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if _, err := Parse(cases["truncated"]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("truncated: expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestParseRejectsDuplicateExtensions(t *testing.T) {
+	ext := []byte{0x00, 0x17, 0x00, 0x00} // extended_master_secret, empty
+	msg := buildHello(append(append([]byte{}, ext...), ext...))
+	if _, err := Parse(msg); err == nil {
+		t.Fatalf("expected duplicate extension error")
+	}
+}
+
+func TestParseWithoutExtensions(t *testing.T) {
+	ch, err := Parse(buildHello(nil))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := ch.ServerName(); !errors.Is(err, ErrNoServerName) {
+		t.Fatalf("expected ErrNoServerName, got %v", err)
+	}
+}
+
+func TestTypedDecodersRejectTrailingBytes(t *testing.T) {
+	if _, err := ParseServerName([]byte{0x00, 0x04, 0x00, 0x00, 0x01, 'a', 0xff}); err == nil {
+		t.Fatalf("ParseServerName accepted trailing byte")
+	}
+	if _, err := ParseSupportedVersions([]byte{0x03, 0x03, 0x04, 0x03}); err == nil {
+		t.Fatalf("ParseSupportedVersions accepted odd-length list")
+	}
+	if _, err := ParseALPN([]byte{0x00, 0x01, 0x00}); err == nil {
+		t.Fatalf("ParseALPN accepted empty protocol name")
+	}
+	if _, err := ParseKeyShares([]byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x05}); err == nil {
+		t.Fatalf("ParseKeyShares accepted truncated key_exchange")
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	if !IsGREASE(0x0a0a) || !IsGREASE(0xfafa) {
+		t.Fatalf("expected GREASE values to be recognized")
+	}
+	if IsGREASE(tls.VersionTLS13) || IsGREASE(0x0a1a) {
+		t.Fatalf("non-GREASE value reported as GREASE")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(captureGoClientHello(f, &tls.Config{ServerName: "db.ratio1.link", NextProtos: []string{"h2"}}))
+	f.Add(buildHello(nil))
+	f.Add(buildHello([]byte{0x00, 0x00, 0x00, 0x05, 0x00, 0x03, 0x00, 0x00, 0x00}))
+	f.Add([]byte{0x01, 0x00, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		ch, err := Parse(msg)
+		if err != nil {
+			return
+		}
+		if len(ch.Random) != 32 || len(ch.Raw) > len(msg) {
+			t.Fatalf("inconsistent parse: random=%d raw=%d msg=%d", len(ch.Random), len(ch.Raw), len(msg))
+		}
+		// Typed decoders must never panic on whatever extension bodies the parser accepted.
+		_, _ = ch.ServerName()
+		_, _ = ch.ALPNProtocols()
+		_, _ = ch.SupportedVersions()
+		_, _ = ch.KeyShares()
+		_, _ = ch.SignatureAlgorithms()
+		_, _ = ch.ECH()
+		_ = ch.MaxVersion()
+		_ = ch.HasECH()
+		for _, ext := range ch.Extensions {
+			if !bytes.Equal(ch.Raw[ext.Offset:ext.Offset+len(ext.Data)], ext.Data) {
+				t.Fatalf("extension %d offset %d does not point at its data", ext.Type, ext.Offset)
+			}
+		}
+	})
+}
+
+// buildHello assembles a minimal ClientHello with the given raw extensions block (nil omits the block).
+func buildHello(exts []byte) []byte {
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03})
+	body.Write(bytes.Repeat([]byte{0x01}, 32))
+	body.WriteByte(0x00)
+	body.Write([]byte{0x00, 0x02, 0x13, 0x01})
+	body.Write([]byte{0x01, 0x00})
+	if exts != nil {
+		body.Write([]byte{byte(len(exts) >> 8), byte(len(exts))})
+		body.Write(exts)
+	}
+	msg := []byte{0x01, byte(body.Len() >> 16), byte(body.Len() >> 8), byte(body.Len())}
+	return append(msg, body.Bytes()...)
+}
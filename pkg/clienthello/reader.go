@@ -0,0 +1,48 @@
+package clienthello
+
+// reader is a minimal bounds-checked cursor over a byte slice. Every method returns ok=false instead of
+// panicking when the input is too short, leaving the reader in an unspecified state.
+type reader []byte
+
+func (r *reader) empty() bool { return len(*r) == 0 }
+
+func (r *reader) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+	out := (*r)[:n:n]
+	*r = (*r)[n:]
+	return out, true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), true
+}
+
+func (r *reader) vector8() ([]byte, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r *reader) vector16() ([]byte, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
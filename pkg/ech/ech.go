@@ -0,0 +1,391 @@
+// Package ech implements the client-facing server role of TLS Encrypted Client Hello (draft-ietf-tls-esni):
+// it decrypts the inner ClientHello so the proxy can route on the real SNI, without terminating TLS. The
+// original bytes are forwarded unchanged, so the backend must hold the same keys to complete the handshake.
+package ech
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"tcp-tunnel-proxy/pkg/clienthello"
+)
+
+const echConfigVersion = 0xfe0d
+
+var (
+	// ErrNoECH is returned by Decrypt when the ClientHello carries no outer ECH extension.
+	ErrNoECH = errors.New("ech: ClientHello has no outer encrypted_client_hello extension")
+	// ErrUnknownConfig is returned by Decrypt when no key matches the client's config id and cipher suite.
+	ErrUnknownConfig = errors.New("ech: no key matches the ECH config id and cipher suite")
+)
+
+// Key is a serialized ECHConfig with its X25519 private key. Its JSON form (base64 fields) matches the
+// fields of crypto/tls.EncryptedClientHelloKey, so the same file can configure a Go backend.
+type Key struct {
+	Config     []byte `json:"config"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+type cipherSuite struct {
+	kdf, aead uint16
+}
+
+type parsedKey struct {
+	raw        []byte // marshalled ECHConfig, as used in the HPKE info string
+	configID   uint8
+	publicName string
+	suites     []cipherSuite
+	priv       *ecdh.PrivateKey
+}
+
+// KeySet holds the ECH keys used to decrypt inner ClientHellos.
+type KeySet struct {
+	keys []parsedKey
+}
+
+// GenerateKey creates a fresh X25519 key and the matching ECHConfig advertising HKDF-SHA256 with
+// AES-128-GCM and AES-256-GCM.
+func GenerateKey(publicName string, configID uint8) (Key, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return Key{}, fmt.Errorf("ech: invalid public name %q", publicName)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, err
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var contents []byte
+	contents = append(contents, configID)
+	contents = binary.BigEndian.AppendUint16(contents, KEMX25519HKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 8)
+	contents = binary.BigEndian.AppendUint16(contents, KDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, AEADAES128GCM)
+	contents = binary.BigEndian.AppendUint16(contents, KDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, AEADAES256GCM)
+	contents = append(contents, 0) // maximum_name_length: let clients use their default padding
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // no extensions
+
+	config := binary.BigEndian.AppendUint16(nil, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return Key{Config: config, PrivateKey: priv.Bytes()}, nil
+}
+
+// NewKeySet validates the keys and returns a set ready for decryption.
+func NewKeySet(keys []Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("ech: no keys configured")
+	}
+	ks := &KeySet{}
+	for i, k := range keys {
+		pk, err := parseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("ech: key %d: %w", i, err)
+		}
+		ks.keys = append(ks.keys, pk)
+	}
+	return ks, nil
+}
+
+// LoadKeysFile reads a JSON document of the form {"keys": [{"config": "<base64>", "private_key": "<base64>"}]}.
+func LoadKeysFile(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ech: read keys file: %w", err)
+	}
+	var kf keysFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("ech: parse keys file %s: %w", path, err)
+	}
+	return NewKeySet(kf.Keys)
+}
+
+// MarshalKeysFile renders keys in the format read by LoadKeysFile.
+func MarshalKeysFile(keys []Key) ([]byte, error) {
+	return json.MarshalIndent(keysFile{Keys: keys}, "", "  ")
+}
+
+// ConfigList returns the ECHConfigList to publish in the "ech" parameter of the HTTPS DNS record.
+func (ks *KeySet) ConfigList() []byte {
+	var body []byte
+	for _, k := range ks.keys {
+		body = append(body, k.raw...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+// ConfigListBase64 returns ConfigList in the base64 form used by DNS zone files.
+func (ks *KeySet) ConfigListBase64() string {
+	return base64.StdEncoding.EncodeToString(ks.ConfigList())
+}
+
+// PublicNames returns the public names of the configured ECH configs.
+func (ks *KeySet) PublicNames() []string {
+	names := make([]string, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		names = append(names, k.publicName)
+	}
+	return names
+}
+
+// Decrypt decrypts and reconstructs the ClientHelloInner carried by outer. It returns ErrNoECH if the client
+// did not offer ECH and ErrUnknownConfig if none of the keys matches; in both cases the caller should route
+// on the outer SNI, as the backend will reject ECH and complete the handshake with the public name.
+func (ks *KeySet) Decrypt(outer *clienthello.ClientHello) (*clienthello.ClientHello, error) {
+	ext, err := outer.ECH()
+	if err != nil {
+		return nil, err
+	}
+	if ext == nil || ext.Type != clienthello.ECHTypeOuter {
+		return nil, ErrNoECH
+	}
+
+	aad, err := outerAAD(outer, ext)
+	if err != nil {
+		return nil, err
+	}
+	info := []byte("tls ech\x00")
+
+	for _, k := range ks.keys {
+		if k.configID != ext.ConfigID || !k.supports(ext.KDFID, ext.AEADID) {
+			continue
+		}
+		encoded, err := openBase(k.priv, ext.KDFID, ext.AEADID, ext.Enc, append(info[:len(info):len(info)], k.raw...), aad, ext.Payload)
+		if err != nil {
+			// Config ids are not unique; keep trying other keys with the same id.
+			continue
+		}
+		return decodeInner(outer, encoded)
+	}
+	return nil, ErrUnknownConfig
+}
+
+func (k parsedKey) supports(kdf, aead uint16) bool {
+	for _, s := range k.suites {
+		if s.kdf == kdf && s.aead == aead {
+			return true
+		}
+	}
+	return false
+}
+
+// outerAAD builds ClientHelloOuterAAD: the outer ClientHello body with the ECH payload zeroed.
+func outerAAD(outer *clienthello.ClientHello, ext *clienthello.ECHExtension) ([]byte, error) {
+	for _, e := range outer.Extensions {
+		if e.Type != clienthello.ExtensionEncryptedClientHello {
+			continue
+		}
+		payloadStart := e.Offset + len(e.Data) - len(ext.Payload)
+		aad := append([]byte{}, outer.Raw[4:]...)
+		clear(aad[payloadStart-4 : payloadStart-4+len(ext.Payload)])
+		return aad, nil
+	}
+	return nil, ErrNoECH
+}
+
+// decodeInner turns EncodedClientHelloInner into a complete ClientHelloInner handshake message: it restores
+// legacy_session_id from the outer hello, expands ech_outer_extensions and drops the trailing padding.
+func decodeInner(outer *clienthello.ClientHello, encoded []byte) (*clienthello.ClientHello, error) {
+	r := bytes.NewReader(encoded)
+	fixed := make([]byte, 2+32)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, errors.New("ech: EncodedClientHelloInner too short")
+	}
+	sidLen, err := r.ReadByte()
+	if err != nil || sidLen != 0 {
+		return nil, errors.New("ech: EncodedClientHelloInner must have an empty legacy_session_id")
+	}
+	suites, err := readVector(r, 2)
+	if err != nil {
+		return nil, fmt.Errorf("ech: inner cipher suites: %w", err)
+	}
+	comp, err := readVector(r, 1)
+	if err != nil {
+		return nil, fmt.Errorf("ech: inner compression methods: %w", err)
+	}
+	exts, err := readVector(r, 2)
+	if err != nil {
+		return nil, fmt.Errorf("ech: inner extensions: %w", err)
+	}
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return nil, errors.New("ech: non-zero padding in EncodedClientHelloInner")
+		}
+	}
+
+	expanded, err := expandOuterExtensions(outer, exts)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	body = append(body, fixed...)
+	body = append(body, byte(len(outer.SessionID)))
+	body = append(body, outer.SessionID...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(suites)))
+	body = append(body, suites...)
+	body = append(body, byte(len(comp)))
+	body = append(body, comp...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(expanded)))
+	body = append(body, expanded...)
+	msg := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+
+	inner, err := clienthello.Parse(append(msg, body...))
+	if err != nil {
+		return nil, fmt.Errorf("ech: inner ClientHello: %w", err)
+	}
+	if ext, err := inner.ECH(); err != nil || ext == nil || ext.Type != clienthello.ECHTypeInner {
+		return nil, errors.New("ech: inner ClientHello lacks an inner encrypted_client_hello extension")
+	}
+	return inner, nil
+}
+
+// expandOuterExtensions replaces an ech_outer_extensions entry with the referenced extensions copied from the
+// outer ClientHello, in order (draft-ietf-tls-esni section 5.1).
+func expandOuterExtensions(outer *clienthello.ClientHello, exts []byte) ([]byte, error) {
+	var out []byte
+	r := bytes.NewReader(exts)
+	for r.Len() > 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, errors.New("ech: truncated inner extension")
+		}
+		typ := binary.BigEndian.Uint16(hdr[:])
+		data, err := readVector(r, 2)
+		if err != nil {
+			return nil, fmt.Errorf("ech: inner extension %d: %w", typ, err)
+		}
+		if typ != clienthello.ExtensionECHOuterExtensions {
+			out = binary.BigEndian.AppendUint16(out, typ)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+			out = append(out, data...)
+			continue
+		}
+
+		refs, err := readVector(bytes.NewReader(data), 1)
+		if err != nil || len(refs) == 0 || len(refs)%2 != 0 || len(refs)+1 != len(data) {
+			return nil, errors.New("ech: malformed ech_outer_extensions")
+		}
+		next := 0
+		for i := 0; i < len(refs); i += 2 {
+			ref := binary.BigEndian.Uint16(refs[i:])
+			if ref == clienthello.ExtensionEncryptedClientHello {
+				return nil, errors.New("ech: ech_outer_extensions references encrypted_client_hello")
+			}
+			found := false
+			for ; next < len(outer.Extensions); next++ {
+				if outer.Extensions[next].Type == ref {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("ech: ech_outer_extensions references missing or out-of-order extension %d", ref)
+			}
+			ext := outer.Extensions[next]
+			next++
+			out = binary.BigEndian.AppendUint16(out, ext.Type)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(ext.Data)))
+			out = append(out, ext.Data...)
+		}
+	}
+	if len(out) > 0xffff {
+		return nil, errors.New("ech: reconstructed extensions too long")
+	}
+	return out, nil
+}
+
+func readVector(r *bytes.Reader, lenBytes int) ([]byte, error) {
+	var n int
+	for i := 0; i < lenBytes; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("truncated length")
+		}
+		n = n<<8 | int(b)
+	}
+	if n > r.Len() {
+		return nil, errors.New("length exceeds input")
+	}
+	out := make([]byte, n)
+	_, _ = r.Read(out)
+	return out, nil
+}
+
+func parseKey(k Key) (parsedKey, error) {
+	r := bytes.NewReader(k.Config)
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return parsedKey{}, errors.New("ECHConfig too short")
+	}
+	if v := binary.BigEndian.Uint16(hdr[:2]); v != echConfigVersion {
+		return parsedKey{}, fmt.Errorf("unsupported ECHConfig version 0x%04x", v)
+	}
+	if int(binary.BigEndian.Uint16(hdr[2:])) != r.Len() {
+		return parsedKey{}, errors.New("ECHConfig length mismatch")
+	}
+
+	pk := parsedKey{raw: k.Config}
+	var err error
+	if pk.configID, err = r.ReadByte(); err != nil {
+		return parsedKey{}, errors.New("ECHConfig truncated")
+	}
+	var kem [2]byte
+	if _, err := io.ReadFull(r, kem[:]); err != nil {
+		return parsedKey{}, errors.New("ECHConfig truncated")
+	}
+	if id := binary.BigEndian.Uint16(kem[:]); id != KEMX25519HKDFSHA256 {
+		return parsedKey{}, fmt.Errorf("unsupported KEM 0x%04x (only X25519 is supported)", id)
+	}
+	pub, err := readVector(r, 2)
+	if err != nil {
+		return parsedKey{}, fmt.Errorf("ECHConfig public key: %w", err)
+	}
+	suites, err := readVector(r, 2)
+	if err != nil || len(suites) == 0 || len(suites)%4 != 0 {
+		return parsedKey{}, errors.New("ECHConfig cipher suites malformed")
+	}
+	for i := 0; i < len(suites); i += 4 {
+		pk.suites = append(pk.suites, cipherSuite{
+			kdf:  binary.BigEndian.Uint16(suites[i:]),
+			aead: binary.BigEndian.Uint16(suites[i+2:]),
+		})
+	}
+	if _, err := r.ReadByte(); err != nil { // maximum_name_length
+		return parsedKey{}, errors.New("ECHConfig truncated")
+	}
+	name, err := readVector(r, 1)
+	if err != nil || len(name) == 0 {
+		return parsedKey{}, errors.New("ECHConfig public name malformed")
+	}
+	pk.publicName = string(name)
+	if _, err := readVector(r, 2); err != nil || r.Len() != 0 {
+		return parsedKey{}, errors.New("ECHConfig extensions malformed")
+	}
+
+	pk.priv, err = ecdh.X25519().NewPrivateKey(k.PrivateKey)
+	if err != nil {
+		return parsedKey{}, fmt.Errorf("invalid X25519 private key: %w", err)
+	}
+	if !bytes.Equal(pk.priv.PublicKey().Bytes(), pub) {
+		return parsedKey{}, errors.New("private key does not match the ECHConfig public key")
+	}
+	return pk, nil
+}
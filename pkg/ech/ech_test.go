@@ -0,0 +1,134 @@
+package ech
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"tcp-tunnel-proxy/pkg/clienthello"
+)
+
+// captureHello runs a crypto/tls client against a pipe and returns the first handshake message it sends.
+func captureHello(t *testing.T, cfg *tls.Config) *clienthello.ClientHello {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("read record body: %v", err)
+	}
+	hello, err := clienthello.Parse(body)
+	if err != nil {
+		t.Fatalf("parse outer ClientHello: %v", err)
+	}
+	return hello
+}
+
+func newTestKeySet(t *testing.T, publicName string, configID uint8) (*KeySet, Key) {
+	t.Helper()
+	key, err := GenerateKey(publicName, configID)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	ks, err := NewKeySet([]Key{key})
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	return ks, key
+}
+
+func TestDecryptGoClientHello(t *testing.T) {
+	ks, _ := newTestKeySet(t, "public.ratio1.link", 7)
+
+	outer := captureHello(t, &tls.Config{
+		ServerName:                     "db-123.ratio1.link",
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: ks.ConfigList(),
+	})
+	if name, _ := outer.ServerName(); name != "public.ratio1.link" {
+		t.Fatalf("outer SNI = %q, want public name", name)
+	}
+
+	inner, err := ks.Decrypt(outer)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if name, err := inner.ServerName(); err != nil || name != "db-123.ratio1.link" {
+		t.Fatalf("inner SNI = %q, %v", name, err)
+	}
+	if inner.MaxVersion() != tls.VersionTLS13 {
+		t.Fatalf("inner MaxVersion = %#04x", inner.MaxVersion())
+	}
+	if string(inner.SessionID) != string(outer.SessionID) {
+		t.Fatalf("inner session id was not restored from the outer hello")
+	}
+}
+
+func TestDecryptRejectsUnknownKey(t *testing.T) {
+	ks, _ := newTestKeySet(t, "public.ratio1.link", 1)
+	other, _ := newTestKeySet(t, "public.ratio1.link", 1)
+
+	outer := captureHello(t, &tls.Config{
+		ServerName:                     "db-123.ratio1.link",
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: other.ConfigList(),
+	})
+	if _, err := ks.Decrypt(outer); !errors.Is(err, ErrUnknownConfig) {
+		t.Fatalf("expected ErrUnknownConfig, got %v", err)
+	}
+
+	plain := captureHello(t, &tls.Config{ServerName: "db-123.ratio1.link"})
+	if _, err := ks.Decrypt(plain); !errors.Is(err, ErrNoECH) {
+		t.Fatalf("expected ErrNoECH, got %v", err)
+	}
+}
+
+func TestNewKeySetValidatesKeys(t *testing.T) {
+	_, key := newTestKeySet(t, "public.ratio1.link", 1)
+	_, otherKey := newTestKeySet(t, "public.ratio1.link", 1)
+
+	if _, err := NewKeySet([]Key{{Config: key.Config, PrivateKey: otherKey.PrivateKey}}); err == nil {
+		t.Fatalf("expected mismatched private key to be rejected")
+	}
+	if _, err := NewKeySet([]Key{{Config: key.Config[:10], PrivateKey: key.PrivateKey}}); err == nil {
+		t.Fatalf("expected truncated config to be rejected")
+	}
+	if _, err := NewKeySet(nil); err == nil {
+		t.Fatalf("expected empty key set to be rejected")
+	}
+}
+
+func TestKeysFileRoundTripsWithCryptoTLS(t *testing.T) {
+	_, key := newTestKeySet(t, "public.ratio1.link", 3)
+	data, err := MarshalKeysFile([]Key{key})
+	if err != nil {
+		t.Fatalf("MarshalKeysFile: %v", err)
+	}
+	path := t.TempDir() + "/ech.json"
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write keys file: %v", err)
+	}
+	ks, err := LoadKeysFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeysFile: %v", err)
+	}
+	if names := ks.PublicNames(); len(names) != 1 || names[0] != "public.ratio1.link" {
+		t.Fatalf("PublicNames = %v", names)
+	}
+	if ks.ConfigListBase64() == "" {
+		t.Fatalf("empty ConfigListBase64")
+	}
+}
@@ -0,0 +1,118 @@
+package ech
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HPKE identifiers (RFC 9180 section 7). Only DHKEM(X25519, HKDF-SHA256) with HKDF-SHA256 and AES-GCM is
+// implemented, which is what ECH deployments (and Go's crypto/tls client) use by default.
+const (
+	KEMX25519HKDFSHA256 uint16 = 0x0020
+	KDFHKDFSHA256       uint16 = 0x0001
+	AEADAES128GCM       uint16 = 0x0001
+	AEADAES256GCM       uint16 = 0x0002
+)
+
+const hpkeModeBase = 0x00
+
+// openBase performs HPKE SetupBaseR followed by a single Open with sequence number zero, which is exactly
+// how ECH uses HPKE for the first ClientHello.
+func openBase(priv *ecdh.PrivateKey, kdfID, aeadID uint16, enc, info, aad, ciphertext []byte) ([]byte, error) {
+	if kdfID != KDFHKDFSHA256 {
+		return nil, fmt.Errorf("unsupported HPKE KDF 0x%04x", kdfID)
+	}
+	var keyLen int
+	switch aeadID {
+	case AEADAES128GCM:
+		keyLen = 16
+	case AEADAES256GCM:
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported HPKE AEAD 0x%04x", aeadID)
+	}
+
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HPKE encapsulated key: %w", err)
+	}
+	dh, err := priv.ECDH(pkE)
+	if err != nil {
+		return nil, fmt.Errorf("HPKE decap: %w", err)
+	}
+
+	// Decap: ExtractAndExpand(dh, enc || pkRm) under the KEM suite id.
+	kemSuite := binary.BigEndian.AppendUint16([]byte("KEM"), KEMX25519HKDFSHA256)
+	kemContext := append(append([]byte{}, enc...), priv.PublicKey().Bytes()...)
+	eaePRK, err := labeledExtract(kemSuite, nil, "eae_prk", dh)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := labeledExpand(kemSuite, eaePRK, "shared_secret", kemContext, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// KeySchedule for mode_base with empty PSK.
+	suite := []byte("HPKE")
+	suite = binary.BigEndian.AppendUint16(suite, KEMX25519HKDFSHA256)
+	suite = binary.BigEndian.AppendUint16(suite, kdfID)
+	suite = binary.BigEndian.AppendUint16(suite, aeadID)
+	pskIDHash, err := labeledExtract(suite, nil, "psk_id_hash", nil)
+	if err != nil {
+		return nil, err
+	}
+	infoHash, err := labeledExtract(suite, nil, "info_hash", info)
+	if err != nil {
+		return nil, err
+	}
+	ksContext := append(append([]byte{hpkeModeBase}, pskIDHash...), infoHash...)
+	secret, err := labeledExtract(suite, sharedSecret, "secret", nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := labeledExpand(suite, secret, "key", ksContext, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := labeledExpand(suite, secret, "base_nonce", ksContext, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, errors.New("HPKE open failed")
+	}
+	return plaintext, nil
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) ([]byte, error) {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return hkdf.Expand(sha256.New, prk, string(labeled), length)
+}